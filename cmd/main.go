@@ -7,6 +7,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/yigithankarabulut/distributed-file-storage/compress"
 	"github.com/yigithankarabulut/distributed-file-storage/crypto"
 	"github.com/yigithankarabulut/distributed-file-storage/fileserver"
 	"github.com/yigithankarabulut/distributed-file-storage/p2p"
@@ -30,11 +31,16 @@ func makeServer(listenAddr string, nodes ...string) *fileserver.FileServer {
 		PathTransformFunc: store.CASPathTransformFunc,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
+		Compression:       compress.GzipCodec{},
+		HintTTL:           time.Hour,
+		PeerExchange:      true,
 	}
 
 	s := fileserver.NewFileServer(fileServerOpts)
 
+	tcpTransport.ShakeHands = s.Handshake
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
@@ -62,7 +68,7 @@ func main() {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("picture_%d.png", i)
 		data := bytes.NewReader([]byte("my big data file here!"))
-		_ = s3.Store(key, data)
+		_, _ = s3.Store(key, data)
 
 		if err := s3.Storage.Delete(s3.ID, key); err != nil {
 			log.Fatal(err)
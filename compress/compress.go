@@ -0,0 +1,159 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// None is the name recorded for data that is stored without compression.
+const None = ""
+
+// ErrUnknownCodec is an error that is returned when a codec name is not registered.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec is an interface that can be implemented to compress and decompress
+// data streams. The name of the codec is recorded in the metadata of each
+// stored file, so it must be stable across releases.
+type Codec interface {
+	Name() string
+	NewWriter(io.Writer) (io.WriteCloser, error)
+	NewReader(io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec is a codec that uses the gzip format.
+type GzipCodec struct {
+	Level int
+}
+
+// Name implements the Codec interface.
+func (c GzipCodec) Name() string { return "gzip" }
+
+// NewWriter implements the Codec interface.
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level(c.Level))
+}
+
+// NewReader implements the Codec interface.
+func (c GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ZlibCodec is a codec that uses the zlib format.
+type ZlibCodec struct {
+	Level int
+}
+
+// Name implements the Codec interface.
+func (c ZlibCodec) Name() string { return "zlib" }
+
+// NewWriter implements the Codec interface.
+func (c ZlibCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, level(c.Level))
+}
+
+// NewReader implements the Codec interface.
+func (c ZlibCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// FlateCodec is a codec that uses the raw deflate format without any header.
+type FlateCodec struct {
+	Level int
+}
+
+// Name implements the Codec interface.
+func (c FlateCodec) Name() string { return "flate" }
+
+// NewWriter implements the Codec interface.
+func (c FlateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, level(c.Level))
+}
+
+// NewReader implements the Codec interface.
+func (c FlateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{}
+)
+
+// Register registers a codec so it can be found by its name when reading
+// data back. Registering a codec with an existing name replaces it.
+func Register(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[c.Name()] = c
+}
+
+// Lookup returns the registered codec with the given name.
+func Lookup(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Compress reads from src, compresses the data using the given codec and writes to dst.
+func Compress(c Codec, src io.Reader, dst io.Writer) (int64, error) {
+	w, err := c.NewWriter(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, src)
+	if err != nil {
+		_ = w.Close()
+		return n, err
+	}
+
+	return n, w.Close()
+}
+
+// NewReader returns a reader that decompresses r with the codec registered
+// under the given name. Data recorded with None is returned as it is.
+func NewReader(name string, r io.Reader) (io.ReadCloser, error) {
+	if name == None {
+		return io.NopCloser(r), nil
+	}
+
+	c, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(r)
+}
+
+// Worthwhile reports whether compressing size bytes down to compressedSize bytes
+// saves enough space to be kept. Data that shrinks by less than ratio is
+// considered incompressible and should be stored as it is.
+func Worthwhile(size, compressedSize int64, ratio float64) bool {
+	if size == 0 {
+		return false
+	}
+	return float64(compressedSize) <= float64(size)*ratio
+}
+
+func level(l int) int {
+	if l == 0 {
+		return flate.DefaultCompression
+	}
+	return l
+}
+
+func init() {
+	Register(GzipCodec{})
+	Register(ZlibCodec{})
+	Register(FlateCodec{})
+}
@@ -0,0 +1,49 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	payload := bytes.Repeat([]byte("some log line that repeats itself\n"), 100)
+
+	for _, c := range []Codec{GzipCodec{}, ZlibCodec{}, FlateCodec{}} {
+		buf := new(bytes.Buffer)
+		n, err := Compress(c, bytes.NewReader(payload), buf)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(payload)), n)
+		assert.True(t, Worthwhile(n, int64(buf.Len()), 0.9))
+
+		r, err := NewReader(c.Name(), buf)
+		assert.Nil(t, err)
+
+		out, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, out)
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	payload := make([]byte, 4096)
+	_, _ = rand.Read(payload)
+
+	buf := new(bytes.Buffer)
+	n, err := Compress(GzipCodec{}, bytes.NewReader(payload), buf)
+	assert.Nil(t, err)
+	assert.False(t, Worthwhile(n, int64(buf.Len()), 0.9))
+}
+
+func TestLookup(t *testing.T) {
+	_, err := Lookup("lz4")
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+
+	r, err := NewReader(None, bytes.NewReader([]byte("raw")))
+	assert.Nil(t, err)
+	out, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("raw"), out)
+}
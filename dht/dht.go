@@ -0,0 +1,448 @@
+// Package dht implements a Kademlia distributed hash table that locates the nodes
+// providing a key. Keys and nodes share an ID space with XOR as distance, and every
+// node knows more nodes close to itself than far away, so the nodes closest to a key,
+// which keep the provider records of the key, are found in O(log N) hops.
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of a message.
+type Kind int
+
+const (
+	// FindNode asks for the contacts closest to the target.
+	FindNode Kind = iota
+	// FindValue asks for the providers of the key, along with the contacts closest to it.
+	FindValue
+	// Store asks the receiver to record the sender as a provider of the key.
+	Store
+	// Reply answers a FindNode or FindValue.
+	Reply
+	// Unprovide asks the receiver to drop the record of the sender as a provider of the key.
+	Unprovide
+)
+
+// Message is a message of the protocol.
+type Message struct {
+	Kind Kind
+	Seq  uint64
+	From Contact
+	// Target is the ID that FindNode looks up.
+	Target ID
+	// Key is the key that FindValue looks up, and that Store and Unprovide (un)provide.
+	Key       string
+	Contacts  []Contact
+	Providers []Contact
+}
+
+const (
+	defaultK           = 20
+	defaultAlpha       = 3
+	defaultTimeout     = 2 * time.Second
+	defaultProviderTTL = 24 * time.Hour
+)
+
+var (
+	// ErrNoSend is returned by New when the configuration has no Send function.
+	ErrNoSend = errors.New("dht: no send function configured")
+	// ErrNoContacts is returned by lookups when no other node is known.
+	ErrNoContacts = errors.New("dht: no contacts known")
+	// ErrTimeout is returned when a node does not reply in time.
+	ErrTimeout = errors.New("dht: request timed out")
+)
+
+// Config is the configuration of a DHT node.
+type Config struct {
+	// Self is the contact of this node.
+	Self Contact
+	// K is the size of the buckets of the routing table, and the amount of nodes
+	// closest to a key that keep its provider records.
+	K int
+	// Alpha is the amount of requests a lookup sends in parallel.
+	Alpha int
+	// Timeout is how long a request waits for its reply.
+	Timeout time.Duration
+	// ProviderTTL is how long a provider record is kept, unless Republish renews it.
+	ProviderTTL time.Duration
+
+	// Send sends a message to the node with the given address. Messages may be lost.
+	Send func(addr string, msg Message) error
+}
+
+// DHT is a node of the distributed hash table.
+type DHT struct {
+	cfg   Config
+	table *routingTable
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan Message
+	// providers are the provider records kept by this node, by key and node ID.
+	providers map[string]map[string]provider
+	// provided are the keys that this node provides itself.
+	provided map[string]bool
+}
+
+type provider struct {
+	Contact
+	expires time.Time
+}
+
+// New creates a DHT node that does not know any other node yet.
+func New(cfg Config) (*DHT, error) {
+	if cfg.Send == nil {
+		return nil, ErrNoSend
+	}
+	if cfg.K == 0 {
+		cfg.K = defaultK
+	}
+	if cfg.Alpha == 0 {
+		cfg.Alpha = defaultAlpha
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.ProviderTTL == 0 {
+		cfg.ProviderTTL = defaultProviderTTL
+	}
+
+	return &DHT{
+		cfg:       cfg,
+		table:     newRoutingTable(cfg.Self.ID(), cfg.K),
+		pending:   make(map[uint64]chan Message),
+		providers: make(map[string]map[string]provider),
+		provided:  make(map[string]bool),
+	}, nil
+}
+
+// AddContact adds a node to the routing table, e.g. because it just connected.
+func (d *DHT) AddContact(c Contact) {
+	d.table.update(c)
+}
+
+// RemoveContact removes a node from the routing table, e.g. because it left, along
+// with the records of the keys that it provides.
+func (d *DHT) RemoveContact(nodeID string) {
+	d.table.remove(nodeID)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, providers := range d.providers {
+		delete(providers, nodeID)
+		if len(providers) == 0 {
+			delete(d.providers, key)
+		}
+	}
+}
+
+// Len returns the amount of nodes in the routing table.
+func (d *DHT) Len() int {
+	return d.table.len()
+}
+
+// Bootstrap looks up this node, which fills the routing table with the nodes close
+// to it, and lets them know about this node.
+func (d *DHT) Bootstrap() error {
+	_, err := d.FindNode(d.cfg.Self.ID())
+	return err
+}
+
+// FindNode returns the K nodes closest to target.
+func (d *DHT) FindNode(target ID) ([]Contact, error) {
+	contacts, _, err := d.lookup(target, "", FindNode)
+	return contacts, err
+}
+
+// FindProviders returns the nodes that provide key.
+func (d *DHT) FindProviders(key string) ([]Contact, error) {
+	if local := d.Providers(key); len(local) > 0 {
+		return local, nil
+	}
+
+	_, providers, err := d.lookup(NewID(key), key, FindValue)
+	return providers, err
+}
+
+// Provide records this node as a provider of key on the K nodes closest to it.
+func (d *DHT) Provide(key string) error {
+	d.mu.Lock()
+	d.provided[key] = true
+	d.mu.Unlock()
+
+	d.addProvider(key, d.cfg.Self)
+	return d.sendClosest(key, Store)
+}
+
+// Unprovide drops the records of this node as a provider of key from the K nodes
+// closest to it, e.g. because this node deleted its replica of the key.
+func (d *DHT) Unprovide(key string) error {
+	d.mu.Lock()
+	delete(d.provided, key)
+	d.mu.Unlock()
+
+	d.removeProvider(key, d.cfg.Self.NodeID)
+	return d.sendClosest(key, Unprovide)
+}
+
+// Republish records this node again as a provider of the keys that it provides, on
+// the nodes that are closest to them now. It has to be called more often than the
+// ProviderTTL, or the records expire while this node still provides the keys.
+func (d *DHT) Republish() error {
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.provided))
+	for key := range d.provided {
+		keys = append(keys, key)
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	for _, key := range keys {
+		d.addProvider(key, d.cfg.Self)
+		if err := d.sendClosest(key, Store); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Providers returns the providers of key that are recorded on this node.
+func (d *DHT) Providers(key string) []Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var contacts []Contact
+	for nodeID, p := range d.providers[key] {
+		if time.Now().After(p.expires) {
+			delete(d.providers[key], nodeID)
+			continue
+		}
+		contacts = append(contacts, p.Contact)
+	}
+	return contacts
+}
+
+// Handle handles a message received from another node.
+func (d *DHT) Handle(msg Message) {
+	if msg.From.NodeID != "" {
+		d.table.update(msg.From)
+	}
+
+	// Replies that can not be sent are lost, which the requester handles as a timeout.
+	switch msg.Kind {
+	case FindNode:
+		_ = d.send(msg.From.Addr, Message{
+			Kind:     Reply,
+			Seq:      msg.Seq,
+			Contacts: d.closestExcept(msg.Target, msg.From.NodeID),
+		})
+
+	case FindValue:
+		_ = d.send(msg.From.Addr, Message{
+			Kind:      Reply,
+			Seq:       msg.Seq,
+			Contacts:  d.closestExcept(NewID(msg.Key), msg.From.NodeID),
+			Providers: d.Providers(msg.Key),
+		})
+
+	case Store:
+		d.addProvider(msg.Key, msg.From)
+
+	case Unprovide:
+		d.removeProvider(msg.Key, msg.From.NodeID)
+
+	case Reply:
+		d.mu.Lock()
+		ch, ok := d.pending[msg.Seq]
+		d.mu.Unlock()
+		if ok {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// lookup iteratively queries the closest known nodes to target for closer nodes,
+// until the K closest nodes found have all been queried. A FindValue lookup stops as
+// soon as a node knows providers of the key.
+func (d *DHT) lookup(target ID, key string, kind Kind) ([]Contact, []Contact, error) {
+	shortlist := d.table.closest(target, d.cfg.K)
+	if len(shortlist) == 0 {
+		return nil, nil, ErrNoContacts
+	}
+
+	seen := map[string]bool{d.cfg.Self.NodeID: true}
+	for _, c := range shortlist {
+		seen[c.NodeID] = true
+	}
+	queried := make(map[string]bool)
+
+	type result struct {
+		from  Contact
+		reply Message
+		err   error
+	}
+
+	for {
+		var batch []Contact
+		for _, c := range shortlist {
+			if len(batch) == d.cfg.Alpha {
+				break
+			}
+			if !queried[c.NodeID] {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			return shortlist, nil, nil
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			queried[c.NodeID] = true
+			go func(c Contact) {
+				reply, err := d.request(c, Message{Kind: kind, Target: target, Key: key})
+				results <- result{from: c, reply: reply, err: err}
+			}(c)
+		}
+
+		var providers []Contact
+		failed := make(map[string]bool)
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				failed[r.from.NodeID] = true
+				continue
+			}
+			providers = append(providers, r.reply.Providers...)
+			for _, c := range r.reply.Contacts {
+				if !seen[c.NodeID] {
+					seen[c.NodeID] = true
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+		if len(providers) > 0 {
+			return shortlist, dedupe(providers), nil
+		}
+
+		alive := shortlist[:0]
+		for _, c := range shortlist {
+			if !failed[c.NodeID] {
+				alive = append(alive, c)
+			}
+		}
+		shortlist = alive
+		sortByDistance(shortlist, target)
+		if len(shortlist) > d.cfg.K {
+			shortlist = shortlist[:d.cfg.K]
+		}
+	}
+}
+
+// request sends a request to a node and waits for its reply. Nodes that can not be
+// sent to, or do not reply in time, are removed from the routing table.
+func (d *DHT) request(c Contact, msg Message) (Message, error) {
+	d.mu.Lock()
+	d.seq++
+	msg.Seq = d.seq
+	ch := make(chan Message, 1)
+	d.pending[msg.Seq] = ch
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, msg.Seq)
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(c.Addr, msg); err != nil {
+		d.table.remove(c.NodeID)
+		return Message{}, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-time.After(d.cfg.Timeout):
+		d.table.remove(c.NodeID)
+		return Message{}, ErrTimeout
+	}
+}
+
+// sendClosest sends a message about key to the K nodes closest to it, returning the
+// errors of the nodes that it could not be sent to.
+func (d *DHT) sendClosest(key string, kind Kind) error {
+	closest, err := d.FindNode(NewID(key))
+	if err != nil {
+		if errors.Is(err, ErrNoContacts) {
+			return nil
+		}
+		return err
+	}
+
+	var errs []error
+	for _, c := range closest {
+		if err = d.send(c.Addr, Message{Kind: kind, Key: key}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *DHT) send(addr string, msg Message) error {
+	msg.From = d.cfg.Self
+	return d.cfg.Send(addr, msg)
+}
+
+func (d *DHT) closestExcept(target ID, nodeID string) []Contact {
+	contacts := d.table.closest(target, d.cfg.K+1)
+	for i, c := range contacts {
+		if c.NodeID == nodeID {
+			contacts = append(contacts[:i], contacts[i+1:]...)
+			break
+		}
+	}
+	if len(contacts) > d.cfg.K {
+		contacts = contacts[:d.cfg.K]
+	}
+	return contacts
+}
+
+func (d *DHT) addProvider(key string, c Contact) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.providers[key]; !ok {
+		d.providers[key] = make(map[string]provider)
+	}
+	d.providers[key][c.NodeID] = provider{Contact: c, expires: time.Now().Add(d.cfg.ProviderTTL)}
+}
+
+func (d *DHT) removeProvider(key, nodeID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.providers[key], nodeID)
+	if len(d.providers[key]) == 0 {
+		delete(d.providers, key)
+	}
+}
+
+func dedupe(contacts []Contact) []Contact {
+	seen := make(map[string]bool, len(contacts))
+	unique := contacts[:0]
+	for _, c := range contacts {
+		if !seen[c.NodeID] {
+			seen[c.NodeID] = true
+			unique = append(unique, c)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// network delivers the messages between DHT nodes in memory, counting them.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*DHT
+	sent  int
+}
+
+func (n *network) send(addr string, msg Message) error {
+	n.mu.Lock()
+	to, ok := n.nodes[addr]
+	n.sent++
+	n.mu.Unlock()
+
+	if ok {
+		go to.Handle(msg)
+	}
+	return nil
+}
+
+func TestDistance(t *testing.T) {
+	a, b := NewID("a"), NewID("b")
+	assert.Equal(t, ID{}, a.Distance(a))
+	assert.Equal(t, a.Distance(b), b.Distance(a))
+	assert.Equal(t, IDBits, ID{}.prefixLen())
+	assert.Equal(t, 7, ID{1}.prefixLen())
+	assert.True(t, ID{1}.Less(ID{2}))
+	assert.False(t, ID{2}.Less(ID{1}))
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := Contact{NodeID: "self"}
+	table := newRoutingTable(self.ID(), 2)
+	assert.False(t, table.update(self))
+
+	for i := 0; i < 100; i++ {
+		table.update(Contact{NodeID: fmt.Sprintf("node-%d", i)})
+	}
+	// Half the ID space is one bucket, so it is full long before the small buckets are.
+	assert.Len(t, table.buckets[0], 2)
+	assert.Less(t, table.len(), 100)
+
+	target := NewID("key")
+	closest := table.closest(target, 5)
+	assert.Len(t, closest, 5)
+	for i := 1; i < len(closest); i++ {
+		assert.True(t, closest[i-1].ID().Distance(target).Less(closest[i].ID().Distance(target)))
+	}
+}
+
+func TestLookup(t *testing.T) {
+	net := &network{nodes: make(map[string]*DHT)}
+
+	var nodes []*DHT
+	for i := 0; i < 50; i++ {
+		self := Contact{NodeID: fmt.Sprintf("node-%d", i), Addr: fmt.Sprintf("addr-%d", i)}
+		d, err := New(Config{Self: self, K: 4, Timeout: 200 * time.Millisecond, Send: net.send})
+		assert.Nil(t, err)
+
+		net.mu.Lock()
+		net.nodes[self.Addr] = d
+		net.mu.Unlock()
+		nodes = append(nodes, d)
+	}
+
+	// Every node only knows the previous one, and bootstraps from there.
+	for i, d := range nodes[1:] {
+		d.AddContact(nodes[i].cfg.Self)
+		assert.Nil(t, d.Bootstrap())
+	}
+
+	assert.Nil(t, nodes[7].Provide("some-key"))
+	time.Sleep(50 * time.Millisecond)
+
+	net.mu.Lock()
+	net.sent = 0
+	net.mu.Unlock()
+
+	providers, err := nodes[42].FindProviders("some-key")
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{nodes[7].cfg.Self}, providers)
+
+	// A lookup reaches the providers without asking every node.
+	net.mu.Lock()
+	assert.Less(t, net.sent, len(nodes))
+	net.mu.Unlock()
+
+	providers, err = nodes[42].FindProviders("unknown-key")
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+
+	lonely, _ := New(Config{Self: Contact{NodeID: "lonely"}, Send: net.send})
+	_, err = lonely.FindNode(NewID("x"))
+	assert.ErrorIs(t, err, ErrNoContacts)
+}
+
+func TestProviderRecords(t *testing.T) {
+	net := &network{nodes: make(map[string]*DHT)}
+
+	var nodes []*DHT
+	for i := 0; i < 3; i++ {
+		self := Contact{NodeID: fmt.Sprintf("node-%d", i), Addr: fmt.Sprintf("addr-%d", i)}
+		d, err := New(Config{Self: self, Timeout: 200 * time.Millisecond, ProviderTTL: 100 * time.Millisecond, Send: net.send})
+		assert.Nil(t, err)
+
+		net.mu.Lock()
+		net.nodes[self.Addr] = d
+		net.mu.Unlock()
+		nodes = append(nodes, d)
+	}
+	for _, d := range nodes[1:] {
+		d.AddContact(nodes[0].cfg.Self)
+		assert.Nil(t, d.Bootstrap())
+	}
+
+	provided := func(d *DHT, key string) func() bool {
+		return func() bool {
+			return len(d.Providers(key)) == 1
+		}
+	}
+
+	// Records expire unless they are republished.
+	assert.Nil(t, nodes[1].Provide("a"))
+	assert.Eventually(t, provided(nodes[0], "a"), time.Second, 10*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, nodes[1].Republish())
+	}
+	assert.Eventually(t, provided(nodes[0], "a"), time.Second, 10*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	assert.Empty(t, nodes[0].Providers("a"))
+
+	// Records are dropped when the provider no longer provides the key, or leaves.
+	assert.Nil(t, nodes[1].Provide("b"))
+	assert.Nil(t, nodes[2].Provide("c"))
+	assert.Eventually(t, provided(nodes[0], "b"), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, provided(nodes[0], "c"), time.Second, 10*time.Millisecond)
+	assert.Nil(t, nodes[1].Unprovide("b"))
+	assert.Eventually(t, func() bool { return len(nodes[0].Providers("b")) == 0 }, time.Second, 10*time.Millisecond)
+	assert.Empty(t, nodes[1].Providers("b"))
+	nodes[0].RemoveContact("node-2")
+	assert.Empty(t, nodes[0].Providers("c"))
+}
+
+func TestSendError(t *testing.T) {
+	errDown := fmt.Errorf("down") //nolint:err113
+	d, err := New(Config{
+		Self:    Contact{NodeID: "self"},
+		Timeout: time.Minute,
+		Send:    func(string, Message) error { return errDown },
+	})
+	assert.Nil(t, err)
+	d.AddContact(Contact{NodeID: "other", Addr: "addr"})
+
+	// A request that can not be sent fails right away, instead of waiting for its reply.
+	_, err = d.request(Contact{NodeID: "other", Addr: "addr"}, Message{Kind: FindNode})
+	assert.ErrorIs(t, err, errDown)
+	assert.Zero(t, d.Len())
+}
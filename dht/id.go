@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+)
+
+// IDBits is the size of the ID space in bits.
+const IDBits = 256
+
+// ID is a position in the ID space, which keys and nodes are both mapped to.
+type ID [IDBits / 8]byte
+
+// NewID maps a key, e.g. a value of crypto.HashKey, or a node ID to the ID space.
+func NewID(s string) ID {
+	return sha256.Sum256([]byte(s))
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance is the XOR distance between two IDs.
+func (id ID) Distance(o ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ o[i]
+	}
+	return d
+}
+
+// Less reports whether id is smaller than o, when both are read as big endian numbers.
+func (id ID) Less(o ID) bool {
+	for i := range id {
+		if id[i] != o[i] {
+			return id[i] < o[i]
+		}
+	}
+	return false
+}
+
+// prefixLen returns the amount of leading zero bits of id.
+func (id ID) prefixLen() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDBits
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+)
+
+// Contact is a node of the DHT.
+type Contact struct {
+	// NodeID is the ID of the node, which its position in the ID space is derived from.
+	NodeID string
+	Addr   string
+}
+
+// ID returns the position of the contact in the ID space.
+func (c Contact) ID() ID {
+	return NewID(c.NodeID)
+}
+
+// routingTable keeps the known contacts in buckets by the length of the prefix that
+// their ID shares with the ID of this node. Each bucket holds up to k contacts, least
+// recently seen first, so long-lived contacts are preferred over new ones.
+type routingTable struct {
+	mu      sync.Mutex
+	self    ID
+	k       int
+	buckets [IDBits][]Contact
+}
+
+func newRoutingTable(self ID, k int) *routingTable {
+	return &routingTable{self: self, k: k}
+}
+
+func (t *routingTable) bucket(id ID) int {
+	b := t.self.Distance(id).prefixLen()
+	if b == IDBits {
+		b = IDBits - 1
+	}
+	return b
+}
+
+// update records that a contact was seen, reporting whether it is in the table.
+func (t *routingTable) update(c Contact) bool {
+	id := c.ID()
+	if id == t.self {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(id)
+	for i, known := range t.buckets[b] {
+		if known.NodeID == c.NodeID {
+			t.buckets[b] = append(append(t.buckets[b][:i], t.buckets[b][i+1:]...), c)
+			return true
+		}
+	}
+	if len(t.buckets[b]) >= t.k {
+		return false
+	}
+	t.buckets[b] = append(t.buckets[b], c)
+	return true
+}
+
+func (t *routingTable) remove(nodeID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(NewID(nodeID))
+	for i, known := range t.buckets[b] {
+		if known.NodeID == nodeID {
+			t.buckets[b] = append(t.buckets[b][:i], t.buckets[b][i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns the n known contacts that are closest to target.
+func (t *routingTable) closest(target ID, n int) []Contact {
+	t.mu.Lock()
+	var all []Contact
+	for _, b := range t.buckets {
+		all = append(all, b...)
+	}
+	t.mu.Unlock()
+
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID().Distance(target).Less(contacts[j].ID().Distance(target))
+	})
+}
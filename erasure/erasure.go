@@ -0,0 +1,230 @@
+// Package erasure implements Reed-Solomon erasure coding over GF(2^8). Data is split
+// into k data shards, from which m parity shards are computed, so that the data can
+// be reconstructed from any k of the k+m shards.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxShards is the maximum total amount of data and parity shards.
+const MaxShards = 256
+
+var (
+	// ErrInvalidShardCount is returned for an amount of shards that can not be coded.
+	ErrInvalidShardCount = errors.New("invalid amount of shards")
+	// ErrShardSize is returned when the shards are empty or differ in size.
+	ErrShardSize = errors.New("shards differ in size")
+	// ErrTooFewShards is returned when fewer shards than data shards are present.
+	ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+)
+
+// Encoder codes data into a fixed amount of data and parity shards.
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	// matrix is the encoding matrix. Its top rows are the identity, so the data
+	// shards are the data itself, and the other rows compute the parity shards.
+	matrix matrix
+}
+
+// New creates an encoder for the given amount of data and parity shards.
+func New(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("%d data and %d parity shards: %w", dataShards, parityShards, ErrInvalidShardCount)
+	}
+
+	total := dataShards + parityShards
+	vm := vandermonde(total, dataShards)
+	top, err := vm.subMatrix(rowRange(dataShards)).invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       vm.multiply(top),
+	}, nil
+}
+
+// DataShards returns the amount of data shards.
+func (e *Encoder) DataShards() int {
+	return e.dataShards
+}
+
+// ParityShards returns the amount of parity shards.
+func (e *Encoder) ParityShards() int {
+	return e.parityShards
+}
+
+// Split splits data into data shards of equal size, padding the last one with zeros,
+// and allocates the parity shards, which are filled in by Encode.
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := (len(data) + e.dataShards - 1) / e.dataShards
+	if size == 0 {
+		size = 1
+	}
+
+	buf := make([]byte, size*(e.dataShards+e.parityShards))
+	copy(buf, data)
+
+	shards := make([][]byte, e.dataShards+e.parityShards)
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards.
+func (e *Encoder) Encode(shards [][]byte) error {
+	if err := e.checkShards(shards, false); err != nil {
+		return err
+	}
+
+	for i := 0; i < e.parityShards; i++ {
+		e.codeShard(e.matrix[e.dataShards+i], shards[:e.dataShards], shards[e.dataShards+i])
+	}
+	return nil
+}
+
+// Verify reports whether the parity shards match the data shards.
+func (e *Encoder) Verify(shards [][]byte) (bool, error) {
+	if err := e.checkShards(shards, false); err != nil {
+		return false, err
+	}
+
+	parity := make([]byte, len(shards[0]))
+	for i := 0; i < e.parityShards; i++ {
+		clear(parity)
+		e.codeShard(e.matrix[e.dataShards+i], shards[:e.dataShards], parity)
+		for j, b := range parity {
+			if shards[e.dataShards+i][j] != b {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// Reconstruct recreates the missing shards, which are nil or empty, from the shards
+// that are present. At least as many shards as there are data shards must be present.
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	if err := e.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	var (
+		size    int
+		present []int
+	)
+	for i, shard := range shards {
+		if len(shard) > 0 {
+			size = len(shard)
+			present = append(present, i)
+		}
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+	if len(present) < e.dataShards {
+		return fmt.Errorf("%d of %d shards present, %d required: %w", len(present), len(shards), e.dataShards, ErrTooFewShards)
+	}
+	present = present[:e.dataShards]
+
+	// The rows of the encoding matrix of the present shards map the data shards to
+	// them, so their inverse maps the present shards back to the data shards.
+	decode, err := e.matrix.subMatrix(present).invert()
+	if err != nil {
+		return err
+	}
+
+	inputs := make([][]byte, len(present))
+	for i, idx := range present {
+		inputs[i] = shards[idx]
+	}
+	for i := 0; i < e.dataShards; i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = make([]byte, size)
+			e.codeShard(decode[i], inputs, shards[i])
+		}
+	}
+
+	for i := e.dataShards; i < len(shards); i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = make([]byte, size)
+			e.codeShard(e.matrix[i], shards[:e.dataShards], shards[i])
+		}
+	}
+	return nil
+}
+
+// Join writes the first size bytes of the data shards to w, undoing Split.
+func (e *Encoder) Join(w io.Writer, shards [][]byte, size int64) error {
+	if len(shards) < e.dataShards {
+		return fmt.Errorf("%d shards: %w", len(shards), ErrTooFewShards)
+	}
+
+	for _, shard := range shards[:e.dataShards] {
+		if size <= 0 {
+			break
+		}
+		if len(shard) == 0 {
+			return ErrTooFewShards
+		}
+		if int64(len(shard)) > size {
+			shard = shard[:size]
+		}
+		n, err := w.Write(shard)
+		if err != nil {
+			return err
+		}
+		size -= int64(n)
+	}
+
+	if size > 0 {
+		return fmt.Errorf("%d bytes missing from the data shards: %w", size, ErrShardSize)
+	}
+	return nil
+}
+
+// codeShard sets out to the sum of the inputs multiplied by the coefficients of row.
+func (e *Encoder) codeShard(row []byte, inputs [][]byte, out []byte) {
+	clear(out)
+	for i, in := range inputs {
+		galMulAdd(row[i], in, out)
+	}
+}
+
+// checkShards checks the amount and the sizes of the shards, allowing missing
+// shards when they are to be reconstructed.
+func (e *Encoder) checkShards(shards [][]byte, allowMissing bool) error {
+	if len(shards) != e.dataShards+e.parityShards {
+		return fmt.Errorf("%d shards, %d expected: %w", len(shards), e.dataShards+e.parityShards, ErrInvalidShardCount)
+	}
+
+	size := -1
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			if allowMissing {
+				continue
+			}
+			return ErrShardSize
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+	}
+	return nil
+}
+
+func rowRange(n int) []int {
+	rows := make([]int, n)
+	for i := range rows {
+		rows[i] = i
+	}
+	return rows
+}
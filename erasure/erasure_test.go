@@ -0,0 +1,58 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoder(t *testing.T) {
+	enc, err := New(4, 2)
+	assert.Nil(t, err)
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	shards := enc.Split(data)
+	assert.Len(t, shards, 6)
+	assert.Nil(t, enc.Encode(shards))
+
+	ok, err := enc.Verify(shards)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// Any two of the six shards may be missing.
+	for a := 0; a < 6; a++ {
+		for b := a + 1; b < 6; b++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[a], damaged[b] = nil, nil
+
+			assert.Nil(t, enc.Reconstruct(damaged))
+			for i := range shards {
+				assert.Equal(t, shards[i], damaged[i])
+			}
+
+			buf := new(bytes.Buffer)
+			assert.Nil(t, enc.Join(buf, damaged, int64(len(data))))
+			assert.Equal(t, data, buf.Bytes())
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[2], damaged[5] = nil, nil, nil
+	assert.ErrorIs(t, enc.Reconstruct(damaged), ErrTooFewShards)
+
+	shards[1][0] ^= 0xff
+	ok, err = enc.Verify(shards)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = New(0, 2)
+	assert.ErrorIs(t, err, ErrInvalidShardCount)
+	_, err = New(200, 100)
+	assert.ErrorIs(t, err, ErrInvalidShardCount)
+}
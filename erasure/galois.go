@@ -0,0 +1,61 @@
+package erasure
+
+// The arithmetic of GF(2^8), the field that the shards are coded in. Bytes are
+// polynomials over GF(2) reduced by x^8 + x^4 + x^3 + x^2 + 1, with 2 as generator.
+const fieldPolynomial = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fieldPolynomial
+		}
+	}
+}
+
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func galDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func galExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// galMulAdd adds c times in to out.
+func galMulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(logTable[c])
+	for i, v := range in {
+		if v != 0 {
+			out[i] ^= expTable[lc+int(logTable[v])]
+		}
+	}
+}
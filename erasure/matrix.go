@@ -0,0 +1,99 @@
+package erasure
+
+import "errors"
+
+var errSingular = errors.New("matrix is singular")
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func identity(n int) matrix {
+	m := newMatrix(n, n)
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m
+}
+
+// vandermonde returns a matrix whose rows are the powers of distinct elements,
+// of which any cols rows are linearly independent.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galExp(byte(r), c)
+		}
+	}
+	return m
+}
+
+func (m matrix) multiply(o matrix) matrix {
+	res := newMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v ^= galMul(m[r][i], o[i][c])
+			}
+			res[r][c] = v
+		}
+	}
+	return res
+}
+
+// subMatrix returns the given rows of the matrix.
+func (m matrix) subMatrix(rows []int) matrix {
+	res := make(matrix, len(rows))
+	for i, r := range rows {
+		res[i] = append([]byte(nil), m[r]...)
+	}
+	return res
+}
+
+// invert returns the inverse of a square matrix, using Gauss-Jordan elimination.
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		if work[c][c] == 0 {
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					break
+				}
+			}
+		}
+		if work[c][c] == 0 {
+			return nil, errSingular
+		}
+
+		if pivot := work[c][c]; pivot != 1 {
+			for i := range work[c] {
+				work[c][i] = galDiv(work[c][i], pivot)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				galMulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	res := make(matrix, n)
+	for r := range work {
+		res[r] = work[r][n:]
+	}
+	return res, nil
+}
@@ -0,0 +1,262 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+const defaultAckTimeout = 5 * time.Second
+
+// ErrNoAck is the error of a peer that did not answer a write within the ack timeout.
+var ErrNoAck = errors.New("no acknowledgement received")
+
+// StoreReport is the result of a call to Store, with the answer of every peer the file was sent to.
+type StoreReport struct {
+	Key   string
+	Size  int64
+	Peers []PeerResult
+
+	// answers receives the answers of the peers when Store did not wait for them.
+	answers <-chan []PeerResult
+}
+
+// Wait waits until every peer answered the write or the ack timeout expired, and updates
+// Peers with their answers. Store only waits for the answers itself when the write has a
+// quorum, without one it returns as soon as the file was sent and every peer is pending.
+// Wait must not be called concurrently with itself or with the other methods.
+func (r *StoreReport) Wait() *StoreReport {
+	if r.answers != nil {
+		r.Peers = <-r.answers
+		r.answers = nil
+	}
+	return r
+}
+
+// Acked returns the number of peers that stored the file.
+func (r *StoreReport) Acked() int {
+	n := 0
+	for _, p := range r.Peers {
+		if p.Err == nil && !p.Pending {
+			n++
+		}
+	}
+	return n
+}
+
+// PeerResult is the answer of a peer to a write. Written and Checksum describe the
+// data that the peer received, and Err is set when the peer failed to store it or
+// its answer does not match what was sent. Pending is set for peers that had not
+// answered yet when Store returned, because the write quorum was already reached.
+type PeerResult struct {
+	Peer     string
+	Written  int64
+	Checksum string
+	Err      error
+	Pending  bool
+}
+
+// ack is the answer of a peer to a write.
+type ack struct {
+	from     string
+	written  int64
+	checksum string
+	clock    vclock.Clock
+	err      error
+}
+
+// ackWaiters keeps the writes that are waiting for the answers of their replicas.
+type ackWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]ackWaiter
+}
+
+// ackWaiter is a write that is waiting for the answers of its replicas.
+type ackWaiter struct {
+	ch    chan ack
+	clock vclock.Clock
+}
+
+// sentFile describes what was sent to a peer, to compare it with the answer of the peer.
+type sentFile struct {
+	size     int64
+	checksum string
+}
+
+// expectAcks registers a write of the given keys with the given clock to n peers that
+// waits for their answers. The returned function unregisters it.
+func (s *FileServer) expectAcks(id string, keys []string, clock vclock.Clock, n int) (<-chan ack, func()) {
+	ch := make(chan ack, n)
+
+	s.acks.mu.Lock()
+	for _, key := range keys {
+		name := id + "/" + key
+		s.acks.waiters[name] = append(s.acks.waiters[name], ackWaiter{ch: ch, clock: clock})
+	}
+	s.acks.mu.Unlock()
+
+	return ch, func() {
+		s.acks.mu.Lock()
+		defer s.acks.mu.Unlock()
+
+		for _, key := range keys {
+			name := id + "/" + key
+			waiters := s.acks.waiters[name]
+			for i, w := range waiters {
+				if w.ch == ch {
+					waiters = append(waiters[:i], waiters[i+1:]...)
+					break
+				}
+			}
+			if len(waiters) == 0 {
+				delete(s.acks.waiters, name)
+			} else {
+				s.acks.waiters[name] = waiters
+			}
+		}
+	}
+}
+
+// deliverAck passes the answer of a peer to the writes of key that are waiting for it.
+// Answers without a clock come from nodes that do not send it, and are passed to every
+// write of the key.
+func (s *FileServer) deliverAck(id, key string, a ack) {
+	s.acks.mu.Lock()
+	defer s.acks.mu.Unlock()
+
+	for _, w := range s.acks.waiters[id+"/"+key] {
+		if a.clock != nil && a.clock.Compare(w.clock) != vclock.Equal {
+			continue
+		}
+		select {
+		case w.ch <- a:
+		default:
+		}
+	}
+}
+
+// collectAcks collects the answers of the targets of a write, which were sent what sent
+// holds for their address, and unregisters the write with done once it is complete. With
+// a write quorum, it waits until the quorum is reached or can no longer be reached. Without
+// one, it returns at once with every target pending, and sends their answers on the
+// returned channel once all of them answered or the ack timeout expired.
+func (s *FileServer) collectAcks(ch <-chan ack, done func(), targets []p2p.Peer, sent map[string]sentFile, quorum int) ([]PeerResult, <-chan []PeerResult) {
+	if quorum > 0 {
+		defer done()
+		return s.waitAcks(ch, targets, sent, quorum), nil
+	}
+
+	answers := make(chan []PeerResult, 1)
+	go func() {
+		defer done()
+		answers <- s.waitAcks(ch, targets, sent, 0)
+	}()
+
+	pending := make([]PeerResult, 0, len(targets))
+	for _, peer := range targets {
+		pending = append(pending, PeerResult{Peer: peer.RemoteAddr().String(), Pending: true})
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Peer < pending[j].Peer
+	})
+
+	return pending, answers
+}
+
+// waitAcks waits for the answers of the targets of a write until all of them answered or
+// the ack timeout expires, or until the write quorum is reached or can no longer be reached.
+func (s *FileServer) waitAcks(ch <-chan ack, targets []p2p.Peer, sent map[string]sentFile, quorum int) []PeerResult {
+	timeout := s.AckTimeout
+	if timeout == 0 {
+		timeout = defaultAckTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	results := make(map[string]*PeerResult, len(targets))
+	for _, peer := range targets {
+		addr := peer.RemoteAddr().String()
+		results[addr] = &PeerResult{Peer: addr, Pending: true}
+	}
+
+	acked, answered := 0, 0
+	for answered < len(targets) {
+		if quorum > 0 && (acked >= quorum || acked+len(targets)-answered < quorum) {
+			break
+		}
+
+		select {
+		case a := <-ch:
+			res, ok := results[a.from]
+			if !ok || !res.Pending {
+				continue
+			}
+			answered++
+
+			res.Pending = false
+			res.Written, res.Checksum, res.Err = a.written, a.checksum, a.err
+			if want := sent[a.from]; res.Err == nil && (res.Written != want.size || res.Checksum != want.checksum) {
+				res.Err = fmt.Errorf("peer received %d bytes with checksum %s, sent %d bytes with checksum %s", res.Written, res.Checksum, want.size, want.checksum) //nolint:err113
+			}
+			if res.Err == nil {
+				acked++
+			}
+		case <-timer.C:
+			for _, res := range results {
+				if res.Pending {
+					res.Pending, res.Err = false, ErrNoAck
+				}
+			}
+			answered = len(targets)
+		}
+	}
+
+	peers := make([]PeerResult, 0, len(results))
+	for _, res := range results {
+		peers = append(peers, *res)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Peer < peers[j].Peer
+	})
+
+	return peers
+}
+
+// ackStoreFile tells the sender of a file how much of it was received with which
+// checksum, and whether it was stored.
+func (s *FileServer) ackStoreFile(peer p2p.Peer, msg MessageStoreFile, written int64, checksum string, err error) error {
+	reply := MessageStoreFileAck{
+		ID:       msg.ID,
+		Key:      msg.Key,
+		Written:  written,
+		Checksum: checksum,
+		Clock:    msg.Metadata.Clock,
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+
+	return s.send(peer, &Message{Payload: reply})
+}
+
+func (s *FileServer) handleMessageStoreFileAck(from string, msg MessageStoreFileAck) error {
+	a := ack{
+		from:     from,
+		written:  msg.Written,
+		checksum: msg.Checksum,
+		clock:    msg.Clock,
+	}
+	if len(msg.Error) > 0 {
+		a.err = errors.New(msg.Error) //nolint:err113
+		log.Printf("[%s] peer (%s) did not store file (%s): %s\n", s.Transport.Addr(), from, msg.Key, msg.Error)
+	}
+
+	s.deliverAck(msg.ID, msg.Key, a)
+	return nil
+}
@@ -0,0 +1,86 @@
+package fileserver
+
+import (
+	"io"
+	"log"
+
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// advertiseCapacity sends the storage capacity of this node to the given peer,
+// so it can avoid sending files that would not fit.
+func (s *FileServer) advertiseCapacity(peer p2p.Peer) error {
+	limiter, ok := s.Storage.(store.Limiter)
+	if !ok {
+		return nil
+	}
+
+	c, err := limiter.Capacity()
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Payload: MessageCapacity{
+			Total: c.Total,
+			Used:  c.Used,
+			Free:  c.Free,
+		},
+	}
+
+	return s.send(peer, &msg)
+}
+
+// storeTargets returns the peers that a file of size bytes is placed on, and that
+// are expected to have room for it. Peers that have not advertised their capacity
+// yet are assumed to have room, and peers that have not announced their node yet
+// are assumed to be owners.
+func (s *FileServer) storeTargets(id, key string, size int64) []p2p.Peer {
+	owners := s.owners(id + "/" + key)
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	targets := make([]p2p.Peer, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		if !s.placedOn(owners, addr) {
+			continue
+		}
+		if c, ok := s.peerCapacity[addr]; ok && c.Free >= 0 && c.Free < size {
+			log.Printf("[%s] skipping peer (%s), it has %d of %d bytes free\n", s.Transport.Addr(), addr, c.Free, size)
+			continue
+		}
+		targets = append(targets, peer)
+	}
+
+	return targets
+}
+
+// refuseStoreFile discards the rest of the incoming file stream and tells the
+// sender that the file could not be stored.
+func (s *FileServer) refuseStoreFile(peer p2p.Peer, msg MessageStoreFile, r io.Reader, reason error) error {
+	_, _ = io.Copy(io.Discard, r)
+	peer.CloseStream()
+
+	log.Printf("[%s] refused to store file (%s): %s\n", s.Transport.Addr(), msg.Key, reason.Error())
+
+	if err := s.ackStoreFile(peer, msg, 0, "", reason); err != nil {
+		return err
+	}
+
+	return s.advertiseCapacity(peer)
+}
+
+func (s *FileServer) handleMessageCapacity(from string, msg MessageCapacity) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	s.peerCapacity[from] = store.Capacity{
+		Total: msg.Total,
+		Used:  msg.Used,
+		Free:  msg.Free,
+	}
+
+	return nil
+}
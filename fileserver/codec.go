@@ -0,0 +1,124 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Codec is an interface that can be implemented to encode the messages that the
+// file servers exchange. The name of the codec is what nodes agree on in Handshake,
+// so it must be stable across releases.
+type Codec interface {
+	Name() string
+	Encode(msg *Message) ([]byte, error)
+	Decode(b []byte, msg *Message) error
+}
+
+// payloads are the types of the payloads of the messages.
+var payloads = []any{
+	MessageStoreFile{},
+	MessageGetFile{},
+	MessageGetShards{},
+	MessageStoreFileAck{},
+	MessageCapacity{},
+	MessageAnnounce{},
+	MessagePeerExchange{},
+	MessageGossip{},
+	MessageDHT{},
+	MessageDeleteFile{},
+	MessageSyncRoot{},
+	MessageSyncBuckets{},
+	MessageSyncEntries{},
+	MessageSyncRequest{},
+}
+
+// payloadTypes maps the name of each payload type, which is the name of the type
+// without its Message prefix, to the type.
+var payloadTypes = make(map[string]reflect.Type, len(payloads))
+
+func payloadName(t reflect.Type) string {
+	return strings.TrimPrefix(t.Name(), "Message")
+}
+
+// GOBCodec is a codec that uses the gob package, which only Go programs can speak.
+type GOBCodec struct{}
+
+// Name implements the Codec interface.
+func (c GOBCodec) Name() string { return "gob" }
+
+// Encode implements the Codec interface.
+func (c GOBCodec) Encode(msg *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements the Codec interface.
+func (c GOBCodec) Decode(b []byte, msg *Message) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(msg)
+}
+
+// JSONCodec is a codec that encodes each message as a JSON object holding the name of
+// its payload type and the payload, e.g. {"type":"GetFile","payload":{"Key":"..."}}.
+// It is larger and slower than the other codecs, but can be read when tracing traffic.
+type JSONCodec struct{}
+
+type jsonMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Name implements the Codec interface.
+func (c JSONCodec) Name() string { return "json" }
+
+// Encode implements the Codec interface.
+func (c JSONCodec) Encode(msg *Message) ([]byte, error) {
+	if msg.Payload == nil {
+		return nil, fmt.Errorf("can not encode message without a payload") //nolint:err113
+	}
+
+	name := payloadName(reflect.TypeOf(msg.Payload))
+	if _, ok := payloadTypes[name]; !ok {
+		return nil, fmt.Errorf("can not encode message payload of type %T", msg.Payload) //nolint:err113
+	}
+
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonMessage{Type: name, Payload: payload})
+}
+
+// Decode implements the Codec interface.
+func (c JSONCodec) Decode(b []byte, msg *Message) error {
+	var m jsonMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	t, ok := payloadTypes[m.Type]
+	if !ok {
+		return fmt.Errorf("unknown message payload type %q", m.Type) //nolint:err113
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(m.Payload, v.Interface()); err != nil {
+		return err
+	}
+
+	msg.Payload = v.Elem().Interface()
+	return nil
+}
+
+func init() {
+	for _, payload := range payloads {
+		gob.Register(payload)
+		t := reflect.TypeOf(payload)
+		payloadTypes[payloadName(t)] = t
+	}
+}
@@ -0,0 +1,106 @@
+package fileserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yigithankarabulut/distributed-file-storage/dht"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/swim"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	md := store.Metadata{
+		Key:         "picture.png",
+		Checksum:    "a1b2",
+		Compression: "gzip",
+		Version:     "v1",
+		Timestamp:   time.Unix(1700000000, 42).UTC(),
+		Origin:      "node-a",
+		Clock:       vclock.Clock{"node-a": 2, "node-b": 1},
+		Shard:       &store.Shard{Index: 3, DataShards: 4, ParityShards: 2, Size: 1 << 20, Checksum: "c3d4"},
+	}
+	entries := []SyncEntry{
+		{ID: "id", Key: "a", Checksum: "e5", Clock: vclock.Clock{"node-a": 1}},
+		{ID: "id", Key: "b"},
+	}
+	payloads := []any{
+		MessageStoreFile{ID: "id", Key: "key", Size: 1024, Metadata: md},
+		MessageGetFile{Key: "key", ID: "id"},
+		MessageGetShards{ID: "id", Keys: []string{"key_0", "key_1"}},
+		MessageStoreFileAck{ID: "id", Key: "key", Written: 1024, Checksum: "f6", Error: "full", Clock: vclock.Clock{"node-a": 2}},
+		MessageCapacity{Total: 100, Used: 40, Free: -1},
+		MessageAnnounce{NodeID: "node-a", ListenAddr: ":3000"},
+		MessagePeerExchange{Addrs: []string{":4000", ":5000"}},
+		MessageGossip{Message: swim.Message{
+			Kind: swim.PingReq, Seq: 7, From: "node-a", FromAddr: ":3000", Target: "node-b", TargetAddr: ":4000",
+			Updates: []swim.Update{{ID: "node-c", Addr: ":5000", State: swim.Suspect, Incarnation: 3}},
+		}},
+		MessageDHT{Message: dht.Message{
+			Kind: dht.Reply, Seq: 9, From: dht.Contact{NodeID: "node-a", Addr: ":3000"},
+			Target: dht.NewID("key"), Key: "key",
+			Contacts:  []dht.Contact{{NodeID: "node-b", Addr: ":4000"}},
+			Providers: []dht.Contact{{NodeID: "node-c", Addr: ":5000"}},
+		}},
+		MessageDeleteFile{ID: "id", Key: "key"},
+		MessageSyncRoot{Root: []byte{1, 2, 3}},
+		MessageSyncBuckets{Level: 4, Nodes: []int{0, 5, 15}, Hashes: [][]byte{{1}, {2}, {3}}},
+		MessageSyncEntries{Buckets: []int{0, 5, 300}, Entries: entries},
+		MessageSyncRequest{Entries: entries},
+	}
+
+	for _, codec := range []Codec{GOBCodec{}, ProtoCodec{}, JSONCodec{}} {
+		for _, payload := range payloads {
+			b, err := codec.Encode(&Message{Payload: payload})
+			assert.Nil(t, err)
+
+			var msg Message
+			assert.Nil(t, codec.Decode(b, &msg), "%s %T", codec.Name(), payload)
+			assert.EqualValues(t, payload, msg.Payload, "%s %T", codec.Name(), payload)
+		}
+	}
+
+	// Messages without a payload can not be encoded as JSON.
+	_, err := JSONCodec{}.Encode(&Message{})
+	assert.NotNil(t, err)
+}
+
+func TestProtoCodecCompatibility(t *testing.T) {
+	t.Parallel()
+
+	codec := ProtoCodec{}
+
+	// Fields that were added by newer nodes are ignored.
+	w := protoWriter{}
+	w.uint(fieldVersion, protoVersion)
+	w.message(fieldAnnounce, func(w *protoWriter) {
+		w.string(1, "node-a")
+		w.string(2, ":3000")
+		w.string(99, "added later")
+	})
+	w.int(100, 1)
+
+	var msg Message
+	assert.Nil(t, codec.Decode(w.buf, &msg))
+	assert.Equal(t, MessageAnnounce{NodeID: "node-a", ListenAddr: ":3000"}, msg.Payload)
+
+	// Messages of other versions of the schema are rejected.
+	w = protoWriter{}
+	w.uint(fieldVersion, protoVersion+1)
+	w.message(fieldAnnounce, func(w *protoWriter) { w.string(1, "node-a") })
+	assert.ErrorIs(t, codec.Decode(w.buf, &msg), ErrUnsupportedVersion)
+
+	// Messages without a known payload, and truncated messages, are rejected.
+	w = protoWriter{}
+	w.uint(fieldVersion, protoVersion)
+	w.message(100, func(w *protoWriter) {})
+	assert.NotNil(t, codec.Decode(w.buf, &msg))
+
+	b, err := codec.Encode(&Message{Payload: MessageGetFile{Key: "key", ID: "id"}})
+	assert.Nil(t, err)
+	assert.NotNil(t, codec.Decode(b[:len(b)-1], &msg))
+}
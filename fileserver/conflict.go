@@ -0,0 +1,287 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+// siblingSep separates a key from the node that wrote one of its siblings.
+const siblingSep = "@s."
+
+// ConflictResolution decides what happens when a node receives a write that is
+// concurrent with the data it already has for the same key.
+type ConflictResolution int
+
+const (
+	// LastWriterWins keeps the write with the latest timestamp, breaking ties by
+	// the node that wrote it, so that every replica picks the same winner.
+	LastWriterWins ConflictResolution = iota
+	// KeepSiblings keeps the winner of LastWriterWins as the value of the key, and
+	// keeps the other writes as siblings for the application to resolve.
+	KeepSiblings
+)
+
+// Siblings returns the metadata of the concurrent writes of a key that this node
+// holds, with the value of the key first. Storing the key again resolves the
+// conflict, since the new write descends from all the siblings.
+func (s *FileServer) Siblings(key string) ([]store.Metadata, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	netKey := crypto.HashKey(key)
+
+	var siblings []store.Metadata
+	for _, k := range []string{key, netKey} {
+		if md, err := s.Storage.ReadMetadata(s.ID, k); err == nil {
+			siblings = append(siblings, md)
+			break
+		}
+	}
+
+	others, err := s.siblings(s.ID, netKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(siblings, others...), nil
+}
+
+// causalClock returns the clock that a new write of key has to descend from,
+// merging the clocks of the local data and of the replicas held for the key.
+func (s *FileServer) causalClock(key string) vclock.Clock {
+	clock := vclock.Clock{}
+
+	for _, k := range []string{key, crypto.HashKey(key)} {
+		if md, err := s.Storage.ReadMetadata(s.ID, k); err == nil {
+			clock = clock.Merge(md.Clock)
+		}
+	}
+
+	siblings, _ := s.siblings(s.ID, crypto.HashKey(key))
+	for _, md := range siblings {
+		clock = clock.Merge(md.Clock)
+	}
+
+	return clock
+}
+
+// resolveConflict compares an incoming write of key with the data that is stored
+// for it, and returns the key that the incoming data should be written to along with
+// its metadata. An empty key means that the incoming data is obsolete and should be
+// discarded. When key is the net key of a file that this node stored itself, the
+// write is compared with the local copy of the file, which the incoming data should
+// replace decrypted, as told by the net key in the returned metadata.
+func (s *FileServer) resolveConflict(id, key string, incoming store.Metadata) (string, store.Metadata, error) {
+	netKey := key
+	incoming.Key, incoming.NetKey = key, ""
+	if own, ok := s.ownKey(id, netKey); ok {
+		key = own
+		incoming.Key, incoming.NetKey = own, netKey
+	}
+
+	local, err := s.Storage.ReadMetadata(id, key)
+	if errors.Is(err, os.ErrNotExist) || !s.Storage.Has(id, key) {
+		return key, incoming, nil
+	}
+	if err != nil {
+		return "", incoming, err
+	}
+
+	return s.resolve(id, key, netKey, local, incoming)
+}
+
+// resolve compares an incoming write with the local write of key, whose siblings are
+// kept under netKey, like resolveConflict does.
+func (s *FileServer) resolve(id, key, netKey string, local, incoming store.Metadata) (string, store.Metadata, error) {
+	switch incoming.Clock.Compare(local.Clock) {
+	case vclock.After:
+		return key, incoming, s.pruneSiblings(id, netKey, incoming.Clock)
+	case vclock.Before, vclock.Equal:
+		log.Printf("[%s] discarding obsolete write of file (%s) with clock %s\n", s.Transport.Addr(), key, incoming.Clock)
+		return "", incoming, nil
+	case vclock.Concurrent:
+	}
+
+	log.Printf("[%s] concurrent writes of file (%s) with clocks %s and %s\n", s.Transport.Addr(), key, local.Clock, incoming.Clock)
+
+	incomingWins := lastWriterWins(incoming, local)
+
+	if s.ConflictResolution == KeepSiblings {
+		if !incomingWins {
+			sibling := siblingKey(netKey, incoming.Origin)
+			incoming.Key, incoming.NetKey = sibling, ""
+			return sibling, incoming, nil
+		}
+		if err := s.keepSibling(id, key, siblingKey(netKey, local.Origin), local); err != nil {
+			return "", incoming, err
+		}
+		return key, incoming, nil
+	}
+
+	// With last writer wins, both writes are merged into the clock of the winner,
+	// so replicas that received them in a different order converge on the same state.
+	merged := local.Clock.Merge(incoming.Clock)
+	if !incomingWins {
+		local.Clock = merged
+		return "", incoming, s.writeMetadata(id, key, local)
+	}
+
+	incoming.Clock = merged
+	return key, incoming, nil
+}
+
+// keepSibling keeps the data of key, which a concurrent write replaces, as the given
+// sibling. Siblings are stored like replicas, so the data of a file that this node
+// stored itself is encrypted.
+func (s *FileServer) keepSibling(id, key, sibling string, md store.Metadata) error {
+	if md.NetKey == "" {
+		return s.copyKey(id, key, sibling, md)
+	}
+
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := crypto.CopyEncrypt(s.EncryptKey, r, pw)
+		_ = pw.CloseWithError(err)
+	}()
+	_, err = s.Storage.Write(id, sibling, pr)
+	_ = pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	md.Key, md.NetKey = sibling, ""
+	return s.writeMetadata(id, sibling, md)
+}
+
+// ownKey returns the key of the file that this node stored itself as id under the
+// given net key, if there is one.
+func (s *FileServer) ownKey(id, netKey string) (string, bool) {
+	if id != s.ID {
+		return "", false
+	}
+
+	s.ownKeyLock.Lock()
+	defer s.ownKeyLock.Unlock()
+
+	if s.ownKeys == nil {
+		s.ownKeys = make(map[string]string)
+		infos, _ := s.Storage.List(s.ID)
+		for _, fi := range infos {
+			if md, err := s.Storage.ReadMetadata(s.ID, fi.Key); err == nil && md.NetKey != "" {
+				s.ownKeys[md.NetKey] = fi.Key
+			}
+		}
+	}
+
+	key, ok := s.ownKeys[netKey]
+	if !ok {
+		return "", false
+	}
+	// The file may have been deleted since.
+	if md, err := s.Storage.ReadMetadata(s.ID, key); err != nil || md.NetKey != netKey {
+		delete(s.ownKeys, netKey)
+		return "", false
+	}
+	return key, true
+}
+
+// addOwnKey records that this node stored key itself under the given net key.
+func (s *FileServer) addOwnKey(key, netKey string) {
+	s.ownKeyLock.Lock()
+	defer s.ownKeyLock.Unlock()
+
+	if s.ownKeys != nil {
+		s.ownKeys[netKey] = key
+	}
+}
+
+// siblings returns the metadata of the siblings that are stored for key.
+func (s *FileServer) siblings(id, key string) ([]store.Metadata, error) {
+	infos, err := s.Storage.ListPrefix(id, key+siblingSep)
+	if err != nil {
+		return nil, err
+	}
+
+	siblings := make([]store.Metadata, 0, len(infos))
+	for _, fi := range infos {
+		md, err := s.Storage.ReadMetadata(id, fi.Key)
+		if err != nil {
+			return nil, err
+		}
+		siblings = append(siblings, md)
+	}
+
+	return siblings, nil
+}
+
+// pruneSiblings deletes the siblings of key that the given clock descends from,
+// since a write with that clock resolves them.
+func (s *FileServer) pruneSiblings(id, key string, clock vclock.Clock) error {
+	siblings, err := s.siblings(id, key)
+	if err != nil {
+		return err
+	}
+
+	for _, md := range siblings {
+		if !clock.Descends(md.Clock) {
+			continue
+		}
+		if err = s.deleteKey(id, md.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyKey makes the data of key from readable as key to with the given metadata,
+// linking it instead of copying it when the backend can.
+func (s *FileServer) copyKey(id, from, to string, md store.Metadata) error {
+	md.Key = to
+	if linker, ok := s.Storage.(store.Linker); ok {
+		if err := linker.Link(id, from, to); err != nil {
+			return err
+		}
+		return s.writeMetadata(id, to, md)
+	}
+
+	_, r, err := s.Storage.Read(id, from)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+
+	if _, err = s.Storage.Write(id, to, r); err != nil {
+		return err
+	}
+
+	return s.writeMetadata(id, to, md)
+}
+
+// lastWriterWins reports whether write a wins over write b.
+func lastWriterWins(a, b store.Metadata) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return a.Origin > b.Origin
+}
+
+func siblingKey(key, origin string) string {
+	return key + siblingSep + origin
+}
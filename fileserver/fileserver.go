@@ -2,58 +2,227 @@ package fileserver
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/yigithankarabulut/distributed-file-storage/compress"
 	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/dht"
 	"github.com/yigithankarabulut/distributed-file-storage/p2p"
 	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/swim"
 )
 
 // ServerOpts is a struct that contains the configuration for the file server.
 type ServerOpts struct {
-	ID                string
+	ID string
+	// NodeID identifies this node in the version vectors of writes. Unlike ID, which
+	// identifies the owner of the files, it must be unique per node. Defaults to a random ID.
+	NodeID            string
 	EncryptKey        []byte
 	ListenAddr        string
 	StorageRoot       string
 	PathTransformFunc store.PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+
+	// Backend is where the file server keeps its data. When it is nil, a disk
+	// backend is created with the StorageRoot and PathTransformFunc options.
+	Backend store.Backend
+	// StorageCapacity is the maximum amount of bytes that the disk backend holds,
+	// zero meaning it is only limited by the free space of the disk.
+	StorageCapacity int64
+	// StorageQuota is the maximum amount of bytes that each ID can store on the
+	// disk backend, zero meaning unlimited.
+	StorageQuota int64
+
+	// Compression is the codec that files are compressed with before they are
+	// encrypted and stored. Compression is disabled when it is nil.
+	Compression compress.Codec
+	// CompressionRatio is the ratio of compressed to original size above which
+	// data is considered incompressible and stored as it is. Defaults to 0.9.
+	CompressionRatio float64
+
+	// Versioning keeps the previous contents of a key as versions when it is stored again.
+	Versioning bool
+	// Retention is the policy that old versions are pruned with when versioning is enabled.
+	Retention RetentionPolicy
+
+	// ConflictResolution decides what happens to concurrent writes of the same key.
+	ConflictResolution ConflictResolution
+
+	// HintTTL is how long a node holds hints for the writes that a replica missed
+	// because it was not connected. Hinted handoff is disabled when it is zero.
+	HintTTL time.Duration
+	// HintBudget is the maximum amount of bytes that pending hints may refer to,
+	// zero meaning unlimited.
+	HintBudget int64
+
+	// WriteQuorum is the number of replicas that have to acknowledge a write before
+	// Store succeeds. ReadQuorum is the number of replicas, including the local copy,
+	// that Get consults before it succeeds. Both can be overridden per call, and zero
+	// means that Store does not wait for any replica and Get prefers the local copy.
+	// The read quorum does not apply in erasure coded mode.
+	WriteQuorum int
+	ReadQuorum  int
+	// AckTimeout is how long the peers have to acknowledge a write, after which they are
+	// reported with ErrNoAck. Defaults to 5 seconds.
+	AckTimeout time.Duration
+
+	// ReplicationFactor is the number of nodes that each file is placed on, which are
+	// chosen by rendezvous hashing of its key. The node that stores a file keeps its own
+	// copy of it in any case. Files are placed on all nodes when it is zero.
+	ReplicationFactor int
+	// AutoRebalance sends the files of this node to the nodes that should own them whenever
+	// a node joins or leaves, so new nodes receive their share of the existing files and
+	// the files of departed nodes are replicated again.
+	AutoRebalance bool
+	// RebalanceBandwidth is the maximum amount of bytes per second that rebalancing
+	// sends, zero meaning unlimited.
+	RebalanceBandwidth int64
+
+	// DataShards and ParityShards enable the erasure coded mode when DataShards is above
+	// zero. Instead of a full copy of each file being sent to every peer, the file is
+	// coded into data and parity shards that are each sent to a distinct peer, and it
+	// can be reconstructed as long as no more than ParityShards shards are missing.
+	DataShards   int
+	ParityShards int
+
+	// PeerExchange makes connected nodes share the listen addresses of their peers, so
+	// a node that is bootstrapped with a single node discovers and dials all the others.
+	PeerExchange bool
+	// MaxPeers is the maximum amount of peers beyond which no more nodes are dialed
+	// when they are discovered, zero meaning unlimited. It only limits the nodes that
+	// this node dials itself through peer exchange and gossip: the bootstrap nodes are
+	// always dialed and the nodes that dial this node are always accepted.
+	MaxPeers int
+
+	// GossipInterval enables the SWIM gossip membership, probing one member every interval.
+	// Members learned through gossip are connected with, so every node ends up with a
+	// view of all the alive, suspect and dead nodes of the cluster. It is disabled when zero.
+	GossipInterval time.Duration
+
+	// DHT enables the Kademlia DHT, which the nodes record the replicas they hold on.
+	// Get then asks the peers that the DHT locates the file on first, instead of every
+	// peer, and only asks the other peers when fewer of those than the read quorum have it.
+	DHT bool
+
+	// SyncInterval is the interval of the anti-entropy rounds with the peers, which
+	// repair files that a peer is missing. Anti-entropy is disabled when it is zero.
+	SyncInterval time.Duration
+
+	// Codec is the codec that the messages are encoded with. With Handshake as the
+	// handshake function of the transport, it is only preferred, and the nodes agree
+	// on a codec that both speak; it must be the same on every node otherwise.
+	// Defaults to GOBCodec. ProtoCodec is a compact binary codec that nodes and clients
+	// written in other languages can speak, and JSONCodec is readable when tracing.
+	Codec Codec
 }
 
+const defaultCompressionRatio = 0.9
+
 // FileServer is a struct that contains the configuration for the file server.
 type FileServer struct {
 	ServerOpts
 
-	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
-
-	Storage  *store.Store
+	peerLock     sync.Mutex
+	peers        map[string]p2p.Peer
+	peerCapacity map[string]store.Capacity
+	writeLocks   map[string]*sync.Mutex
+	// peerNodes maps the address of each peer to the ID of its node.
+	peerNodes map[string]string
+	// members maps the ID of each node that was ever connected to its listen address.
+	members map[string]string
+	// dialing holds the listen addresses of the discovered nodes that are being dialed,
+	// with a channel that is closed once the node announces itself.
+	dialing map[string]chan struct{}
+
+	codecLock  sync.Mutex
+	peerCodecs map[string]peerCodecs
+
+	hintLock  sync.Mutex
+	hints     map[string]map[string]Hint
+	hintBytes int64
+
+	// ownKeys maps the net keys of the files that this node stored itself to their
+	// keys. It is filled from the storage when it is first needed, and nil until then.
+	ownKeyLock sync.Mutex
+	ownKeys    map[string]string
+
+	syncState syncState
+
+	acks       ackWaiters
+	rebalance  rebalancer
+	membership *swim.Memberlist
+	dht        *dht.DHT
+
+	Storage  store.Backend
 	doneChan chan struct{}
 }
 
 // NewFileServer creates a new file server instance with the given options.
 func NewFileServer(opts ServerOpts) *FileServer {
-	s := store.NewStore(
-		store.WithRoot(opts.StorageRoot),
-		store.WithPathTransformFunc(opts.PathTransformFunc),
-	)
+	var s store.Backend = opts.Backend
+	if s == nil {
+		s = store.NewStore(
+			store.WithRoot(opts.StorageRoot),
+			store.WithPathTransformFunc(opts.PathTransformFunc),
+			store.WithIndex(true),
+			store.WithCapacity(opts.StorageCapacity),
+			store.WithQuota(opts.StorageQuota),
+		)
+	}
 
 	if len(opts.ID) == 0 {
 		opts.ID = crypto.GenerateID()
 	}
+	if len(opts.NodeID) == 0 {
+		opts.NodeID = crypto.GenerateID()[:16]
+	}
+	if opts.CompressionRatio == 0 {
+		opts.CompressionRatio = defaultCompressionRatio
+	}
+	if opts.Codec == nil {
+		opts.Codec = GOBCodec{}
+	}
+
+	fs := &FileServer{
+		ServerOpts:   opts,
+		Storage:      s,
+		doneChan:     make(chan struct{}),
+		peers:        make(map[string]p2p.Peer),
+		peerCapacity: make(map[string]store.Capacity),
+		writeLocks:   make(map[string]*sync.Mutex),
+		peerNodes:    make(map[string]string),
+		members:      make(map[string]string),
+		dialing:      make(map[string]chan struct{}),
+		peerCodecs:   make(map[string]peerCodecs),
+		hints:        make(map[string]map[string]Hint),
+		acks:         ackWaiters{waiters: make(map[string][]ackWaiter)},
+	}
 
-	return &FileServer{
-		ServerOpts: opts,
-		Storage:    s,
-		doneChan:   make(chan struct{}),
-		peers:      make(map[string]p2p.Peer),
+	if opts.GossipInterval > 0 {
+		var err error
+		if fs.membership, err = fs.newMembership(); err != nil {
+			log.Printf("[%s] gossip membership disabled: %s\n", opts.Transport.Addr(), err.Error())
+		}
+	}
+	if opts.DHT {
+		var err error
+		if fs.dht, err = fs.newDHT(); err != nil {
+			log.Printf("[%s] dht disabled: %s\n", opts.Transport.Addr(), err.Error())
+		}
 	}
+
+	return fs
 }
 
 // Start starts the file server.
@@ -66,6 +235,10 @@ func (s *FileServer) Start() error {
 		s.bootstrapNetwork()
 	}
 
+	if s.membership != nil {
+		go s.membership.Run(s.doneChan)
+	}
+
 	s.loop()
 
 	return nil
@@ -79,122 +252,355 @@ func (s *FileServer) Stop() {
 // OnPeer is a callback function that is called when a peer is connected to the file server.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-
 	s.peers[p.RemoteAddr().String()] = p
+	s.peerLock.Unlock()
 
 	log.Printf("connected with remote: %s\n", p.RemoteAddr())
 
-	return nil
+	announce := Message{
+		Payload: MessageAnnounce{
+			NodeID:     s.NodeID,
+			ListenAddr: s.Transport.Addr(),
+		},
+	}
+	if err := s.send(p, &announce); err != nil {
+		return err
+	}
+
+	return s.advertiseCapacity(p)
+}
+
+// OnPeerDisconnect is a callback function that is called when the connection with a peer is dropped.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	if nodeID, ok := s.peerNodes[addr]; ok && s.dht != nil {
+		s.dht.RemoveContact(nodeID)
+	}
+	delete(s.peers, addr)
+	delete(s.peerCapacity, addr)
+	delete(s.peerNodes, addr)
+	delete(s.writeLocks, addr)
+
+	s.codecLock.Lock()
+	delete(s.peerCodecs, addr)
+	s.codecLock.Unlock()
+
+	log.Printf("disconnected from remote: %s\n", addr)
+
+	if s.AutoRebalance {
+		s.Rebalance()
+	}
 }
 
 // Get gets the data from the file server.
 // It reads the data from the store if it exists, otherwise it fetches the data from the network.
-func (s *FileServer) Get(key string) (io.Reader, error) {
+// With a read quorum above one, the newest of the local copy and the copies of the peers is returned.
+// In erasure coded mode, the file is reconstructed from the shards that the peers have.
+func (s *FileServer) Get(key string, opts ...CallOption) (io.Reader, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return s.get(key, crypto.HashKey(key), opts...)
+}
+
+// get gets the data of key, which is known to the peers as netKey.
+func (s *FileServer) get(key, netKey string, opts ...CallOption) (io.Reader, error) {
+	o := s.callOptions(opts)
+
+	var local *store.Metadata
 	if s.Storage.Has(s.ID, key) {
-		log.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.Storage.Read(s.ID, key)
-		return r, err
+		if o.readQuorum <= 1 || s.DataShards > 0 {
+			log.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
+			return s.read(s.ID, key)
+		}
+
+		md, err := s.Storage.ReadMetadata(s.ID, key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		local = &md
+
+		log.Printf("[%s] consulting replicas of file (%s) for a read quorum of %d\n", s.Transport.Addr(), key, o.readQuorum)
+	} else {
+		log.Printf("[%s] dont have the file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
 	}
 
-	log.Printf("[%s] dont have the file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+	peers := s.peerList()
+
+	if s.DataShards > 0 {
+		if err := s.fetchShards(key, netKey, peers); err != nil {
+			return nil, err
+		}
+		return s.read(s.ID, key)
+	}
 
 	msg := Message{
 		Payload: MessageGetFile{
 			ID:  s.ID,
-			Key: crypto.HashKey(key),
+			Key: netKey,
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	var consulted int
+	if local != nil {
+		consulted++
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// The peers that the DHT locates the file on are asked first. When fewer of them than
+	// the read quorum have it, e.g. because their provider records are stale, the file is
+	// fetched from the other peers as well.
+	if located := s.providers(s.ID, netKey); len(located) > 0 && len(located) >= o.readQuorum {
+		log.Printf("[%s] located file (%s) on %d peers\n", s.Transport.Addr(), key, len(located))
+		// The answers are only read from the peers that the request was sent to.
+		located = s.sendEach(located, &msg)
 
-	for _, peer := range s.peers {
-		// First read the file size, so we can limit the amount of bytes that we read
-		// from the connection, so it will not keep hanging.
-		var fileSize int64
-		if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+		time.Sleep(time.Millisecond * 500)
+
+		n, err := s.fetch(key, netKey, located, local)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
+		if consulted += n; err == nil && consulted >= max(o.readQuorum, 1) {
+			return s.read(s.ID, key)
+		}
 
-		n, err := s.Storage.WriteDecrypt(
-			s.EncryptKey,
-			s.ID,
-			key,
-			io.LimitReader(peer, fileSize),
-		)
-		if err != nil {
-			return nil, err
+		log.Printf("[%s] %d of the located peers have file (%s), asking the other peers\n", s.Transport.Addr(), n, key)
+		peers = s.sendEach(exclude(peers, located), &msg)
+		if md, err := s.Storage.ReadMetadata(s.ID, key); err == nil {
+			local = &md
 		}
+	} else {
+		peers = s.sendEach(peers, &msg)
+	}
 
-		log.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+	time.Sleep(time.Millisecond * 500)
 
-		peer.CloseStream()
+	n, err := s.fetch(key, netKey, peers, local)
+	if err != nil {
+		return nil, err
+	}
+	if consulted += n; consulted < o.readQuorum {
+		return nil, fmt.Errorf("[%s] %d replicas of file (%s) consulted, %d required: %w", s.Transport.Addr(), consulted, key, o.readQuorum, ErrReadQuorum)
 	}
 
-	_, r, err := s.Storage.Read(s.ID, key)
-	return r, err
+	return s.read(s.ID, key)
 }
 
 // Store stores the data in the file server.
 // It writes the data to the store and then broadcasts the message to the peers.
-func (s *FileServer) Store(key string, r io.Reader) error {
+// The data is compressed before it is stored and encrypted, unless it turns out
+// to be incompressible. When versioning is enabled, each call creates a new version of the key.
+// Keys that contain the separator of version or sibling keys are rejected with ErrReservedKey.
+// With a write quorum, it waits for the answers of the peers and returns an error when
+// fewer replicas than that acknowledged the write. Without one, it returns as soon as
+// the data is sent, and StoreReport.Wait waits for the answers of the peers.
+func (s *FileServer) Store(key string, r io.Reader, opts ...CallOption) (*StoreReport, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	o := s.callOptions(opts)
+
+	fileBuffer, codec, err := s.compress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := sha256.Sum256(fileBuffer.Bytes())
+	md := store.Metadata{
+		Key:         key,
+		NetKey:      crypto.HashKey(key),
+		Checksum:    hex.EncodeToString(checksum[:]),
+		Compression: codec,
+		Timestamp:   time.Now().UTC(),
+		Origin:      s.NodeID,
+		Clock:       s.causalClock(key).Tick(s.NodeID),
+	}
+	if s.Versioning {
+		md.Version = newVersionID()
+	}
+
+	size, err := s.Storage.Write(s.ID, key, bytes.NewReader(fileBuffer.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.writeMetadata(s.ID, key, md); err != nil {
+		return nil, err
+	}
+	s.addOwnKey(key, md.NetKey)
+	if err = s.storeVersion(s.ID, key, md); err != nil {
+		return nil, err
+	}
+
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		peers   []PeerResult
+		answers <-chan []PeerResult
 	)
-
-	size, err := s.Storage.Write(s.ID, key, tee)
+	if s.DataShards > 0 {
+		peers, answers, err = s.storeShards(md, fileBuffer.Bytes(), o.writeQuorum)
+	} else {
+		peers, answers, err = s.replicate(md, size, fileBuffer, o.writeQuorum)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	report := &StoreReport{
+		Key:     key,
+		Size:    size,
+		Peers:   peers,
+		answers: answers,
+	}
+
+	if s.Versioning {
+		if err = s.PruneVersions(key); err != nil {
+			return report, err
+		}
+	}
+
+	if acked := report.Acked(); acked < o.writeQuorum {
+		return report, fmt.Errorf("%d of %d peers acknowledged the write, %d required: %w", acked, len(peers), o.writeQuorum, ErrWriteQuorum)
 	}
 
+	return report, nil
+}
+
+// replicate sends a copy of the file described by md, of which r holds the size bytes
+// that were stored, to every peer that it is placed on, and collects their answers.
+func (s *FileServer) replicate(md store.Metadata, size int64, r io.Reader, quorum int) ([]PeerResult, <-chan []PeerResult, error) {
 	msg := Message{
 		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  crypto.HashKey(key),
-			Size: size + 16,
+			ID:       s.ID,
+			Key:      md.NetKey,
+			Size:     size + 16,
+			Metadata: md,
 		},
 	}
 
-	if err = s.broadcast(&msg); err != nil {
-		return err
+	targets := s.storeTargets(s.ID, md.NetKey, size+16)
+	acks, done := s.expectAcks(s.ID, []string{md.NetKey}, md.Clock, len(targets))
+	collecting := false
+	defer func() {
+		if !collecting {
+			done()
+		}
+	}()
+
+	unlock := s.lockPeers(targets...)
+	defer unlock()
+
+	for _, peer := range targets {
+		if err := s.write(peer, &msg); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	time.Sleep(time.Millisecond * 5)
 
-	peers := make([]io.Writer, 0, len(s.peers))
-	for _, peer := range s.peers {
+	peers := make([]io.Writer, 0, len(targets))
+	for _, peer := range targets {
 		peers = append(peers, peer)
 	}
 
 	mw := io.MultiWriter(peers...)
-	if _, err = mw.Write([]byte{p2p.IncomingStream}); err != nil {
-		return err
+	if _, err := mw.Write([]byte{p2p.IncomingStream}); err != nil {
+		return nil, nil, err
 	}
 
-	n, err := crypto.CopyEncrypt(s.EncryptKey, fileBuffer, mw)
+	// Hash what is sent, so it can be compared with what the peers received.
+	h := sha256.New()
+	n, err := crypto.CopyEncrypt(s.EncryptKey, r, io.MultiWriter(mw, h))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	log.Printf("[%s] received and written (%d) bytes to disk: ", s.Transport.Addr(), n)
 
-	return nil
+	unlock()
+	s.addHints(s.ID, md.Key, md.NetKey, size+16)
+
+	sent := make(map[string]sentFile, len(targets))
+	for _, peer := range targets {
+		sent[peer.RemoteAddr().String()] = sentFile{size: int64(n), checksum: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	collecting = true
+	peerResults, answers := s.collectAcks(acks, done, targets, sent, quorum)
+	return peerResults, answers, nil
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+// compress reads all the data from r and compresses it with the configured codec.
+// It returns the data to be stored along with the name of the codec that was used,
+// which is compress.None when compression is disabled or not worthwhile.
+func (s *FileServer) compress(r io.Reader) (*bytes.Buffer, string, error) {
+	raw := new(bytes.Buffer)
+	if _, err := raw.ReadFrom(r); err != nil {
+		return nil, "", err
 	}
 
-	for _, peer := range s.peers {
-		_ = peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	if s.Compression == nil {
+		return raw, compress.None, nil
+	}
+
+	compressed := new(bytes.Buffer)
+	if _, err := compress.Compress(s.Compression, bytes.NewReader(raw.Bytes()), compressed); err != nil {
+		return nil, "", err
+	}
+
+	if !compress.Worthwhile(int64(raw.Len()), int64(compressed.Len()), s.CompressionRatio) {
+		return raw, compress.None, nil
+	}
+
+	return compressed, s.Compression.Name(), nil
+}
+
+// read reads a key from the store and decompresses it according to its metadata.
+func (s *FileServer) read(id, key string) (io.Reader, error) {
+	md, err := s.Storage.ReadMetadata(id, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	dr, err := compress.NewReader(md.Compression, r)
+	if err != nil {
+		return nil, err
+	}
+
+	closers := []io.Closer{dr}
+	if rc, ok := r.(io.Closer); ok {
+		closers = append(closers, rc)
+	}
+
+	return readCloser{Reader: dr, closers: closers}, nil
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	// The message is encoded once for every codec that the peers receive.
+	frames := make(map[string][]byte)
+	for _, peer := range s.peerList() {
+		codec := s.codecsOf(peer.RemoteAddr().String()).send
+		frame, ok := frames[codec.Name()]
+		if !ok {
+			b, err := codec.Encode(msg)
+			if err != nil {
+				return err
+			}
+			frame = p2p.EncodeMessage(b)
+			frames[codec.Name()] = frame
+		}
+
+		unlock := s.lockPeers(peer)
+		err := peer.Send(frame)
+		unlock()
+		if err != nil {
 			return err
 		}
 	}
@@ -202,6 +608,86 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// peerList returns the connected peers. It is taken under the peer lock, so it can be
+// iterated while peers connect and disconnect.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// sendEach sends a message to each of the given peers, and returns the peers that it was sent to.
+func (s *FileServer) sendEach(peers []p2p.Peer, msg *Message) []p2p.Peer {
+	sent := make([]p2p.Peer, 0, len(peers))
+	for _, peer := range peers {
+		if err := s.send(peer, msg); err != nil {
+			log.Printf("[%s] send to (%s) error: %s\n", s.Transport.Addr(), peer.RemoteAddr(), err.Error())
+			continue
+		}
+		sent = append(sent, peer)
+	}
+	return sent
+}
+
+// send sends a message to a single peer.
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	unlock := s.lockPeers(peer)
+	defer unlock()
+
+	return s.write(peer, msg)
+}
+
+// write sends a message to a peer that is already locked with lockPeers.
+func (s *FileServer) write(peer p2p.Peer, msg *Message) error {
+	b, err := s.codecsOf(peer.RemoteAddr().String()).send.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return peer.Send(p2p.EncodeMessage(b))
+}
+
+// lockPeers locks the connections of the given peers for writing, so that a message
+// and the stream that follows it are never interleaved with other writes. Peers are
+// locked in the order of their address, so concurrent callers can not deadlock.
+// The returned function unlocks the peers and may be called more than once.
+func (s *FileServer) lockPeers(peers ...p2p.Peer) func() {
+	s.peerLock.Lock()
+	locks := make(map[string]*sync.Mutex, len(peers))
+	for _, peer := range peers {
+		addr := peer.RemoteAddr().String()
+		if _, ok := s.writeLocks[addr]; !ok {
+			s.writeLocks[addr] = &sync.Mutex{}
+		}
+		locks[addr] = s.writeLocks[addr]
+	}
+	s.peerLock.Unlock()
+
+	addrs := make([]string, 0, len(locks))
+	for addr := range locks {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		locks[addr].Lock()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, addr := range addrs {
+				locks[addr].Unlock()
+			}
+		})
+	}
+}
+
 func (s *FileServer) loop() {
 	defer func() {
 		log.Printf("file server stopped due to error or user quit action\n")
@@ -210,12 +696,35 @@ func (s *FileServer) loop() {
 		}
 	}()
 
+	var syncTick <-chan time.Time
+	if s.SyncInterval > 0 {
+		ticker := time.NewTicker(s.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+
+	var republishTick <-chan time.Time
+	if s.dht != nil {
+		ticker := time.NewTicker(dhtRepublishInterval)
+		defer ticker.Stop()
+		republishTick = ticker.C
+	}
+
 	for {
 		select {
+		case <-syncTick:
+			if err := s.Sync(); err != nil {
+				log.Printf("sync error: %s\n", err.Error())
+			}
+
+		case <-republishTick:
+			s.republish()
+
 		case rpc := <-s.Transport.Consume():
 			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Printf("gob decode error: %s\n", err.Error())
+			codec := s.codecsOf(rpc.From.String()).recv
+			if err := codec.Decode(rpc.Payload, &msg); err != nil {
+				log.Printf("%s decode error: %s\n", codec.Name(), err.Error())
 			}
 			if err := s.handleMessage(rpc.From.String(), &msg); err != nil {
 				log.Printf("handle message error: %s\n", err.Error())
@@ -233,12 +742,49 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageGetShards:
+		return s.handleMessageGetShards(from, v)
+	case MessageStoreFileAck:
+		return s.handleMessageStoreFileAck(from, v)
+	case MessageCapacity:
+		return s.handleMessageCapacity(from, v)
+	case MessageAnnounce:
+		return s.handleMessageAnnounce(from, v)
+	case MessagePeerExchange:
+		return s.handleMessagePeerExchange(from, v)
+	case MessageGossip:
+		return s.handleMessageGossip(from, v)
+	case MessageDHT:
+		return s.handleMessageDHT(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageSyncRoot:
+		return s.handleMessageSyncRoot(from, v)
+	case MessageSyncBuckets:
+		return s.handleMessageSyncBuckets(from, v)
+	case MessageSyncEntries:
+		return s.handleMessageSyncEntries(from, v)
+	case MessageSyncRequest:
+		return s.handleMessageSyncRequest(from, v)
 	}
 	return nil
 }
 
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockPeers(peer)
+	defer unlock()
+
 	if !s.Storage.Has(msg.ID, msg.Key) {
+		// Answer anyway, so the requester knows that this replica is missing the file.
+		_ = peer.Send([]byte{p2p.IncomingStream})
+		if wErr := writeFileHeader(peer, fileNotFound, store.Metadata{}); wErr != nil {
+			return wErr
+		}
 		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key) //nolint:err113
 	}
 
@@ -249,19 +795,19 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 		return err
 	}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer func() { _ = rc.Close() }()
+	md, err := s.Storage.ReadMetadata(msg.ID, msg.Key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peers map", from) //nolint:err113
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer func() { _ = rc.Close() }()
 	}
 
 	// First send the "incomingStream" byte to the peer then
-	// we can send the file size as an int64.
+	// we can send the file header with the size and the metadata.
 	_ = peer.Send([]byte{p2p.IncomingStream})
-	if wErr := binary.Write(peer, binary.LittleEndian, fileSize); wErr != nil {
+	if wErr := writeFileHeader(peer, fileSize, md); wErr != nil {
 		return wErr
 	}
 	n, err := io.Copy(peer, r)
@@ -275,20 +821,63 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peers map", from) //nolint:err113
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
 	}
 
-	n, err := s.Storage.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
-	if err != nil {
+	if limiter, ok := s.Storage.(store.Limiter); ok {
+		if err := limiter.CheckQuota(msg.ID, msg.Size); err != nil {
+			return s.refuseStoreFile(peer, msg, io.LimitReader(peer, msg.Size), err)
+		}
+	}
+
+	// Hash what is received, so the sender can compare it with what it sent.
+	h := sha256.New()
+	r := &countingReader{r: io.TeeReader(io.LimitReader(peer, msg.Size), h)}
+
+	key, md, err := s.resolveConflict(msg.ID, msg.Key, msg.Metadata)
+	if err != nil || len(key) == 0 {
+		_, _ = io.Copy(io.Discard, r)
+		peer.CloseStream()
+		// A write that is superseded by the copy that is already here still counts as stored.
+		if ackErr := s.ackStoreFile(peer, msg, r.n, hex.EncodeToString(h.Sum(nil)), err); ackErr != nil {
+			return ackErr
+		}
 		return err
 	}
+
+	var n int64
+	if md.NetKey != "" {
+		// The data replaces a file that this node stored itself, which is kept decrypted.
+		n, err = store.WriteDecrypt(s.Storage, s.EncryptKey, msg.ID, key, r)
+	} else {
+		n, err = s.Storage.Write(msg.ID, key, r)
+	}
+	if err != nil {
+		return s.refuseStoreFile(peer, msg, r, err)
+	}
 	log.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
 
 	peer.CloseStream()
 
-	return nil
+	err = s.writeMetadata(msg.ID, key, md)
+	if err == nil && key == msg.Key {
+		err = s.storeVersion(msg.ID, key, md)
+	}
+
+	if ackErr := s.ackStoreFile(peer, msg, r.n, hex.EncodeToString(h.Sum(nil)), err); ackErr != nil {
+		return ackErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if msg.Metadata.Shard == nil {
+		s.provide(msg.ID, msg.Key)
+	}
+
+	return s.advertiseCapacity(peer)
 }
 
 func (s *FileServer) bootstrapNetwork() {
@@ -305,8 +894,3 @@ func (s *FileServer) bootstrapNetwork() {
 		}(addr)
 	}
 }
-
-func init() {
-	gob.Register(MessageStoreFile{})
-	gob.Register(MessageGetFile{})
-}
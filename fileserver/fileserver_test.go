@@ -0,0 +1,638 @@
+package fileserver_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/fileserver"
+	"github.com/yigithankarabulut/distributed-file-storage/fileserver/fileservertest"
+)
+
+func TestStoreGet(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4)
+
+	data := []byte("my big data file here!")
+	report := c.Store(0, "picture.png", data).Wait()
+	assert.Len(t, report.Peers, 3)
+	assert.Equal(t, 3, report.Acked())
+	c.WaitReplicas(0, "picture.png", 3)
+
+	// The owner serves its own copy, and fetches a replica once it is gone.
+	assert.Equal(t, data, c.Get(0, "picture.png"))
+	c.Delete(0, "picture.png")
+	assert.Equal(t, data, c.Get(0, "picture.png"))
+
+	// Other nodes only hold encrypted replicas under another key.
+	_, err := c.TryGet(1, "picture.png")
+	assert.NotNil(t, err)
+}
+
+func TestReplicationFactor(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 5, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.ReplicationFactor = 2
+	}))
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		owner := i % 5
+		c.Store(owner, key, []byte(key)).Wait()
+
+		// The replicas are on the nodes that the key is placed on, besides the owner, which
+		// keeps its copy whether it is one of them or not.
+		placed := c.Node(owner).Server.Placement(key)
+		assert.Len(t, placed, 2, key)
+		var want []int
+		for _, nodeID := range placed {
+			var j int
+			_, _ = fmt.Sscanf(nodeID, "node-%d", &j)
+			if j != owner {
+				want = append(want, j)
+			}
+		}
+		assert.ElementsMatch(t, want, c.Replicas(owner, key), key)
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.HintTTL = time.Minute
+	}))
+
+	c.Kill(2)
+
+	report := c.Store(0, "missed", []byte("written while node-2 was down")).Wait()
+	assert.Equal(t, 1, report.Acked())
+	assert.Len(t, c.Node(0).Server.PendingHints(), 1)
+	assert.Equal(t, []int{1}, c.Replicas(0, "missed"))
+
+	// The replica that was missed is handed off once the node is back.
+	c.Restart(2)
+	c.WaitReplicas(0, "missed", 2)
+	c.Eventually("the hint to be delivered", func() bool {
+		return len(c.Node(0).Server.PendingHints()) == 0
+	})
+}
+
+func TestHintedHandoffReplicationFactor(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.ReplicationFactor = 2
+		opts.HintTTL = time.Minute
+	}))
+	owner := c.Node(0).Server
+
+	// One file that is placed on node-3 and one that is not.
+	var placed, other string
+	for i := 0; placed == "" || other == ""; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if slices.Contains(owner.Placement(key), "node-3") {
+			placed = key
+		} else {
+			other = key
+		}
+	}
+
+	c.Kill(3)
+	c.Store(0, placed, []byte("placed on node-3")).Wait()
+	c.Store(0, other, []byte("not placed on node-3")).Wait()
+
+	// Only the write of the file that is placed on node-3 is held for it.
+	hints := owner.PendingHints()
+	if assert.Len(t, hints, 1) {
+		assert.Equal(t, placed, hints[0].Key)
+		assert.Equal(t, "node-3", hints[0].Target)
+	}
+
+	c.Restart(3)
+	c.Eventually("the hint to be delivered", func() bool {
+		return len(owner.PendingHints()) == 0
+	})
+	c.Eventually("node-3 to get the file", func() bool {
+		return slices.Contains(c.Replicas(0, placed), 3)
+	})
+}
+
+func TestRestartKeepsFiles(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3)
+
+	data := []byte("survives a restart")
+	c.Store(1, "durable", data)
+	c.WaitReplicas(1, "durable", 2)
+
+	c.Kill(1)
+	c.Restart(1)
+
+	assert.Equal(t, data, c.Get(1, "durable"))
+	c.Delete(1, "durable")
+	assert.Equal(t, data, c.Get(1, "durable"))
+}
+
+func TestWriteQuorumPartition(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.AckTimeout = time.Second
+	}))
+
+	c.Store(0, "before", []byte("both replicas"), fileserver.WithWriteQuorum(2))
+
+	c.Faults.Isolate("node-0")
+	c.Eventually("node-0 to lose its peers", func() bool {
+		return len(c.Node(0).Server.Peers()) == 0
+	})
+
+	_, err := c.Node(0).Server.Store("during", bytes.NewReader([]byte("no replicas")), fileserver.WithWriteQuorum(1))
+	assert.ErrorIs(t, err, fileserver.ErrWriteQuorum)
+
+	c.Faults.HealAll()
+	assert.Nil(t, c.Node(1).Server.Transport.Dial("node-0"))
+	c.WaitMesh()
+
+	c.Store(0, "after", []byte("both replicas again"), fileserver.WithWriteQuorum(2))
+}
+
+func TestErasureCoding(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 6, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.DataShards = 3
+		opts.ParityShards = 2
+	}))
+
+	data := []byte("coded into three data shards and two parity shards")
+	c.Store(0, "coded", data)
+	c.Delete(0, "coded")
+
+	// Any two shards can be lost.
+	c.Kill(4)
+	c.Kill(5)
+	assert.Equal(t, data, c.Get(0, "coded"))
+}
+
+func TestProtoCodecCluster(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.Codec = fileserver.ProtoCodec{}
+		opts.DHT = true
+	}))
+
+	data := []byte("encoded in the protobuf wire format")
+	report := c.Store(0, "proto", data, fileserver.WithWriteQuorum(2))
+	assert.Equal(t, 2, report.Acked())
+
+	c.Delete(0, "proto")
+	assert.Equal(t, data, c.Get(0, "proto"))
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	t.Parallel()
+
+	// Each node prefers another codec, and sends with it to the nodes that speak it.
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		switch opts.NodeID {
+		case "node-0":
+			opts.Codec = fileserver.JSONCodec{}
+		case "node-1":
+			opts.Codec = fileserver.ProtoCodec{}
+		}
+	}))
+
+	data := []byte("encoded differently in each direction")
+	report := c.Store(0, "mixed", data, fileserver.WithWriteQuorum(2))
+	assert.Equal(t, 2, report.Acked())
+
+	c.Delete(0, "mixed")
+	assert.Equal(t, data, c.Get(0, "mixed"))
+
+	data = []byte("sent with gob, answered with json and proto")
+	c.Store(2, "other", data, fileserver.WithWriteQuorum(2))
+	c.Delete(2, "other")
+	assert.Equal(t, data, c.Get(2, "other"))
+}
+
+func TestVersioning(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.Versioning = true
+		opts.Retention = fileserver.RetentionPolicy{KeepLast: 2}
+	}))
+	s := c.Node(0).Server
+	netKey := crypto.HashKey("doc")
+
+	c.Store(0, "doc", []byte("first"))
+	c.Store(0, "doc", []byte("second"))
+	versions, err := s.ListVersions("doc")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	pruned := versions[1].ID
+	onPeers := func(version string) int {
+		n := 0
+		for _, node := range c.Running()[1:] {
+			if node.Server.Storage.Has(s.ID, netKey+"@v."+version) {
+				n++
+			}
+		}
+		return n
+	}
+	c.Eventually("the versions to be replicated", func() bool {
+		return onPeers(versions[0].ID) == 2 && onPeers(pruned) == 2
+	})
+
+	// The oldest version is pruned here and on the peers once a third one is kept.
+	c.Store(0, "doc", []byte("third"))
+	versions, err = s.ListVersions("doc")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+	assert.NotEqual(t, pruned, versions[1].ID)
+	c.Eventually("the pruned version to be deleted on the peers", func() bool {
+		return onPeers(pruned) == 0
+	})
+
+	assert.Equal(t, []byte("third"), c.Get(0, "doc"))
+	r, err := s.GetVersion("doc", versions[1].ID)
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, []byte("second"), b)
+
+	// Versions are replicated, so they can be fetched once the local copy is gone.
+	assert.Nil(t, s.Storage.Delete(s.ID, "doc@v."+versions[1].ID))
+	r, err = s.GetVersion("doc", versions[1].ID)
+	assert.Nil(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, []byte("second"), b)
+
+	// A key that looks like a version of another key is not accepted.
+	_, err = s.Store("doc@v."+versions[0].ID, bytes.NewReader([]byte("fake")))
+	assert.ErrorIs(t, err, fileserver.ErrReservedKey)
+	versions, err = s.ListVersions("doc")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	t.Parallel()
+
+	// Node 0 and node 1 write as the same ID, while they can not reach each other.
+	id := crypto.GenerateID()
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		if opts.NodeID != "node-2" {
+			opts.ID = id
+		}
+		opts.ConflictResolution = fileserver.KeepSiblings
+	}))
+
+	c.Faults.Partition("node-0", "node-1")
+	c.Eventually("node-0 and node-1 to lose each other", func() bool {
+		return len(c.Node(0).Server.Peers()) == 1 && len(c.Node(1).Server.Peers()) == 1
+	})
+	for _, key := range []string{"synced", "read"} {
+		c.Store(0, key, []byte("from node-0"))
+		c.Store(1, key, []byte("from node-1"))
+	}
+
+	c.Faults.HealAll()
+	assert.Nil(t, c.Node(1).Server.Transport.Dial("node-0"))
+	c.WaitMesh()
+
+	// The writers resolve the conflict against their own copies, whether the other
+	// write comes back through a read or through anti-entropy.
+	assert.Equal(t, []byte("from node-1"), c.Get(0, "read", fileserver.WithReadQuorum(2)))
+	for _, i := range []int{0, 1} {
+		assert.Nil(t, c.Node(i).Server.Sync())
+		c.Eventually(fmt.Sprintf("node-%d to keep both writes", i), func() bool {
+			siblings, err := c.Node(i).Server.Siblings("synced")
+			return err == nil && len(siblings) == 2
+		})
+	}
+
+	for _, key := range []string{"synced", "read"} {
+		assert.Equal(t, []byte("from node-1"), c.Get(0, key), key)
+
+		siblings, err := c.Node(0).Server.Siblings(key)
+		assert.Nil(t, err)
+		if assert.Len(t, siblings, 2, key) {
+			assert.Equal(t, "node-1", siblings[0].Origin)
+			assert.Equal(t, "node-0", siblings[1].Origin)
+		}
+	}
+
+	// A key that looks like a sibling of another key is not accepted.
+	_, err := c.Node(0).Server.Store(crypto.HashKey("synced")+"@s.node-2", bytes.NewReader([]byte("fake")))
+	assert.ErrorIs(t, err, fileserver.ErrReservedKey)
+}
+
+func TestAntiEntropy(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.SyncInterval = 100 * time.Millisecond
+	}))
+	owner := c.Node(0).Server
+
+	c.Store(0, "lost", []byte("deleted from a replica"))
+	c.WaitReplicas(0, "lost", 2)
+	assert.Nil(t, c.Node(2).Server.Storage.Delete(owner.ID, crypto.HashKey("lost")))
+
+	c.Kill(2)
+	c.Store(0, "missed", []byte("written while node-2 was down")).Wait()
+	assert.Equal(t, []int{1}, c.Replicas(0, "missed"))
+	c.Restart(2)
+
+	// The periodic rounds find both files missing on node-2 and push them to it.
+	c.WaitReplicas(0, "lost", 2)
+	c.WaitReplicas(0, "missed", 2)
+}
+
+func TestAntiEntropyReplicationFactor(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.ReplicationFactor = 2
+		opts.SyncInterval = 100 * time.Millisecond
+	}))
+	owner := c.Node(0).Server
+
+	// A file that is placed on two nodes besides the owner.
+	var (
+		key    string
+		placed []int
+	)
+	for i := 0; len(placed) < 2; i++ {
+		key, placed = fmt.Sprintf("file_%d", i), nil
+		for _, nodeID := range owner.Placement(key) {
+			var j int
+			_, _ = fmt.Sscanf(nodeID, "node-%d", &j)
+			if j != 0 {
+				placed = append(placed, j)
+			}
+		}
+	}
+	c.Store(0, key, []byte("placed on two nodes")).Wait()
+	assert.ElementsMatch(t, placed, c.Replicas(0, key))
+
+	// The node that lost the file gets it back from the other node it is placed on,
+	// and the nodes that it is not placed on never get it.
+	c.Kill(placed[0])
+	assert.Nil(t, c.Node(placed[0]).Server.Storage.Delete(owner.ID, crypto.HashKey(key)))
+	c.Restart(placed[0])
+	c.WaitReplicas(0, key, 2)
+	assert.ElementsMatch(t, placed, c.Replicas(0, key))
+}
+
+func TestReadRepair(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3)
+	owner := c.Node(0).Server
+	netKey := crypto.HashKey("doc")
+
+	c.Store(0, "doc", []byte("first"))
+	c.WaitReplicas(0, "doc", 2)
+
+	c.Kill(2)
+	c.Store(0, "doc", []byte("second"))
+	c.Restart(2)
+
+	stale, err := c.Node(2).Server.Storage.ReadMetadata(owner.ID, netKey)
+	assert.Nil(t, err)
+	current, err := c.Node(1).Server.Storage.ReadMetadata(owner.ID, netKey)
+	assert.Nil(t, err)
+	assert.NotEqual(t, current.Checksum, stale.Checksum)
+
+	// A read that consults the replicas repairs the outdated one.
+	assert.Equal(t, []byte("second"), c.Get(0, "doc", fileserver.WithReadQuorum(3)))
+	c.Eventually("the outdated replica to be repaired", func() bool {
+		md, err := c.Node(2).Server.Storage.ReadMetadata(owner.ID, netKey)
+		return err == nil && md.Checksum == current.Checksum
+	})
+
+	// And the missing one.
+	assert.Nil(t, c.Node(1).Server.Storage.Delete(owner.ID, netKey))
+	assert.Equal(t, []byte("second"), c.Get(0, "doc", fileserver.WithReadQuorum(2)))
+	c.WaitReplicas(0, "doc", 2)
+}
+
+func TestHintLimits(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.HintTTL = 500 * time.Millisecond
+		opts.HintBudget = 100
+	}))
+	s := c.Node(0).Server
+
+	c.Kill(2)
+
+	// Hints that do not fit in the budget are dropped, and a newer write of a key
+	// replaces its hint.
+	large := make([]byte, 200)
+	_, _ = rand.New(rand.NewSource(1)).Read(large)
+	c.Store(0, "large", large)
+	assert.Empty(t, s.PendingHints())
+	c.Store(0, "small", []byte("first"))
+	c.Store(0, "small", []byte("second"))
+	if hints := s.PendingHints(); assert.Len(t, hints, 1) {
+		assert.Equal(t, "node-2", hints[0].Target)
+	}
+
+	// Hints expire after their TTL.
+	c.Eventually("the hint to expire", func() bool {
+		return len(s.PendingHints()) == 0
+	})
+	c.Restart(2)
+	assert.Equal(t, []int{1}, c.Replicas(0, "small"))
+}
+
+func TestCorruptReplica(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3)
+	owner := c.Node(0).Server
+	netKey := crypto.HashKey("doc")
+
+	data := []byte("the valid local copy")
+	c.Store(0, "doc", data).Wait()
+	c.WaitReplicas(0, "doc", 2)
+
+	// Node 1 claims to have a newer write, but its data does not match its checksum.
+	replica := c.Node(1).Server.Storage
+	md, err := replica.ReadMetadata(owner.ID, netKey)
+	assert.Nil(t, err)
+	md.Clock = md.Clock.Tick("node-0")
+	_, err = replica.Write(owner.ID, netKey, bytes.NewReader(bytes.Repeat([]byte("x"), 64)))
+	assert.Nil(t, err)
+	assert.Nil(t, replica.WriteMetadata(owner.ID, netKey, md))
+
+	// The corrupt replica is rejected without touching the local copy, which is the
+	// only other copy once node 2 is gone, and does not count towards the read quorum.
+	c.Kill(2)
+	_, err = c.TryGet(0, "doc", fileserver.WithReadQuorum(2))
+	assert.ErrorIs(t, err, fileserver.ErrReadQuorum)
+	assert.Equal(t, data, c.Get(0, "doc"))
+
+	// With node 2 back, its valid replica makes up the quorum.
+	c.Restart(2)
+	assert.Equal(t, data, c.Get(0, "doc", fileserver.WithReadQuorum(2)))
+}
+
+func TestStoreAcks(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 3, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		if opts.NodeID == "node-2" {
+			opts.StorageQuota = 10
+		}
+	}))
+	data := make([]byte, 100)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+
+	// Without a write quorum, Store returns before the peers answer.
+	report := c.Store(0, "unacked", data)
+	assert.Len(t, report.Peers, 2)
+	assert.Equal(t, 0, report.Acked())
+	for _, peer := range report.Peers {
+		assert.True(t, peer.Pending, peer.Peer)
+	}
+
+	// The answers are reported once they arrive, including the refusal of the peer
+	// that is over its quota.
+	report.Wait()
+	assert.Equal(t, 1, report.Acked())
+	for _, peer := range report.Peers {
+		assert.False(t, peer.Pending, peer.Peer)
+		assert.Equal(t, peer.Peer == "node-2/2", peer.Err != nil, peer.Peer)
+	}
+
+	// With a write quorum, Store waits for the answers and fails when too few peers stored the file.
+	_, err := c.Node(0).Server.Store("acked", bytes.NewReader(data), fileserver.WithWriteQuorum(2))
+	assert.ErrorIs(t, err, fileserver.ErrWriteQuorum)
+	report = c.Store(0, "acked", data, fileserver.WithWriteQuorum(1))
+	assert.Equal(t, 1, report.Acked())
+}
+
+func TestRebalance(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.ReplicationFactor = 2
+		opts.AutoRebalance = true
+	}))
+	s := c.Node(0).Server
+
+	// placed reports whether the replicas of key are on the nodes it is placed on.
+	placed := func(key string) bool {
+		for _, nodeID := range s.Placement(key) {
+			var i int
+			_, _ = fmt.Sscanf(nodeID, "node-%d", &i)
+			if i != 0 && !c.Node(i).Server.Storage.Has(s.ID, crypto.HashKey(key)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	keys := make([]string, 12)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("file_%d", i)
+		c.Store(0, keys[i], []byte(keys[i])).Wait()
+		assert.True(t, placed(keys[i]), keys[i])
+	}
+
+	// The files that node-3 held move to the nodes that they are placed on without it.
+	c.Kill(3)
+	c.Eventually("node-0 to lose node-3", func() bool {
+		return len(s.Peers()) == 2
+	})
+	c.Eventually("the files to be rebalanced", func() bool {
+		for _, key := range keys {
+			if !placed(key) {
+				return false
+			}
+		}
+		return !s.RebalanceProgress().Running
+	})
+	assert.Zero(t, s.RebalanceProgress().Failed)
+}
+
+func TestPeerExchange(t *testing.T) {
+	t.Parallel()
+
+	// Every node is only bootstrapped with node-0, and dials the others once it learns about them.
+	c := fileservertest.New(t, 3)
+	for _, node := range c.Nodes {
+		assert.Len(t, node.Server.Peers(), 2, node.Name)
+	}
+}
+
+func TestMaxPeers(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4, fileservertest.WithoutMesh(), fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.MaxPeers = 1
+	}))
+
+	// node-0 accepts every node that dials it, but the others do not dial the nodes that they
+	// learn about from it, as they are already connected with node-0.
+	c.Eventually("node-0 to accept every node", func() bool {
+		return len(c.Node(0).Server.Peers()) == 3
+	})
+	assert.Never(t, func() bool {
+		for _, node := range c.Nodes[1:] {
+			if len(node.Server.Peers()) > 1 {
+				return true
+			}
+		}
+		return false
+	}, 500*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestStaleProviders(t *testing.T) {
+	t.Parallel()
+
+	c := fileservertest.New(t, 4, fileservertest.WithServerOpts(func(opts *fileserver.ServerOpts) {
+		opts.DHT = true
+	}))
+	id, netKey := c.Node(0).Server.ID, crypto.HashKey("moved")
+
+	c.Kill(3)
+	data := []byte("moved behind the back of the dht")
+	assert.Equal(t, 2, c.Store(0, "moved", data, fileserver.WithWriteQuorum(2)).Acked())
+	c.Restart(3)
+
+	// The replicas move from the nodes that provide them to node-3, which does not, so every
+	// provider record is stale and Get has to ask the other peers.
+	from, to := c.Node(1).Server.Storage, c.Node(3).Server.Storage
+	_, r, err := from.Read(id, netKey)
+	assert.Nil(t, err)
+	_, err = to.Write(id, netKey, r)
+	assert.Nil(t, err)
+	if rc, ok := r.(io.Closer); ok {
+		_ = rc.Close()
+	}
+	md, err := from.ReadMetadata(id, netKey)
+	assert.Nil(t, err)
+	assert.Nil(t, to.WriteMetadata(id, netKey, md))
+	assert.Nil(t, from.Delete(id, netKey))
+	assert.Nil(t, c.Node(2).Server.Storage.Delete(id, netKey))
+
+	c.Delete(0, "moved")
+	assert.Equal(t, data, c.Get(0, "moved"))
+}
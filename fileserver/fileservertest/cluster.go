@@ -0,0 +1,383 @@
+// Package fileservertest runs clusters of file servers in memory for tests. The nodes
+// are connected through a p2p.MemNetwork with the faults of a p2p.Faults, and keep
+// their files in temporary directories, so clusters start fast and run in parallel.
+package fileservertest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/fileserver"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// defaultTimeout is how long the helpers wait for the cluster to reach a state.
+const defaultTimeout = 10 * time.Second
+
+// Cluster is a cluster of file servers that are connected with each other in memory.
+type Cluster struct {
+	t       testing.TB
+	root    string
+	timeout time.Duration
+	noMesh  bool
+	configs []func(*fileserver.ServerOpts)
+
+	// Network is the in-memory network that the nodes are connected through.
+	Network *p2p.MemNetwork
+	// Faults injects faults into the connections between the nodes, which are named
+	// by Node.Name.
+	Faults *p2p.Faults
+	// Nodes are the nodes of the cluster, in the order that they were started in.
+	Nodes []*Node
+}
+
+// Node is a node of a cluster.
+type Node struct {
+	Name   string
+	Server *fileserver.FileServer
+
+	opts fileserver.ServerOpts
+
+	mu      sync.Mutex
+	peers   map[p2p.Peer]struct{}
+	running bool
+	stopped chan struct{}
+}
+
+// Option is a functional option for configuring a Cluster.
+type Option func(*Cluster)
+
+// WithServerOpts is a functional option for changing the options that every file server
+// of the cluster is created with.
+func WithServerOpts(f func(*fileserver.ServerOpts)) Option {
+	return func(c *Cluster) {
+		c.configs = append(c.configs, f)
+	}
+}
+
+// WithTimeout is a functional option for setting how long the helpers wait for the
+// cluster to reach a state before they fail the test.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.timeout = d
+	}
+}
+
+// WithoutMesh is a functional option that makes New return once the nodes are started,
+// without waiting until they are all connected with each other.
+func WithoutMesh() Option {
+	return func(c *Cluster) {
+		c.noMesh = true
+	}
+}
+
+// WithSeed is a functional option for setting the seed of the randomness of the faults.
+func WithSeed(seed int64) Option {
+	return func(c *Cluster) {
+		c.Faults = p2p.NewFaults(seed)
+	}
+}
+
+// New starts a cluster of n nodes, which are bootstrapped with the first node and
+// discover each other through peer exchange, and waits until they are all connected
+// unless WithoutMesh is given.
+// The cluster is stopped when the test ends.
+func New(t testing.TB, n int, opts ...Option) *Cluster {
+	t.Helper()
+
+	c := &Cluster{
+		t:       t,
+		root:    t.TempDir(),
+		timeout: defaultTimeout,
+		Network: p2p.NewMemNetwork(),
+		Faults:  p2p.NewFaults(1),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	encryptKey, err := crypto.NewEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("node-%d", i)
+		opts := fileserver.ServerOpts{
+			ID:                crypto.GenerateID(),
+			NodeID:            name,
+			EncryptKey:        encryptKey,
+			StorageRoot:       filepath.Join(c.root, name),
+			PathTransformFunc: store.CASPathTransformFunc,
+			PeerExchange:      true,
+		}
+		if i > 0 {
+			opts.BootstrapNodes = []string{c.Nodes[0].Name}
+		}
+		for _, config := range c.configs {
+			config(&opts)
+		}
+
+		node := &Node{Name: name, opts: opts}
+		c.Nodes = append(c.Nodes, node)
+		c.start(node)
+	}
+
+	t.Cleanup(c.Stop)
+
+	if !c.noMesh {
+		c.WaitMesh()
+	}
+	return c
+}
+
+// start starts a node with a new file server and transport, which keeps the files,
+// IDs and encryption key of the node.
+func (c *Cluster) start(node *Node) {
+	c.t.Helper()
+
+	tr := p2p.NewMemTransport(c.Network,
+		p2p.WithListenAddr(node.Name),
+		p2p.WithHandshakeFunc(p2p.NOPHandshakeFunc),
+		p2p.WithDecoder(&p2p.DefaultDecoder{}),
+	)
+	ft, err := c.Faults.Wrap(tr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	opts := node.opts
+	opts.Transport = ft
+	s := fileserver.NewFileServer(opts)
+
+	node.mu.Lock()
+	node.Server = s
+	node.peers = make(map[p2p.Peer]struct{})
+	node.running = true
+	node.stopped = make(chan struct{})
+	node.mu.Unlock()
+
+	tr.ShakeHands = s.Handshake
+	tr.OnPeer = func(p p2p.Peer) error {
+		node.mu.Lock()
+		node.peers[p] = struct{}{}
+		node.mu.Unlock()
+		return s.OnPeer(p)
+	}
+	tr.OnPeerDisconnect = func(p p2p.Peer) {
+		node.mu.Lock()
+		delete(node.peers, p)
+		node.mu.Unlock()
+		s.OnPeerDisconnect(p)
+	}
+
+	go func(stopped chan struct{}) {
+		defer close(stopped)
+		if err := s.Start(); err != nil {
+			c.t.Errorf("node %s: %s", node.Name, err)
+		}
+	}(node.stopped)
+
+	// The next nodes are bootstrapped with this one, so it has to listen before they start.
+	c.Eventually(fmt.Sprintf("%s to listen", node.Name), func() bool {
+		return c.Network.Listening(node.Name)
+	})
+}
+
+// stop stops the file server of a node and drops its connections.
+func (c *Cluster) stop(node *Node) {
+	node.mu.Lock()
+	if !node.running {
+		node.mu.Unlock()
+		return
+	}
+	node.running = false
+	peers := make([]p2p.Peer, 0, len(node.peers))
+	for p := range node.peers {
+		peers = append(peers, p)
+	}
+	node.mu.Unlock()
+
+	node.Server.Stop()
+	_ = node.Server.Transport.Close()
+	for _, p := range peers {
+		_ = p.Close()
+	}
+	<-node.stopped
+}
+
+// Running reports whether the node is running.
+func (n *Node) Running() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.running
+}
+
+// Node returns the node with the given index.
+func (c *Cluster) Node(i int) *Node {
+	return c.Nodes[i]
+}
+
+// Running returns the nodes that are running.
+func (c *Cluster) Running() []*Node {
+	var nodes []*Node
+	for _, node := range c.Nodes {
+		if node.Running() {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// WaitMesh waits until every running node is connected with every other running node.
+func (c *Cluster) WaitMesh() {
+	c.t.Helper()
+
+	c.Eventually("the nodes to form a mesh", func() bool {
+		running := c.Running()
+		for _, node := range running {
+			if len(node.Server.Peers()) < len(running)-1 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Eventually waits until cond holds, failing the test when it does not hold in time.
+func (c *Cluster) Eventually(what string, cond func() bool) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(c.timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out after %s waiting for %s", c.timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Store stores data as key on node i.
+func (c *Cluster) Store(i int, key string, data []byte, opts ...fileserver.CallOption) *fileserver.StoreReport {
+	c.t.Helper()
+
+	report, err := c.Nodes[i].Server.Store(key, bytes.NewReader(data), opts...)
+	if err != nil {
+		c.t.Fatalf("store of %s on %s: %s", key, c.Nodes[i].Name, err)
+	}
+	return report
+}
+
+// Get gets key on node i, which fetches it from the network when node i does not have it.
+func (c *Cluster) Get(i int, key string, opts ...fileserver.CallOption) []byte {
+	c.t.Helper()
+
+	data, err := c.TryGet(i, key, opts...)
+	if err != nil {
+		c.t.Fatalf("get of %s on %s: %s", key, c.Nodes[i].Name, err)
+	}
+	return data
+}
+
+// TryGet gets key on node i like Get, returning the error instead of failing the test.
+func (c *Cluster) TryGet(i int, key string, opts ...fileserver.CallOption) ([]byte, error) {
+	r, err := c.Nodes[i].Server.Get(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+	return io.ReadAll(r)
+}
+
+// Delete deletes the copy of key that node i keeps for itself, so Get on node i has to
+// fetch it from the network. The replicas on the other nodes are kept.
+func (c *Cluster) Delete(i int, key string) {
+	c.t.Helper()
+
+	s := c.Nodes[i].Server
+	if err := s.Storage.Delete(s.ID, key); err != nil {
+		c.t.Fatalf("delete of %s on %s: %s", key, c.Nodes[i].Name, err)
+	}
+}
+
+// Replicas returns the indexes of the nodes that hold a replica of the key stored by node i.
+func (c *Cluster) Replicas(i int, key string) []int {
+	owner := c.Nodes[i].Server
+	netKey := crypto.HashKey(key)
+
+	var replicas []int
+	for j, node := range c.Nodes {
+		if j != i && node.Server.Storage.Has(owner.ID, netKey) {
+			replicas = append(replicas, j)
+		}
+	}
+	return replicas
+}
+
+// WaitReplicas waits until n nodes hold a replica of the key stored by node i.
+func (c *Cluster) WaitReplicas(i int, key string, n int) {
+	c.t.Helper()
+
+	c.Eventually(fmt.Sprintf("%d replicas of %s", n, key), func() bool {
+		return len(c.Replicas(i, key)) == n
+	})
+}
+
+// Kill stops node i and drops its connections, like a crash of the node does. Its
+// files stay on disk, so it can be restarted with them.
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+
+	node := c.Nodes[i]
+	if !node.Running() {
+		return
+	}
+	c.stop(node)
+
+	c.Eventually(fmt.Sprintf("the nodes to notice that %s is gone", node.Name), func() bool {
+		for _, other := range c.Running() {
+			for _, nodeID := range other.Server.Peers() {
+				if nodeID == node.opts.NodeID {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// Restart starts node i again after it was killed, bootstrapped with a running node,
+// and waits until it is connected with every running node.
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+
+	node := c.Nodes[i]
+	if node.Running() {
+		return
+	}
+
+	node.opts.BootstrapNodes = nil
+	for _, other := range c.Running() {
+		node.opts.BootstrapNodes = []string{other.Name}
+		break
+	}
+
+	c.start(node)
+	c.WaitMesh()
+}
+
+// Stop stops every node of the cluster.
+func (c *Cluster) Stop() {
+	for _, node := range c.Nodes {
+		c.stop(node)
+	}
+}
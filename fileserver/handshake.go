@@ -0,0 +1,108 @@
+package fileserver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+)
+
+// handshakeTimeout is how long Handshake waits for a peer to name the codecs it speaks.
+const handshakeTimeout = 5 * time.Second
+
+// builtinCodecs are the codecs that every node speaks, besides the codec of its options.
+var builtinCodecs = []Codec{ProtoCodec{}, GOBCodec{}, JSONCodec{}}
+
+// peerCodecs are the codecs that the messages exchanged with a peer are encoded with.
+type peerCodecs struct {
+	send Codec
+	recv Codec
+}
+
+// Handshake is a handshake function for the transport, which agrees with the peer on
+// the codecs of the messages. Both nodes send the names of the codecs that they speak,
+// in order of preference, and then each node sends its messages with the first codec
+// of its own preferences that the other node speaks. Either every node of a cluster or
+// none of them has to use it, as the nodes that do not all send with their Codec.
+func (s *FileServer) Handshake(p p2p.Peer) error {
+	codecs := s.codecs()
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	if err := p.Send(p2p.EncodeMessage([]byte(strings.Join(names, ",")))); err != nil {
+		return err
+	}
+
+	_ = p.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	var rpc p2p.RPC
+	err := p2p.DefaultDecoder{}.Decode(p, &rpc)
+	_ = p.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if rpc.Stream {
+		return fmt.Errorf("[%s] %s sent a stream instead of the codecs it speaks", s.Transport.Addr(), p.RemoteAddr()) //nolint:err113
+	}
+
+	theirs := strings.Split(string(rpc.Payload), ",")
+
+	var pc peerCodecs
+	for _, codec := range codecs {
+		if pc.send == nil && codecNamed(theirs, codec.Name()) {
+			pc.send = codec
+		}
+	}
+	for _, name := range theirs {
+		for _, codec := range codecs {
+			if pc.recv == nil && codec.Name() == name {
+				pc.recv = codec
+			}
+		}
+	}
+	if pc.send == nil || pc.recv == nil {
+		return fmt.Errorf("[%s] no codec in common with %s, which speaks %s", s.Transport.Addr(), p.RemoteAddr(), rpc.Payload) //nolint:err113
+	}
+
+	s.codecLock.Lock()
+	s.peerCodecs[p.RemoteAddr().String()] = pc
+	s.codecLock.Unlock()
+
+	log.Printf("[%s] sending %s to and receiving %s from %s\n", s.Transport.Addr(), pc.send.Name(), pc.recv.Name(), p.RemoteAddr())
+
+	return nil
+}
+
+// codecs returns the codecs that this node speaks, in order of preference.
+func (s *FileServer) codecs() []Codec {
+	codecs := []Codec{s.Codec}
+	for _, codec := range builtinCodecs {
+		if codec.Name() != s.Codec.Name() {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// codecsOf returns the codecs of the messages exchanged with the peer at addr, which
+// are the Codec of the options when the peer did not take part in the handshake.
+func (s *FileServer) codecsOf(addr string) peerCodecs {
+	s.codecLock.Lock()
+	defer s.codecLock.Unlock()
+
+	if pc, ok := s.peerCodecs[addr]; ok {
+		return pc
+	}
+	return peerCodecs{send: s.Codec, recv: s.Codec}
+}
+
+func codecNamed(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
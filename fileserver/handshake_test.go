@@ -0,0 +1,36 @@
+package fileserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+func TestHandshakeRejectsStream(t *testing.T) {
+	t.Parallel()
+
+	s := NewFileServer(ServerOpts{
+		Transport: p2p.NewMemTransport(p2p.NewMemNetwork(), p2p.WithListenAddr("node")),
+		Backend:   store.NewMemoryStore(),
+	})
+
+	local, remote := net.Pipe()
+	defer func() {
+		_ = local.Close()
+		_ = remote.Close()
+	}()
+
+	// The remote answers the codecs of the node with a stream, which is not a list of codecs.
+	go func() {
+		var rpc p2p.RPC
+		if err := (p2p.DefaultDecoder{}).Decode(remote, &rpc); err == nil {
+			_, _ = remote.Write([]byte{p2p.IncomingStream})
+		}
+	}()
+
+	err := s.Handshake(p2p.NewTCPPeer(p2p.WithTCPPeerConn(local)))
+	assert.ErrorContains(t, err, "sent a stream")
+}
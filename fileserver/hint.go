@@ -0,0 +1,141 @@
+package fileserver
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+)
+
+// Hint is a write that a node missed because it was not connected at the time. The
+// node that coordinated the write holds on to it, referring to its local copy of the
+// file, and delivers it once the node reconnects.
+type Hint struct {
+	Target  string
+	ID      string
+	Key     string
+	Size    int64
+	Created time.Time
+
+	// netKey is the key that the file is known by on the network, which it is placed by.
+	netKey string
+}
+
+// PendingHints returns the hints that are waiting for their target to reconnect.
+func (s *FileServer) PendingHints() []Hint {
+	s.hintLock.Lock()
+	defer s.hintLock.Unlock()
+
+	s.expireHints()
+
+	var hints []Hint
+	for _, byKey := range s.hints {
+		for _, h := range byKey {
+			hints = append(hints, h)
+		}
+	}
+	return hints
+}
+
+// addHints records a hint of a write for every known node that is not connected and
+// that the file is placed on, once it is connected again.
+func (s *FileServer) addHints(id, key, netKey string, size int64) {
+	if s.HintTTL == 0 {
+		return
+	}
+
+	s.peerLock.Lock()
+	reached := make(map[string]bool, len(s.peerNodes))
+	for _, nodeID := range s.peerNodes {
+		reached[nodeID] = true
+	}
+	var missing []string
+	for nodeID := range s.members {
+		if !reached[nodeID] && nodeID != s.NodeID {
+			missing = append(missing, nodeID)
+		}
+	}
+	s.peerLock.Unlock()
+
+	if s.ReplicationFactor > 0 && len(missing) > 0 {
+		owners := placement(id+"/"+netKey, append(s.liveNodes(), missing...), s.ReplicationFactor)
+		missing = slices.DeleteFunc(missing, func(nodeID string) bool {
+			return !slices.Contains(owners, nodeID)
+		})
+	}
+
+	s.hintLock.Lock()
+	defer s.hintLock.Unlock()
+
+	s.expireHints()
+
+	for _, target := range missing {
+		if _, ok := s.hints[target]; !ok {
+			s.hints[target] = make(map[string]Hint)
+		}
+
+		// A newer write of the same key replaces the older hint.
+		hintKey := id + "/" + key
+		if old, ok := s.hints[target][hintKey]; ok {
+			s.hintBytes -= old.Size
+		}
+
+		if s.HintBudget > 0 && s.hintBytes+size > s.HintBudget {
+			delete(s.hints[target], hintKey)
+			log.Printf("[%s] dropping hint of file (%s) for node (%s), hint budget of %d bytes exceeded\n", s.Transport.Addr(), key, target, s.HintBudget)
+			continue
+		}
+
+		s.hints[target][hintKey] = Hint{
+			Target:  target,
+			ID:      id,
+			Key:     key,
+			Size:    size,
+			Created: time.Now(),
+			netKey:  netKey,
+		}
+		s.hintBytes += size
+
+		log.Printf("[%s] holding hint of file (%s) for node (%s)\n", s.Transport.Addr(), key, target)
+	}
+}
+
+// deliverHints sends the files of the pending hints of a node that just connected,
+// except for the files that are not placed on it anymore.
+func (s *FileServer) deliverHints(nodeID string, peer p2p.Peer) {
+	s.hintLock.Lock()
+	s.expireHints()
+	byKey := s.hints[nodeID]
+	delete(s.hints, nodeID)
+	for _, h := range byKey {
+		s.hintBytes -= h.Size
+	}
+	s.hintLock.Unlock()
+
+	for _, h := range byKey {
+		if !s.placedOnPeer(h.ID+"/"+h.netKey, peer) {
+			continue
+		}
+		if err := s.sendFile(peer, h.ID, h.Key); err != nil {
+			log.Printf("[%s] delivering hint of file (%s) to node (%s) failed: %s\n", s.Transport.Addr(), h.Key, nodeID, err.Error())
+			continue
+		}
+		log.Printf("[%s] delivered hint of file (%s) to node (%s)\n", s.Transport.Addr(), h.Key, nodeID)
+	}
+}
+
+// expireHints drops the hints that are older than the hint TTL. The hint lock must be held.
+func (s *FileServer) expireHints() {
+	for target, byKey := range s.hints {
+		for hintKey, h := range byKey {
+			if time.Since(h.Created) > s.HintTTL {
+				delete(byKey, hintKey)
+				s.hintBytes -= h.Size
+			}
+		}
+		if len(byKey) == 0 {
+			delete(s.hints, target)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fileserver
+
+import (
+	"log"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/dht"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+)
+
+// dhtRepublishInterval is how often the file server records itself again as a provider
+// of its replicas, well within the ProviderTTL of the DHT.
+const dhtRepublishInterval = time.Hour
+
+// newDHT creates the DHT that the file server locates the replicas of files with.
+func (s *FileServer) newDHT() (*dht.DHT, error) {
+	return dht.New(dht.Config{
+		Self: dht.Contact{NodeID: s.NodeID, Addr: s.Transport.Addr()},
+		Send: s.sendDHT,
+	})
+}
+
+// sendDHT sends a message of the DHT protocol to the node listening on addr.
+func (s *FileServer) sendDHT(addr string, msg dht.Message) error {
+	peer, err := s.listenPeer(addr)
+	if err != nil {
+		return err
+	}
+
+	m := Message{
+		Payload: MessageDHT{
+			Message: msg,
+		},
+	}
+
+	return s.send(peer, &m)
+}
+
+// addContact adds a newly announced node to the DHT. The first node that is added
+// is bootstrapped from, which makes the nodes close to this one learn about it.
+func (s *FileServer) addContact(nodeID, listenAddr string) {
+	if s.dht == nil {
+		return
+	}
+
+	first := s.dht.Len() == 0
+	s.dht.AddContact(dht.Contact{NodeID: nodeID, Addr: listenAddr})
+	if !first {
+		return
+	}
+
+	// Lookups wait for replies that are read by the message loop, so they can not run on it.
+	go func() {
+		if err := s.dht.Bootstrap(); err != nil {
+			log.Printf("[%s] dht bootstrap failed: %s\n", s.Transport.Addr(), err.Error())
+		}
+	}()
+}
+
+// provide announces on the DHT that this node holds a replica of the file.
+func (s *FileServer) provide(id, netKey string) {
+	if s.dht == nil {
+		return
+	}
+
+	go func() {
+		if err := s.dht.Provide(dhtKey(id, netKey)); err != nil {
+			log.Printf("[%s] providing file (%s) on the dht failed: %s\n", s.Transport.Addr(), netKey, err.Error())
+		}
+	}()
+}
+
+// unprovide announces on the DHT that this node no longer holds a replica of the file.
+func (s *FileServer) unprovide(id, netKey string) {
+	if s.dht == nil {
+		return
+	}
+
+	go func() {
+		if err := s.dht.Unprovide(dhtKey(id, netKey)); err != nil {
+			log.Printf("[%s] unproviding file (%s) on the dht failed: %s\n", s.Transport.Addr(), netKey, err.Error())
+		}
+	}()
+}
+
+// republish records this node again as a provider of its replicas, before the records expire.
+func (s *FileServer) republish() {
+	go func() {
+		if err := s.dht.Republish(); err != nil {
+			log.Printf("[%s] republishing the provided files on the dht failed: %s\n", s.Transport.Addr(), err.Error())
+		}
+	}()
+}
+
+// providers returns the connected peers that the DHT knows to hold a replica of the
+// file, or nil when the DHT is disabled or knows none.
+func (s *FileServer) providers(id, netKey string) []p2p.Peer {
+	if s.dht == nil {
+		return nil
+	}
+
+	contacts, err := s.dht.FindProviders(dhtKey(id, netKey))
+	if err != nil {
+		log.Printf("[%s] locating file (%s) on the dht failed: %s\n", s.Transport.Addr(), netKey, err.Error())
+		return nil
+	}
+
+	var peers []p2p.Peer
+	for _, c := range contacts {
+		if c.NodeID == s.NodeID {
+			continue
+		}
+		if peer, err := s.listenPeer(c.Addr); err == nil {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (s *FileServer) handleMessageDHT(_ string, msg MessageDHT) error {
+	if s.dht != nil {
+		s.dht.Handle(msg.Message)
+	}
+	return nil
+}
+
+// dhtKey is the key that the replicas of a file are provided under. The DHT hashes
+// it into its ID space, so files with the same key under different IDs do not collide.
+func dhtKey(id, netKey string) string {
+	return id + "/" + netKey
+}
+
+// exclude returns the peers that are not in excluded.
+func exclude(peers, excluded []p2p.Peer) []p2p.Peer {
+	skip := make(map[string]bool, len(excluded))
+	for _, peer := range excluded {
+		skip[peer.RemoteAddr().String()] = true
+	}
+
+	var rest []p2p.Peer
+	for _, peer := range peers {
+		if !skip[peer.RemoteAddr().String()] {
+			rest = append(rest, peer)
+		}
+	}
+	return rest
+}
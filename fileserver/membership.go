@@ -0,0 +1,128 @@
+package fileserver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/swim"
+)
+
+// Members returns the members of the cluster as seen by the gossip membership,
+// or nil when gossip membership is disabled.
+func (s *FileServer) Members() []swim.Member {
+	if s.membership == nil {
+		return nil
+	}
+	return s.membership.Members()
+}
+
+// Peers returns the IDs of the nodes that this node is connected with, once they
+// have announced themselves.
+func (s *FileServer) Peers() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	nodeIDs := make([]string, 0, len(s.peerNodes))
+	for _, nodeID := range s.peerNodes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	return nodeIDs
+}
+
+// newMembership creates the gossip membership of the file server.
+func (s *FileServer) newMembership() (*swim.Memberlist, error) {
+	return swim.New(swim.Config{
+		ID:            s.NodeID,
+		Addr:          s.Transport.Addr(),
+		ProbeInterval: s.GossipInterval,
+		Send:          s.sendGossip,
+		OnChange:      s.onMemberChange,
+	})
+}
+
+// sendGossip sends a message of the membership protocol to the member listening on addr.
+func (s *FileServer) sendGossip(addr string, msg swim.Message) error {
+	peer, err := s.listenPeer(addr)
+	if err != nil {
+		return err
+	}
+
+	gossip := Message{
+		Payload: MessageGossip{
+			Message: msg,
+		},
+	}
+
+	return s.send(peer, &gossip)
+}
+
+// onMemberChange connects with the members that become alive, so nodes learn about
+// the peers that they did not dial themselves.
+func (s *FileServer) onMemberChange(m swim.Member) {
+	log.Printf("[%s] member (%s) at (%s) is %s\n", s.Transport.Addr(), m.ID, m.Addr, m.State)
+
+	if m.State != swim.Alive {
+		return
+	}
+
+	s.peerLock.Lock()
+	s.members[m.ID] = m.Addr
+	s.peerLock.Unlock()
+
+	s.dialMember(m.Addr)
+}
+
+// listenPeer returns the connected peer of the node that listens on addr.
+func (s *FileServer) listenPeer(addr string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for remote, nodeID := range s.peerNodes {
+		if s.members[nodeID] == addr {
+			return s.peers[remote], nil
+		}
+	}
+	return nil, fmt.Errorf("no peer listening on (%s) is connected", addr) //nolint:err113
+}
+
+func (s *FileServer) handleMessageAnnounce(from string, msg MessageAnnounce) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	s.peerLock.Lock()
+	s.peerNodes[from] = msg.NodeID
+	s.members[msg.NodeID] = msg.ListenAddr
+	if announced, ok := s.dialing[msg.ListenAddr]; ok {
+		close(announced)
+		delete(s.dialing, msg.ListenAddr)
+	}
+	s.peerLock.Unlock()
+
+	if s.membership != nil {
+		s.membership.Join(msg.NodeID, msg.ListenAddr)
+	}
+	s.addContact(msg.NodeID, msg.ListenAddr)
+	if s.PeerExchange {
+		go s.exchangePeers(from, msg.ListenAddr)
+	}
+
+	go s.deliverHints(msg.NodeID, peer)
+
+	if s.AutoRebalance {
+		s.Rebalance()
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageGossip(_ string, msg MessageGossip) error {
+	if s.membership != nil {
+		s.membership.Handle(msg.Message)
+	}
+	return nil
+}
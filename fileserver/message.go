@@ -1,15 +1,24 @@
 package fileserver
 
+import (
+	"github.com/yigithankarabulut/distributed-file-storage/dht"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/swim"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
 // Message is a struct that contains the payload of the message.
 type Message struct {
 	Payload any
 }
 
-// MessageStoreFile is a struct that contains the key and the size of the file.
+// MessageStoreFile is a struct that contains the key and the size of the file,
+// along with the metadata that the receiver records for it.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	ID       string
+	Key      string
+	Size     int64
+	Metadata store.Metadata
 }
 
 // MessageGetFile is a struct that contains the key of the file.
@@ -17,3 +26,90 @@ type MessageGetFile struct {
 	Key string
 	ID  string
 }
+
+// MessageGetShards is a struct that requests the erasure coded shards of a file.
+// The receiver answers with a single stream holding every shard that it has, and
+// a not found header for every shard that it does not have.
+type MessageGetShards struct {
+	ID   string
+	Keys []string
+}
+
+// MessageStoreFileAck is a struct that is sent back to the sender of a file, telling
+// how many bytes of it were received with which checksum. Error is empty when the
+// file was stored, and the reason it was not otherwise, e.g. because the node is
+// full or the quota of the ID is exceeded. Clock is the clock of the write, so the
+// answers to an earlier write of the key are not taken for answers to a later one.
+type MessageStoreFileAck struct {
+	ID       string
+	Key      string
+	Written  int64
+	Checksum string
+	Error    string
+	Clock    vclock.Clock
+}
+
+// MessageCapacity is a struct that contains the storage capacity of the node sending it.
+// A Free value below zero means that the node has no known limit.
+type MessageCapacity struct {
+	Total int64
+	Used  int64
+	Free  int64
+}
+
+// MessageDeleteFile is a struct that contains the key of a file that should be deleted.
+type MessageDeleteFile struct {
+	ID  string
+	Key string
+}
+
+// MessageSyncRoot is a struct that contains the root of the Merkle tree of the sender,
+// starting an anti-entropy round.
+type MessageSyncRoot struct {
+	Root []byte
+}
+
+// MessageSyncBuckets is a struct that contains the hashes of some nodes of a level of
+// the Merkle tree of the sender, sent when the roots or the nodes above them differ.
+// Level zero holds the buckets.
+type MessageSyncBuckets struct {
+	Level  int
+	Nodes  []int
+	Hashes [][]byte
+}
+
+// MessageSyncEntries is a struct that contains the files of the buckets whose hashes differ.
+type MessageSyncEntries struct {
+	Buckets []int
+	Entries []SyncEntry
+}
+
+// MessageSyncRequest is a struct that contains the files that the sender is missing
+// or has outdated, and wants the receiver to push.
+type MessageSyncRequest struct {
+	Entries []SyncEntry
+}
+
+// MessageAnnounce is a struct that is sent to every new peer, so it knows which
+// node it is connected with and where that node can be reached.
+type MessageAnnounce struct {
+	NodeID     string
+	ListenAddr string
+}
+
+// MessagePeerExchange is a struct that contains the listen addresses of nodes that the
+// sender knows about, so the receiver can connect with the ones it is not connected with.
+type MessagePeerExchange struct {
+	Addrs []string
+}
+
+// MessageGossip is a struct that carries a message of the gossip membership protocol.
+type MessageGossip struct {
+	Message swim.Message
+}
+
+// MessageDHT is a struct that carries a message of the DHT protocol, which locates
+// the nodes holding the replicas of a file.
+type MessageDHT struct {
+	Message dht.Message
+}
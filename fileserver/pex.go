@@ -0,0 +1,102 @@
+package fileserver
+
+import (
+	"log"
+	"time"
+)
+
+// exchangePeers tells a newly connected node about the listen addresses of the other
+// connected nodes, and tells those about the new node, so every node can dial the
+// nodes that it was not bootstrapped with.
+func (s *FileServer) exchangePeers(from, listenAddr string) {
+	s.peerLock.Lock()
+	newPeer := s.peers[from]
+	var known, others []string
+	for remote, nodeID := range s.peerNodes {
+		if remote == from {
+			continue
+		}
+		if addr, ok := s.members[nodeID]; ok && addr != listenAddr {
+			known = append(known, addr)
+			others = append(others, remote)
+		}
+	}
+	s.peerLock.Unlock()
+
+	if newPeer != nil && len(known) > 0 {
+		msg := Message{Payload: MessagePeerExchange{Addrs: known}}
+		if err := s.send(newPeer, &msg); err != nil {
+			log.Printf("[%s] peer exchange with (%s) failed: %s\n", s.Transport.Addr(), from, err.Error())
+		}
+	}
+
+	for _, remote := range others {
+		peer, err := s.peer(remote)
+		if err != nil {
+			continue
+		}
+		msg := Message{Payload: MessagePeerExchange{Addrs: []string{listenAddr}}}
+		if err = s.send(peer, &msg); err != nil {
+			log.Printf("[%s] peer exchange with (%s) failed: %s\n", s.Transport.Addr(), remote, err.Error())
+		}
+	}
+}
+
+// handleMessagePeerExchange dials the nodes that this node is not connected with yet.
+func (s *FileServer) handleMessagePeerExchange(_ string, msg MessagePeerExchange) error {
+	for _, addr := range msg.Addrs {
+		s.dialMember(addr)
+	}
+
+	return nil
+}
+
+// dialMember connects with the node listening on addr in the background, unless it is
+// already connected or being dialed, or this node already has MaxPeers peers. Of two
+// nodes that learn about each other, only the one with the lower listen address dials,
+// so they do not end up with two connections.
+func (s *FileServer) dialMember(addr string) {
+	if addr <= s.Transport.Addr() {
+		return
+	}
+
+	s.peerLock.Lock()
+	for _, nodeID := range s.peerNodes {
+		if s.members[nodeID] == addr {
+			s.peerLock.Unlock()
+			return
+		}
+	}
+	if _, ok := s.dialing[addr]; ok {
+		s.peerLock.Unlock()
+		return
+	}
+	if s.MaxPeers > 0 && len(s.peers)+len(s.dialing) >= s.MaxPeers {
+		s.peerLock.Unlock()
+		log.Printf("[%s] not dialing (%s), reached the maximum of %d peers\n", s.Transport.Addr(), addr, s.MaxPeers)
+		return
+	}
+	announced := make(chan struct{})
+	s.dialing[addr] = announced
+	s.peerLock.Unlock()
+
+	go func() {
+		log.Printf("[%s] attempting to connect with member: %s\n", s.Transport.Addr(), addr)
+		if err := s.Transport.Dial(addr); err != nil {
+			log.Printf("dial error: %s\n", err.Error())
+		} else {
+			// The node only counts as connected once it announced itself, so it is not
+			// dialed again in the meantime.
+			select {
+			case <-announced:
+			case <-time.After(handshakeTimeout):
+			}
+		}
+
+		s.peerLock.Lock()
+		if s.dialing[addr] == announced {
+			delete(s.dialing, addr)
+		}
+		s.peerLock.Unlock()
+	}()
+}
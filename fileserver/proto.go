@@ -0,0 +1,637 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/dht"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/swim"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+// protoVersion is the version of the schema of the messages that ProtoCodec encodes.
+// Fields and messages can be added to the schema without changing it, as they are
+// ignored by the nodes that do not know them; it changes when the schema changes
+// in a way that older nodes can not read.
+const protoVersion = 1
+
+// ErrUnsupportedVersion is returned when a message is encoded with a version of the
+// schema that this node does not support.
+var ErrUnsupportedVersion = errors.New("unsupported message version")
+
+// The numbers of the fields of the envelope that each message is sent in, which hold
+// the version of the schema and the payload of the message.
+const (
+	fieldVersion = iota + 1
+	fieldStoreFile
+	fieldGetFile
+	fieldGetShards
+	fieldStoreFileAck
+	fieldCapacity
+	fieldAnnounce
+	fieldPeerExchange
+	fieldGossip
+	fieldDHT
+	fieldDeleteFile
+	fieldSyncRoot
+	fieldSyncBuckets
+	fieldSyncEntries
+	fieldSyncRequest
+)
+
+// ProtoCodec is a codec that uses the protobuf wire format, so nodes and clients
+// written in other languages can speak the protocol. The schema of the messages is
+// described in message.proto, from which they can generate their code.
+type ProtoCodec struct{}
+
+// Name implements the Codec interface.
+func (c ProtoCodec) Name() string { return "proto" }
+
+// Encode implements the Codec interface.
+func (c ProtoCodec) Encode(msg *Message) ([]byte, error) {
+	var w protoWriter
+	w.uint(fieldVersion, protoVersion)
+
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		w.message(fieldStoreFile, func(w *protoWriter) {
+			w.string(1, v.ID)
+			w.string(2, v.Key)
+			w.int(3, v.Size)
+			w.message(4, func(w *protoWriter) { encodeMetadata(w, v.Metadata) })
+		})
+	case MessageGetFile:
+		w.message(fieldGetFile, func(w *protoWriter) {
+			w.string(1, v.Key)
+			w.string(2, v.ID)
+		})
+	case MessageGetShards:
+		w.message(fieldGetShards, func(w *protoWriter) {
+			w.string(1, v.ID)
+			w.strings(2, v.Keys)
+		})
+	case MessageStoreFileAck:
+		w.message(fieldStoreFileAck, func(w *protoWriter) {
+			w.string(1, v.ID)
+			w.string(2, v.Key)
+			w.int(3, v.Written)
+			w.string(4, v.Checksum)
+			w.string(5, v.Error)
+			encodeClock(w, 6, v.Clock)
+		})
+	case MessageCapacity:
+		w.message(fieldCapacity, func(w *protoWriter) {
+			w.int(1, v.Total)
+			w.int(2, v.Used)
+			w.int(3, v.Free)
+		})
+	case MessageAnnounce:
+		w.message(fieldAnnounce, func(w *protoWriter) {
+			w.string(1, v.NodeID)
+			w.string(2, v.ListenAddr)
+		})
+	case MessagePeerExchange:
+		w.message(fieldPeerExchange, func(w *protoWriter) {
+			w.strings(1, v.Addrs)
+		})
+	case MessageGossip:
+		w.message(fieldGossip, func(w *protoWriter) {
+			w.message(1, func(w *protoWriter) { encodeGossip(w, v.Message) })
+		})
+	case MessageDHT:
+		w.message(fieldDHT, func(w *protoWriter) {
+			w.message(1, func(w *protoWriter) { encodeDHT(w, v.Message) })
+		})
+	case MessageDeleteFile:
+		w.message(fieldDeleteFile, func(w *protoWriter) {
+			w.string(1, v.ID)
+			w.string(2, v.Key)
+		})
+	case MessageSyncRoot:
+		w.message(fieldSyncRoot, func(w *protoWriter) {
+			w.bytes(1, v.Root)
+		})
+	case MessageSyncBuckets:
+		w.message(fieldSyncBuckets, func(w *protoWriter) {
+			for _, hash := range v.Hashes {
+				w.bytes(1, hash)
+			}
+			w.int(2, int64(v.Level))
+			w.ints(3, v.Nodes)
+		})
+	case MessageSyncEntries:
+		w.message(fieldSyncEntries, func(w *protoWriter) {
+			w.ints(1, v.Buckets)
+			encodeSyncEntries(w, 2, v.Entries)
+		})
+	case MessageSyncRequest:
+		w.message(fieldSyncRequest, func(w *protoWriter) {
+			encodeSyncEntries(w, 1, v.Entries)
+		})
+	default:
+		return nil, fmt.Errorf("can not encode message payload of type %T", msg.Payload) //nolint:err113
+	}
+
+	return w.buf, nil
+}
+
+// Decode implements the Codec interface. Messages whose payload is of a type that this
+// node does not know are rejected.
+func (c ProtoCodec) Decode(b []byte, msg *Message) error {
+	var (
+		version uint64
+		payload *protoField
+	)
+	err := readFields(b, func(f protoField) (err error) {
+		switch f.num {
+		case fieldVersion:
+			version, err = f.uint()
+		case fieldStoreFile, fieldGetFile, fieldGetShards, fieldStoreFileAck, fieldCapacity,
+			fieldAnnounce, fieldPeerExchange, fieldGossip, fieldDHT, fieldDeleteFile,
+			fieldSyncRoot, fieldSyncBuckets, fieldSyncEntries, fieldSyncRequest:
+			payload = &f
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if version != protoVersion {
+		return fmt.Errorf("message of version %d, expected %d: %w", version, protoVersion, ErrUnsupportedVersion)
+	}
+	if payload == nil {
+		return errors.New("message has no payload of a known type") //nolint:err113
+	}
+
+	msg.Payload, err = decodePayload(*payload)
+	return err
+}
+
+func decodePayload(f protoField) (any, error) {
+	switch f.num {
+	case fieldStoreFile:
+		var v MessageStoreFile
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.ID, err = f.string()
+			case 2:
+				v.Key, err = f.string()
+			case 3:
+				v.Size, err = f.int()
+			case 4:
+				v.Metadata, err = decodeMetadata(f)
+			}
+			return err
+		})
+		return v, err
+	case fieldGetFile:
+		var v MessageGetFile
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.Key, err = f.string()
+			case 2:
+				v.ID, err = f.string()
+			}
+			return err
+		})
+		return v, err
+	case fieldGetShards:
+		var v MessageGetShards
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.ID, err = f.string()
+			case 2:
+				var key string
+				key, err = f.string()
+				v.Keys = append(v.Keys, key)
+			}
+			return err
+		})
+		return v, err
+	case fieldStoreFileAck:
+		var v MessageStoreFileAck
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.ID, err = f.string()
+			case 2:
+				v.Key, err = f.string()
+			case 3:
+				v.Written, err = f.int()
+			case 4:
+				v.Checksum, err = f.string()
+			case 5:
+				v.Error, err = f.string()
+			case 6:
+				v.Clock, err = decodeClockEntry(f, v.Clock)
+			}
+			return err
+		})
+		return v, err
+	case fieldCapacity:
+		var v MessageCapacity
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.Total, err = f.int()
+			case 2:
+				v.Used, err = f.int()
+			case 3:
+				v.Free, err = f.int()
+			}
+			return err
+		})
+		return v, err
+	case fieldAnnounce:
+		var v MessageAnnounce
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.NodeID, err = f.string()
+			case 2:
+				v.ListenAddr, err = f.string()
+			}
+			return err
+		})
+		return v, err
+	case fieldPeerExchange:
+		var v MessagePeerExchange
+		err := f.message(func(f protoField) (err error) {
+			if f.num == 1 {
+				var addr string
+				addr, err = f.string()
+				v.Addrs = append(v.Addrs, addr)
+			}
+			return err
+		})
+		return v, err
+	case fieldGossip:
+		var v MessageGossip
+		err := f.message(func(f protoField) (err error) {
+			if f.num == 1 {
+				v.Message, err = decodeGossip(f)
+			}
+			return err
+		})
+		return v, err
+	case fieldDHT:
+		var v MessageDHT
+		err := f.message(func(f protoField) (err error) {
+			if f.num == 1 {
+				v.Message, err = decodeDHT(f)
+			}
+			return err
+		})
+		return v, err
+	case fieldDeleteFile:
+		var v MessageDeleteFile
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				v.ID, err = f.string()
+			case 2:
+				v.Key, err = f.string()
+			}
+			return err
+		})
+		return v, err
+	case fieldSyncRoot:
+		var v MessageSyncRoot
+		err := f.message(func(f protoField) (err error) {
+			if f.num == 1 {
+				v.Root, err = f.bytes()
+			}
+			return err
+		})
+		return v, err
+	case fieldSyncBuckets:
+		var v MessageSyncBuckets
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				var hash []byte
+				hash, err = f.bytes()
+				v.Hashes = append(v.Hashes, hash)
+			case 2:
+				var level int64
+				level, err = f.int()
+				v.Level = int(level)
+			case 3:
+				var nodes []int
+				nodes, err = f.ints()
+				v.Nodes = append(v.Nodes, nodes...)
+			}
+			return err
+		})
+		return v, err
+	case fieldSyncEntries:
+		var v MessageSyncEntries
+		err := f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				var buckets []int
+				buckets, err = f.ints()
+				v.Buckets = append(v.Buckets, buckets...)
+			case 2:
+				var entry SyncEntry
+				entry, err = decodeSyncEntry(f)
+				v.Entries = append(v.Entries, entry)
+			}
+			return err
+		})
+		return v, err
+	case fieldSyncRequest:
+		var v MessageSyncRequest
+		err := f.message(func(f protoField) (err error) {
+			if f.num == 1 {
+				var entry SyncEntry
+				entry, err = decodeSyncEntry(f)
+				v.Entries = append(v.Entries, entry)
+			}
+			return err
+		})
+		return v, err
+	}
+	return nil, fmt.Errorf("field %d is not a message payload", f.num) //nolint:err113
+}
+
+func encodeMetadata(w *protoWriter, md store.Metadata) {
+	w.string(1, md.Key)
+	w.string(2, md.NetKey)
+	w.string(3, md.Checksum)
+	w.string(4, md.Compression)
+	w.string(5, md.Version)
+	if !md.Timestamp.IsZero() {
+		w.message(6, func(w *protoWriter) {
+			w.int(1, md.Timestamp.Unix())
+			w.int(2, int64(md.Timestamp.Nanosecond()))
+		})
+	}
+	w.string(7, md.Origin)
+	encodeClock(w, 8, md.Clock)
+	if md.Shard != nil {
+		w.message(9, func(w *protoWriter) {
+			w.int(1, int64(md.Shard.Index))
+			w.int(2, int64(md.Shard.DataShards))
+			w.int(3, int64(md.Shard.ParityShards))
+			w.int(4, md.Shard.Size)
+			w.string(5, md.Shard.Checksum)
+		})
+	}
+}
+
+func decodeMetadata(f protoField) (md store.Metadata, err error) {
+	err = f.message(func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			md.Key, err = f.string()
+		case 2:
+			md.NetKey, err = f.string()
+		case 3:
+			md.Checksum, err = f.string()
+		case 4:
+			md.Compression, err = f.string()
+		case 5:
+			md.Version, err = f.string()
+		case 6:
+			var sec, nsec int64
+			err = f.message(func(f protoField) (err error) {
+				switch f.num {
+				case 1:
+					sec, err = f.int()
+				case 2:
+					nsec, err = f.int()
+				}
+				return err
+			})
+			md.Timestamp = time.Unix(sec, nsec).UTC()
+		case 7:
+			md.Origin, err = f.string()
+		case 8:
+			md.Clock, err = decodeClockEntry(f, md.Clock)
+		case 9:
+			md.Shard = &store.Shard{}
+			err = f.message(func(f protoField) (err error) {
+				var v int64
+				switch f.num {
+				case 1:
+					v, err = f.int()
+					md.Shard.Index = int(v)
+				case 2:
+					v, err = f.int()
+					md.Shard.DataShards = int(v)
+				case 3:
+					v, err = f.int()
+					md.Shard.ParityShards = int(v)
+				case 4:
+					md.Shard.Size, err = f.int()
+				case 5:
+					md.Shard.Checksum, err = f.string()
+				}
+				return err
+			})
+		}
+		return err
+	})
+	return md, err
+}
+
+// encodeClock writes a version vector as a map of node IDs to counters, which
+// protobuf writes as repeated entries of a key and a value, sorted for stable output.
+func encodeClock(w *protoWriter, field int, c vclock.Clock) {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		w.message(field, func(w *protoWriter) {
+			w.string(1, node)
+			w.uint(2, c[node])
+		})
+	}
+}
+
+// decodeClockEntry reads an entry of a version vector into c, which is created when it is nil.
+func decodeClockEntry(f protoField, c vclock.Clock) (vclock.Clock, error) {
+	var (
+		node string
+		n    uint64
+	)
+	err := f.message(func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			node, err = f.string()
+		case 2:
+			n, err = f.uint()
+		}
+		return err
+	})
+
+	if c == nil {
+		c = make(vclock.Clock)
+	}
+	c[node] = n
+	return c, err
+}
+
+func encodeSyncEntries(w *protoWriter, field int, entries []SyncEntry) {
+	for _, e := range entries {
+		w.message(field, func(w *protoWriter) {
+			w.string(1, e.ID)
+			w.string(2, e.Key)
+			w.string(3, e.Checksum)
+			encodeClock(w, 4, e.Clock)
+		})
+	}
+}
+
+func decodeSyncEntry(f protoField) (e SyncEntry, err error) {
+	err = f.message(func(f protoField) (err error) {
+		switch f.num {
+		case 1:
+			e.ID, err = f.string()
+		case 2:
+			e.Key, err = f.string()
+		case 3:
+			e.Checksum, err = f.string()
+		case 4:
+			e.Clock, err = decodeClockEntry(f, e.Clock)
+		}
+		return err
+	})
+	return e, err
+}
+
+func encodeGossip(w *protoWriter, m swim.Message) {
+	w.uint(1, uint64(m.Kind)) //nolint:gosec
+	w.uint(2, m.Seq)
+	w.string(3, m.From)
+	w.string(4, m.FromAddr)
+	w.string(5, m.Target)
+	w.string(6, m.TargetAddr)
+	for _, u := range m.Updates {
+		w.message(7, func(w *protoWriter) {
+			w.string(1, u.ID)
+			w.string(2, u.Addr)
+			w.uint(3, uint64(u.State)) //nolint:gosec
+			w.uint(4, u.Incarnation)
+		})
+	}
+}
+
+func decodeGossip(f protoField) (m swim.Message, err error) {
+	err = f.message(func(f protoField) (err error) {
+		var v uint64
+		switch f.num {
+		case 1:
+			v, err = f.uint()
+			m.Kind = swim.Kind(v) //nolint:gosec
+		case 2:
+			m.Seq, err = f.uint()
+		case 3:
+			m.From, err = f.string()
+		case 4:
+			m.FromAddr, err = f.string()
+		case 5:
+			m.Target, err = f.string()
+		case 6:
+			m.TargetAddr, err = f.string()
+		case 7:
+			var u swim.Update
+			err = f.message(func(f protoField) (err error) {
+				switch f.num {
+				case 1:
+					u.ID, err = f.string()
+				case 2:
+					u.Addr, err = f.string()
+				case 3:
+					v, err = f.uint()
+					u.State = swim.State(v) //nolint:gosec
+				case 4:
+					u.Incarnation, err = f.uint()
+				}
+				return err
+			})
+			m.Updates = append(m.Updates, u)
+		}
+		return err
+	})
+	return m, err
+}
+
+func encodeDHT(w *protoWriter, m dht.Message) {
+	contact := func(field int, c dht.Contact) {
+		w.message(field, func(w *protoWriter) {
+			w.string(1, c.NodeID)
+			w.string(2, c.Addr)
+		})
+	}
+
+	w.uint(1, uint64(m.Kind)) //nolint:gosec
+	w.uint(2, m.Seq)
+	contact(3, m.From)
+	if m.Target != (dht.ID{}) {
+		w.bytes(4, m.Target[:])
+	}
+	w.string(5, m.Key)
+	for _, c := range m.Contacts {
+		contact(6, c)
+	}
+	for _, c := range m.Providers {
+		contact(7, c)
+	}
+}
+
+func decodeDHT(f protoField) (m dht.Message, err error) {
+	contact := func(f protoField) (c dht.Contact, err error) {
+		err = f.message(func(f protoField) (err error) {
+			switch f.num {
+			case 1:
+				c.NodeID, err = f.string()
+			case 2:
+				c.Addr, err = f.string()
+			}
+			return err
+		})
+		return c, err
+	}
+
+	err = f.message(func(f protoField) (err error) {
+		var c dht.Contact
+		switch f.num {
+		case 1:
+			var v uint64
+			v, err = f.uint()
+			m.Kind = dht.Kind(v) //nolint:gosec
+		case 2:
+			m.Seq, err = f.uint()
+		case 3:
+			m.From, err = contact(f)
+		case 4:
+			var b []byte
+			if b, err = f.bytes(); err == nil && len(b) != len(m.Target) {
+				err = fmt.Errorf("DHT target of %d bytes, expected %d", len(b), len(m.Target)) //nolint:err113
+			}
+			copy(m.Target[:], b)
+		case 5:
+			m.Key, err = f.string()
+		case 6:
+			c, err = contact(f)
+			m.Contacts = append(m.Contacts, c)
+		case 7:
+			c, err = contact(f)
+			m.Providers = append(m.Providers, c)
+		}
+		return err
+	})
+	return m, err
+}
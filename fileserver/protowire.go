@@ -0,0 +1,193 @@
+package fileserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The wire types of the protobuf wire format that the messages are encoded with.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoWriter appends fields in the protobuf wire format. Scalar fields are left out
+// when they hold their zero value, like proto3 does.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType)) //nolint:gosec
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+// int writes a signed integer the way protobuf writes an int64, as its two's complement.
+func (w *protoWriter) int(field int, v int64) {
+	w.uint(field, uint64(v)) //nolint:gosec
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if len(s) > 0 {
+		w.bytes(field, []byte(s))
+	}
+}
+
+// bytes writes a length-delimited field, even when it is empty, so the elements of
+// repeated fields keep their positions.
+func (w *protoWriter) bytes(field int, b []byte) {
+	w.tag(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *protoWriter) strings(field int, ss []string) {
+	for _, s := range ss {
+		w.bytes(field, []byte(s))
+	}
+}
+
+// ints writes a repeated integer field in the packed encoding.
+func (w *protoWriter) ints(field int, vs []int) {
+	if len(vs) == 0 {
+		return
+	}
+	var packed []byte
+	for _, v := range vs {
+		packed = binary.AppendUvarint(packed, uint64(v)) //nolint:gosec
+	}
+	w.bytes(field, packed)
+}
+
+// message writes a nested message, which is written by f.
+func (w *protoWriter) message(field int, f func(*protoWriter)) {
+	var nested protoWriter
+	f(&nested)
+	w.bytes(field, nested.buf)
+}
+
+// protoField is a field that is read from a message in the protobuf wire format.
+type protoField struct {
+	num      int
+	wireType int
+	// value is the varint or fixed value of the field, or its content when it is
+	// length-delimited.
+	value   uint64
+	content []byte
+}
+
+// readFields reads the fields of a message in the protobuf wire format, handing each
+// of them to f. Fields of unknown numbers should be ignored by f, so messages of newer
+// nodes with fields that were added since can still be read.
+func readFields(b []byte, f func(protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("reading field key: %w", io.ErrUnexpectedEOF)
+		}
+		b = b[n:]
+
+		field := protoField{num: int(key >> 3), wireType: int(key & 7)} //nolint:gosec
+		switch field.wireType {
+		case wireVarint:
+			field.value, n = binary.Uvarint(b)
+		case wireFixed64:
+			if n = 8; len(b) >= n {
+				field.value = binary.LittleEndian.Uint64(b)
+			} else {
+				n = 0
+			}
+		case wireFixed32:
+			if n = 4; len(b) >= n {
+				field.value = uint64(binary.LittleEndian.Uint32(b))
+			} else {
+				n = 0
+			}
+		case wireBytes:
+			var size uint64
+			size, n = binary.Uvarint(b)
+			if n > 0 && size <= uint64(len(b)-n) {
+				field.content = b[n : n+int(size)] //nolint:gosec
+				n += int(size)                     //nolint:gosec
+			} else {
+				n = 0
+			}
+		default:
+			return fmt.Errorf("field %d has unsupported wire type %d", field.num, field.wireType) //nolint:err113
+		}
+		if n <= 0 {
+			return fmt.Errorf("reading field %d: %w", field.num, io.ErrUnexpectedEOF)
+		}
+		b = b[n:]
+
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f protoField) check(wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("field %d has wire type %d, expected %d", f.num, f.wireType, wireType) //nolint:err113
+	}
+	return nil
+}
+
+func (f protoField) uint() (uint64, error) {
+	return f.value, f.check(wireVarint)
+}
+
+func (f protoField) int() (int64, error) {
+	return int64(f.value), f.check(wireVarint) //nolint:gosec
+}
+
+func (f protoField) string() (string, error) {
+	return string(f.content), f.check(wireBytes)
+}
+
+func (f protoField) bytes() ([]byte, error) {
+	if err := f.check(wireBytes); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, f.content...), nil
+}
+
+// ints reads a repeated integer field, which may be packed or not.
+func (f protoField) ints() ([]int, error) {
+	if f.wireType == wireVarint {
+		return []int{int(f.value)}, nil //nolint:gosec
+	}
+	if err := f.check(wireBytes); err != nil {
+		return nil, err
+	}
+
+	var vs []int
+	for b := f.content; len(b) > 0; {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("reading field %d: %w", f.num, io.ErrUnexpectedEOF)
+		}
+		vs = append(vs, int(v)) //nolint:gosec
+		b = b[n:]
+	}
+	return vs, nil
+}
+
+// message reads a nested message, handing each of its fields to fn.
+func (f protoField) message(fn func(protoField) error) error {
+	if err := f.check(wireBytes); err != nil {
+		return err
+	}
+	return readFields(f.content, fn)
+}
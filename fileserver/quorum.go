@@ -0,0 +1,45 @@
+package fileserver
+
+import "errors"
+
+var (
+	// ErrWriteQuorum is returned by Store when fewer replicas than the write quorum acknowledged the write.
+	ErrWriteQuorum = errors.New("write quorum not reached")
+	// ErrReadQuorum is returned by Get when fewer replicas than the read quorum could be consulted.
+	ErrReadQuorum = errors.New("read quorum not reached")
+)
+
+// CallOption is a function that configures the consistency of a single Store or Get call.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	writeQuorum int
+	readQuorum  int
+}
+
+// WithWriteQuorum sets the number of replicas that have to acknowledge a write
+// before Store succeeds, overriding ServerOpts.WriteQuorum.
+func WithWriteQuorum(w int) CallOption {
+	return func(o *callOptions) {
+		o.writeQuorum = w
+	}
+}
+
+// WithReadQuorum sets the number of replicas, including the local copy, that Get
+// consults before it succeeds, overriding ServerOpts.ReadQuorum.
+func WithReadQuorum(r int) CallOption {
+	return func(o *callOptions) {
+		o.readQuorum = r
+	}
+}
+
+func (s *FileServer) callOptions(opts []CallOption) callOptions {
+	o := callOptions{
+		writeQuorum: s.WriteQuorum,
+		readQuorum:  s.ReadQuorum,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,353 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+)
+
+// RebalanceProgress reports the progress of the rebalancing of files across the nodes.
+// Files and Bytes are the amount of files and bytes that the current or last round has
+// to send, of which Done files and Sent bytes are sent and Failed files could not be sent.
+type RebalanceProgress struct {
+	Running  bool
+	Files    int
+	Done     int
+	Failed   int
+	Bytes    int64
+	Sent     int64
+	Started  time.Time
+	Finished time.Time
+}
+
+// rebalancer keeps the state of the rebalancing of this node.
+type rebalancer struct {
+	mu       sync.Mutex
+	progress RebalanceProgress
+	// pending is set when the membership changed while a round was running.
+	pending bool
+	// nodes are the nodes that the files were placed on in the last round.
+	nodes []string
+}
+
+// rebalanceTransfer is a file that is sent to a node that should own it.
+type rebalanceTransfer struct {
+	entry  SyncEntry
+	target string
+	size   int64
+}
+
+// RebalanceProgress returns the progress of the current or last rebalancing round.
+func (s *FileServer) RebalanceProgress() RebalanceProgress {
+	s.rebalance.mu.Lock()
+	defer s.rebalance.mu.Unlock()
+
+	return s.rebalance.progress
+}
+
+// Rebalance starts a rebalancing round in the background, unless one is already
+// running, in which case another round follows it. A round computes which nodes
+// should own each file that is stored here, and sends the files to the nodes that
+// did not own them before the membership changed.
+func (s *FileServer) Rebalance() {
+	s.rebalance.mu.Lock()
+	defer s.rebalance.mu.Unlock()
+
+	if s.rebalance.progress.Running {
+		s.rebalance.pending = true
+		return
+	}
+
+	s.rebalance.progress = RebalanceProgress{Running: true, Started: time.Now()}
+	go s.rebalanceLoop()
+}
+
+func (s *FileServer) rebalanceLoop() {
+	for {
+		if err := s.rebalanceRound(); err != nil {
+			log.Printf("[%s] rebalance error: %s\n", s.Transport.Addr(), err.Error())
+		}
+
+		s.rebalance.mu.Lock()
+		if !s.rebalance.pending {
+			s.rebalance.progress.Running = false
+			s.rebalance.progress.Finished = time.Now()
+			s.rebalance.mu.Unlock()
+			return
+		}
+		s.rebalance.pending = false
+		s.rebalance.progress = RebalanceProgress{Running: true, Started: time.Now()}
+		s.rebalance.mu.Unlock()
+	}
+}
+
+func (s *FileServer) rebalanceRound() error {
+	nodes := s.liveNodes()
+
+	s.rebalance.mu.Lock()
+	prev := s.rebalance.nodes
+	if prev == nil {
+		prev = []string{s.NodeID}
+	}
+	s.rebalance.nodes = nodes
+	s.rebalance.mu.Unlock()
+
+	entries, err := s.syncEntries()
+	if err != nil {
+		return err
+	}
+
+	alive := make(map[string]bool, len(nodes))
+	for _, nodeID := range nodes {
+		alive[nodeID] = true
+	}
+
+	var transfers []rebalanceTransfer
+	for _, e := range entries {
+		owners := placement(e.treeKey(), nodes, s.ReplicationFactor)
+		prevOwners := placement(e.treeKey(), prev, s.ReplicationFactor)
+
+		had := make(map[string]bool, len(prevOwners))
+		for _, nodeID := range prevOwners {
+			had[nodeID] = true
+		}
+
+		var added []string
+		for _, nodeID := range owners {
+			if !had[nodeID] && nodeID != s.NodeID {
+				added = append(added, nodeID)
+			}
+		}
+		if len(added) == 0 || !s.rebalancesEntry(e, prevOwners, alive) {
+			continue
+		}
+
+		fi, err := s.Storage.Stat(e.ID, e.storedKey)
+		if err != nil {
+			continue
+		}
+		for _, nodeID := range added {
+			transfers = append(transfers, rebalanceTransfer{entry: e, target: nodeID, size: fi.Size})
+		}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].target != transfers[j].target {
+			return transfers[i].target < transfers[j].target
+		}
+		return transfers[i].entry.treeKey() < transfers[j].entry.treeKey()
+	})
+
+	s.rebalance.mu.Lock()
+	s.rebalance.progress.Files = len(transfers)
+	for _, t := range transfers {
+		s.rebalance.progress.Bytes += t.size
+	}
+	s.rebalance.mu.Unlock()
+
+	if len(transfers) == 0 {
+		return nil
+	}
+
+	log.Printf("[%s] rebalancing %d files over %d nodes\n", s.Transport.Addr(), len(transfers), len(nodes))
+
+	var limiter *rateLimiter
+	if s.RebalanceBandwidth > 0 {
+		limiter = newRateLimiter(s.RebalanceBandwidth)
+	}
+
+	for _, t := range transfers {
+		n, err := s.rebalanceTransfer(t, limiter)
+
+		s.rebalance.mu.Lock()
+		s.rebalance.progress.Sent += n
+		if err != nil {
+			s.rebalance.progress.Failed++
+		} else {
+			s.rebalance.progress.Done++
+		}
+		p := s.rebalance.progress
+		s.rebalance.mu.Unlock()
+
+		if err != nil {
+			log.Printf("[%s] rebalance of file (%s) to node (%s) failed: %s\n", s.Transport.Addr(), t.entry.Key, t.target, err.Error())
+			continue
+		}
+		log.Printf("[%s] rebalanced file (%s) to node (%s), %d/%d files, %d/%d bytes\n", s.Transport.Addr(), t.entry.Key, t.target, p.Done+p.Failed, p.Files, p.Sent, p.Bytes)
+	}
+
+	return nil
+}
+
+func (s *FileServer) rebalanceTransfer(t rebalanceTransfer, limiter *rateLimiter) (int64, error) {
+	peer, err := s.nodePeer(t.target)
+	if err != nil {
+		return 0, err
+	}
+	return s.sendFileLimited(peer, t.entry.ID, t.entry.storedKey, limiter)
+}
+
+// rebalancesEntry reports whether this node is the one that sends the file of an entry
+// to its new owners. Of the previous owners that are still alive and the node that wrote
+// the file, it is the one that ranks highest for the file. When none of them is alive,
+// every node that has the file sends it.
+func (s *FileServer) rebalancesEntry(e SyncEntry, prevOwners []string, alive map[string]bool) bool {
+	var candidates []string
+	for _, nodeID := range prevOwners {
+		if alive[nodeID] {
+			candidates = append(candidates, nodeID)
+		}
+	}
+	if md, err := s.Storage.ReadMetadata(e.ID, e.storedKey); err == nil && alive[md.Origin] {
+		candidates = append(candidates, md.Origin)
+	}
+
+	if len(candidates) == 0 {
+		return true
+	}
+	return placement(e.treeKey(), candidates, 1)[0] == s.NodeID
+}
+
+// Placement returns the IDs of the nodes that the replicas of key, as stored by this node,
+// are placed on among this node and the nodes it is connected with. This node keeps its
+// own copy of the key whether it is one of them or not.
+func (s *FileServer) Placement(key string) []string {
+	return placement(s.ID+"/"+crypto.HashKey(key), s.liveNodes(), s.ReplicationFactor)
+}
+
+// owners returns the nodes that a file is placed on.
+func (s *FileServer) owners(key string) map[string]bool {
+	nodes := placement(key, s.liveNodes(), s.ReplicationFactor)
+
+	owners := make(map[string]bool, len(nodes))
+	for _, nodeID := range nodes {
+		owners[nodeID] = true
+	}
+	return owners
+}
+
+// placedOn reports whether a file that is placed on the given owners is placed on the
+// peer at addr. Without a replication factor every file is placed on every peer, and
+// peers that did not announce their node yet are taken for owners until they do. The
+// peer lock must be held.
+func (s *FileServer) placedOn(owners map[string]bool, addr string) bool {
+	if s.ReplicationFactor == 0 {
+		return true
+	}
+	nodeID, ok := s.peerNodes[addr]
+	return !ok || owners[nodeID]
+}
+
+// placedOnPeer reports whether the file with the given placement key is placed on peer.
+func (s *FileServer) placedOnPeer(key string, peer p2p.Peer) bool {
+	owners := s.owners(key)
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return s.placedOn(owners, peer.RemoteAddr().String())
+}
+
+// liveNodes returns this node and the nodes of the connected peers, sorted by ID.
+func (s *FileServer) liveNodes() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	seen := map[string]bool{s.NodeID: true}
+	nodes := []string{s.NodeID}
+	for _, nodeID := range s.peerNodes {
+		if !seen[nodeID] {
+			seen[nodeID] = true
+			nodes = append(nodes, nodeID)
+		}
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// nodePeer returns the connected peer of the node with the given ID.
+func (s *FileServer) nodePeer(nodeID string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	var addr string
+	for a, id := range s.peerNodes {
+		if id == nodeID {
+			addr = a
+			break
+		}
+	}
+	s.peerLock.Unlock()
+
+	return s.peer(addr)
+}
+
+// placement returns the n nodes that a key is placed on, using rendezvous hashing:
+// every node is scored by hashing it together with the key, and the highest scores
+// win. So when a node joins or leaves, only the keys that it wins or won move. All
+// nodes are returned when n is zero or not smaller than the amount of nodes.
+func placement(key string, nodes []string, n int) []string {
+	ranked := make([]string, len(nodes))
+	copy(ranked, nodes)
+
+	scores := make(map[string]uint64, len(nodes))
+	for _, nodeID := range nodes {
+		h := sha256.Sum256([]byte(nodeID + "/" + key))
+		scores[nodeID] = binary.BigEndian.Uint64(h[:8])
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	if n > 0 && n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// rateLimiter limits the rate of the writes of its writers to a number of bytes per second.
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait blocks until sending n more bytes stays within the rate.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	l.sent += int64(n)
+	due := time.Duration(float64(l.sent) / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if d := due - time.Since(l.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	return limitedWriter{w: w, limiter: l}
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (lw limitedWriter) Write(p []byte) (int, error) {
+	lw.limiter.wait(len(p))
+	return lw.w.Write(p)
+}
@@ -0,0 +1,235 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+// fileNotFound is the size that a peer answers with when it does not have the requested file.
+const fileNotFound = -1
+
+// fetchSuffix is appended to a key to get the key that a replica of it is fetched to.
+const fetchSuffix = "@f"
+
+// replica is the answer of a peer to a request for a file.
+type replica struct {
+	peer p2p.Peer
+	size int64
+	md   store.Metadata
+}
+
+// fetch reads the answers of the given peers to a request for netKey, and stores the
+// newest valid copy as key, unless the local copy described by local is at least as new.
+// The answers of the other peers are discarded, and the peers that turned out to be
+// missing the file or to have an outdated or corrupt copy of it are repaired in the
+// background. It returns the number of peers that had a valid copy of the file.
+func (s *FileServer) fetch(key, netKey string, peers []p2p.Peer, local *store.Metadata) (int, error) {
+	var (
+		replicas []replica
+		stale    []p2p.Peer
+	)
+
+	for i, peer := range peers {
+		// First read the file header, so we can limit the amount of bytes that we read
+		// from the connection, so it will not keep hanging.
+		size, md, err := readFileHeader(peer)
+		if err != nil {
+			// The answers of the other peers are consumed all the same, so none of
+			// their streams is left open.
+			peer.CloseStream()
+			for _, rep := range replicas {
+				_, _ = io.Copy(io.Discard, io.LimitReader(rep.peer, rep.size))
+				rep.peer.CloseStream()
+			}
+			discardAnswers(peers[i+1:])
+			return 0, err
+		}
+		if size == fileNotFound {
+			peer.CloseStream()
+			stale = append(stale, peer)
+			continue
+		}
+		replicas = append(replicas, replica{peer: peer, size: size, md: md})
+	}
+
+	// Try the replicas from newest to oldest, until one of them is valid.
+	sort.SliceStable(replicas, func(i, j int) bool {
+		return newerMetadata(replicas[i].md, replicas[j].md)
+	})
+
+	var (
+		chosen   = local
+		fetchErr error
+		valid    int
+	)
+	for _, rep := range replicas {
+		r := io.LimitReader(rep.peer, rep.size)
+
+		switch {
+		case chosen != nil && !newerMetadata(rep.md, *chosen):
+			// The replica is not kept, but it is still verified, since only valid
+			// replicas count towards the read quorum.
+			ok := s.verifyReplica(rep, r)
+			if ok {
+				valid++
+			}
+			if !ok || rep.md.Checksum != chosen.Checksum || rep.md.Clock.Compare(chosen.Clock) != vclock.Equal {
+				stale = append(stale, rep.peer)
+			}
+		case fetchErr == nil:
+			ok, err := s.fetchReplica(key, netKey, rep, r, chosen)
+			switch {
+			case err != nil:
+				fetchErr = err
+			case ok:
+				md := rep.md
+				chosen = &md
+				valid++
+			default:
+				stale = append(stale, rep.peer)
+			}
+		}
+
+		// Whatever is left of the stream has to be consumed before the peer can be read from again.
+		_, _ = io.Copy(io.Discard, r)
+		rep.peer.CloseStream()
+	}
+
+	if fetchErr != nil {
+		return 0, fetchErr
+	}
+	if chosen == nil {
+		return 0, fmt.Errorf("[%s] no valid replica of file (%s) found on %d peers: %w", s.Transport.Addr(), key, len(peers), os.ErrNotExist)
+	}
+
+	if len(stale) > 0 {
+		go s.repair(key, netKey, stale)
+	}
+
+	return valid, nil
+}
+
+// verifyReplica reads the data of a replica from r, and reports whether it matches the
+// checksum recorded in its metadata, like fetchReplica does.
+func (s *FileServer) verifyReplica(rep replica, r io.Reader) bool {
+	h := sha256.New()
+	if _, err := crypto.CopyDecrypt(s.EncryptKey, r, h); err != nil {
+		return false
+	}
+	if rep.md.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != rep.md.Checksum {
+		log.Printf("[%s] replica of file (%s) from (%s) is corrupt\n", s.Transport.Addr(), rep.md.Key, rep.peer.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// discardAnswers consumes and closes the answers of the given peers to a request for a file.
+func discardAnswers(peers []p2p.Peer) {
+	for _, peer := range peers {
+		if size, _, err := readFileHeader(peer); err == nil && size > 0 {
+			_, _ = io.CopyN(io.Discard, peer, size)
+		}
+		peer.CloseStream()
+	}
+}
+
+// fetchReplica stores the data of a replica read from r as key, and reports whether it matches
+// the checksum recorded in its metadata. The replica is written next to the local copy described
+// by local, if there is one, and only replaces it once it turns out to be valid. It is newer than
+// the local copy, but it may be concurrent with it, so the conflict is resolved.
+func (s *FileServer) fetchReplica(key, netKey string, rep replica, r io.Reader, local *store.Metadata) (bool, error) {
+	fetchKey := key + fetchSuffix
+	defer func() { _ = s.deleteKey(s.ID, fetchKey) }()
+
+	n, err := store.WriteDecrypt(
+		s.Storage,
+		s.EncryptKey,
+		s.ID,
+		fetchKey,
+		r,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, rep.peer.RemoteAddr())
+
+	if rep.md.Checksum != "" {
+		checksum, err := s.checksum(s.ID, fetchKey)
+		if err != nil {
+			return false, err
+		}
+		if checksum != rep.md.Checksum {
+			log.Printf("[%s] replica of file (%s) from (%s) is corrupt\n", s.Transport.Addr(), key, rep.peer.RemoteAddr())
+			return false, nil
+		}
+	}
+
+	md := rep.md
+	md.Key, md.NetKey = key, netKey
+	if local != nil {
+		if _, md, err = s.resolve(s.ID, key, netKey, *local, md); err != nil {
+			return false, err
+		}
+	}
+	if err = s.copyKey(s.ID, fetchKey, key, md); err != nil {
+		return false, err
+	}
+
+	s.addOwnKey(key, netKey)
+	return true, nil
+}
+
+// repair pushes the local copy of key to the given peers, which are missing it or
+// have an outdated copy of it, unless the file is not placed on them.
+func (s *FileServer) repair(key, netKey string, peers []p2p.Peer) {
+	for _, peer := range peers {
+		if !s.placedOnPeer(s.ID+"/"+netKey, peer) {
+			continue
+		}
+		if err := s.sendFile(peer, s.ID, key); err != nil {
+			log.Printf("[%s] read repair of file (%s) on (%s) failed: %s\n", s.Transport.Addr(), key, peer.RemoteAddr(), err.Error())
+			continue
+		}
+		log.Printf("[%s] repaired file (%s) on (%s)\n", s.Transport.Addr(), key, peer.RemoteAddr())
+	}
+}
+
+func (s *FileServer) checksum(id, key string) (string, error) {
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newerMetadata reports whether the write described by a is newer than the one
+// described by b, falling back to last writer wins for concurrent writes.
+func newerMetadata(a, b store.Metadata) bool {
+	switch a.Clock.Compare(b.Clock) {
+	case vclock.After:
+		return true
+	case vclock.Concurrent:
+		return lastWriterWins(a, b)
+	case vclock.Before, vclock.Equal:
+	}
+	return false
+}
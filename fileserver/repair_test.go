@@ -0,0 +1,52 @@
+package fileserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// answerPeer is a peer whose stream is the answer to a request for a file.
+type answerPeer struct {
+	net.Conn
+	r      *bytes.Reader
+	closed bool
+}
+
+func (p *answerPeer) Read(b []byte) (int, error) { return p.r.Read(b) }
+func (p *answerPeer) RemoteAddr() net.Addr       { return &net.TCPAddr{} }
+func (p *answerPeer) Send([]byte) error          { return nil }
+func (p *answerPeer) CloseStream()               { p.closed = true }
+
+func TestFetchClosesStreams(t *testing.T) {
+	t.Parallel()
+
+	s := NewFileServer(ServerOpts{
+		Transport: p2p.NewMemTransport(p2p.NewMemNetwork(), p2p.WithListenAddr("node")),
+		Backend:   store.NewMemoryStore(),
+	})
+
+	answer := func(data []byte) *answerPeer {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, writeFileHeader(buf, int64(len(data)), store.Metadata{}))
+		buf.Write(data)
+		return &answerPeer{r: bytes.NewReader(buf.Bytes())}
+	}
+	valid, other := answer(make([]byte, 32)), answer(make([]byte, 64))
+	// The header of this answer is cut short.
+	broken := &answerPeer{r: bytes.NewReader([]byte{1, 2, 3})}
+
+	_, err := s.fetch("key", "net-key", []p2p.Peer{valid, broken, other}, nil)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Every stream is consumed and closed, so no peer is left blocked on it.
+	for _, peer := range []*answerPeer{valid, broken, other} {
+		assert.True(t, peer.closed)
+		assert.Zero(t, peer.r.Len())
+	}
+}
@@ -0,0 +1,332 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/erasure"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// shardSep separates a key from the index of one of its erasure coded shards.
+const shardSep = "@e."
+
+// ErrTooFewPeers is returned by Store in erasure coded mode when there are fewer
+// peers with room for a shard than there are shards, which must be stored on distinct peers.
+var ErrTooFewPeers = errors.New("too few peers to store the shards on")
+
+// storeShards codes the file described by md into data and parity shards, and sends each
+// of them to a distinct peer, collecting their answers.
+func (s *FileServer) storeShards(md store.Metadata, data []byte, quorum int) ([]PeerResult, <-chan []PeerResult, error) {
+	enc, err := erasure.New(s.DataShards, s.ParityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := enc.Split(data)
+	if err = enc.Encode(shards); err != nil {
+		return nil, nil, err
+	}
+
+	targets := s.shardTargets(s.ID, md.NetKey, int64(len(shards[0]))+16)
+	if len(targets) < len(shards) {
+		return nil, nil, fmt.Errorf("%d peers for %d shards: %w", len(targets), len(shards), ErrTooFewPeers)
+	}
+	targets = targets[:len(shards)]
+
+	keys := make([]string, len(shards))
+	for i := range shards {
+		keys[i] = shardKey(md.NetKey, i)
+	}
+
+	acks, done := s.expectAcks(s.ID, keys, md.Clock, len(shards))
+	collecting := false
+	defer func() {
+		if !collecting {
+			done()
+		}
+	}()
+
+	sent := make(map[string]sentFile, len(shards))
+	for i, shard := range shards {
+		checksum := sha256.Sum256(shard)
+
+		shardMD := md
+		shardMD.Shard = &store.Shard{
+			Index:        i,
+			DataShards:   enc.DataShards(),
+			ParityShards: enc.ParityShards(),
+			Size:         int64(len(data)),
+			Checksum:     hex.EncodeToString(checksum[:]),
+		}
+
+		sf, err := s.sendShard(targets[i], keys[i], shardMD, shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		sent[targets[i].RemoteAddr().String()] = sf
+	}
+
+	log.Printf("[%s] sent %d shards of file (%s) to %d peers\n", s.Transport.Addr(), len(shards), md.Key, len(targets))
+
+	collecting = true
+	peers, answers := s.collectAcks(acks, done, targets, sent, quorum)
+	return peers, answers, nil
+}
+
+// shardTargets returns the peers that are expected to have room for a shard of size
+// bytes, ranked by rendezvous hashing of the key, so the shards of a file land on the
+// same peers for as long as the peers do not change.
+func (s *FileServer) shardTargets(id, key string, size int64) []p2p.Peer {
+	s.peerLock.Lock()
+	byNode := make(map[string]p2p.Peer, len(s.peers))
+	nodes := make([]string, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		if c, ok := s.peerCapacity[addr]; ok && c.Free >= 0 && c.Free < size {
+			continue
+		}
+		nodeID, ok := s.peerNodes[addr]
+		if !ok {
+			nodeID = addr
+		}
+		byNode[nodeID] = peer
+		nodes = append(nodes, nodeID)
+	}
+	s.peerLock.Unlock()
+
+	ranked := placement(id+"/"+key, nodes, 0)
+	targets := make([]p2p.Peer, len(ranked))
+	for i, nodeID := range ranked {
+		targets[i] = byNode[nodeID]
+	}
+	return targets
+}
+
+// sendShard sends an encrypted shard to a peer, returning what was sent.
+func (s *FileServer) sendShard(peer p2p.Peer, key string, md store.Metadata, shard []byte) (sentFile, error) {
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:       s.ID,
+			Key:      key,
+			Size:     int64(len(shard)) + 16,
+			Metadata: md,
+		},
+	}
+
+	unlock := s.lockPeers(peer)
+	defer unlock()
+
+	if err := s.write(peer, &msg); err != nil {
+		return sentFile{}, err
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return sentFile{}, err
+	}
+
+	h := sha256.New()
+	n, err := crypto.CopyEncrypt(s.EncryptKey, bytes.NewReader(shard), io.MultiWriter(peer, h))
+	if err != nil {
+		return sentFile{}, err
+	}
+
+	return sentFile{size: int64(n), checksum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// shardCopy is a shard of a file read from a peer.
+type shardCopy struct {
+	md   store.Metadata
+	data []byte
+}
+
+// fetchShards requests the shards of netKey from the given peers, reconstructs the
+// newest version of the file that enough valid shards were found of, and stores it as key.
+func (s *FileServer) fetchShards(key, netKey string, peers []p2p.Peer) error {
+	total := s.DataShards + s.ParityShards
+	keys := make([]string, total)
+	for i := range keys {
+		keys[i] = shardKey(netKey, i)
+	}
+
+	msg := Message{
+		Payload: MessageGetShards{
+			ID:   s.ID,
+			Keys: keys,
+		},
+	}
+	// The shards are only read from the peers that were asked for them.
+	peers = s.sendEach(peers, &msg)
+
+	time.Sleep(time.Millisecond * 500)
+
+	// The shards of each version of the file, by the checksum of the file.
+	versions := make(map[string][]shardCopy)
+	for i, peer := range peers {
+		copies, err := s.readShards(peer, len(keys))
+		if err != nil {
+			// The answers of the other peers are consumed all the same, so none of
+			// their streams is left open.
+			for _, other := range peers[i+1:] {
+				_, _ = s.readShards(other, len(keys))
+			}
+			return err
+		}
+		for _, c := range copies {
+			versions[c.md.Checksum] = append(versions[c.md.Checksum], c)
+		}
+	}
+
+	// Try the versions from newest to oldest, until one of them can be reconstructed.
+	checksums := make([]string, 0, len(versions))
+	for checksum := range versions {
+		checksums = append(checksums, checksum)
+	}
+	sort.Slice(checksums, func(i, j int) bool {
+		return newerMetadata(versions[checksums[i]][0].md, versions[checksums[j]][0].md)
+	})
+
+	for _, checksum := range checksums {
+		data, md, err := s.reconstruct(versions[checksum])
+		if err != nil {
+			log.Printf("[%s] can not reconstruct file (%s): %s\n", s.Transport.Addr(), key, err.Error())
+			continue
+		}
+
+		if _, err = s.Storage.Write(s.ID, key, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		md.Key, md.NetKey, md.Shard = key, netKey, nil
+		return s.writeMetadata(s.ID, key, md)
+	}
+
+	return fmt.Errorf("[%s] not enough valid shards of file (%s) found on %d peers: %w", s.Transport.Addr(), key, len(peers), os.ErrNotExist)
+}
+
+// readShards reads the answer of a peer to a request for n shards, returning the
+// shards that the peer had and that are valid.
+func (s *FileServer) readShards(peer p2p.Peer, n int) ([]shardCopy, error) {
+	defer peer.CloseStream()
+
+	var copies []shardCopy
+	for i := 0; i < n; i++ {
+		size, md, err := readFileHeader(peer)
+		if err != nil {
+			return nil, err
+		}
+		if size == fileNotFound {
+			continue
+		}
+
+		r := io.LimitReader(peer, size)
+		buf := new(bytes.Buffer)
+		_, err = crypto.CopyDecrypt(s.EncryptKey, r, buf)
+		// Whatever is left of the shard has to be consumed before the next one can be read.
+		_, _ = io.Copy(io.Discard, r)
+		if err != nil {
+			log.Printf("[%s] can not decrypt shard %d from (%s): %s\n", s.Transport.Addr(), i, peer.RemoteAddr(), err.Error())
+			continue
+		}
+
+		checksum := sha256.Sum256(buf.Bytes())
+		if md.Shard == nil || md.Shard.Index != i || md.Shard.Checksum != hex.EncodeToString(checksum[:]) {
+			log.Printf("[%s] shard %d from (%s) is corrupt\n", s.Transport.Addr(), i, peer.RemoteAddr())
+			continue
+		}
+
+		copies = append(copies, shardCopy{md: md, data: buf.Bytes()})
+	}
+
+	return copies, nil
+}
+
+// reconstruct decodes a file from its shards and verifies it against its checksum.
+func (s *FileServer) reconstruct(copies []shardCopy) ([]byte, store.Metadata, error) {
+	md := copies[0].md
+
+	enc, err := erasure.New(md.Shard.DataShards, md.Shard.ParityShards)
+	if err != nil {
+		return nil, md, err
+	}
+
+	shards := make([][]byte, md.Shard.DataShards+md.Shard.ParityShards)
+	for _, c := range copies {
+		if c.md.Shard.Index < len(shards) {
+			shards[c.md.Shard.Index] = c.data
+		}
+	}
+	if err = enc.Reconstruct(shards); err != nil {
+		return nil, md, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err = enc.Join(buf, shards, md.Shard.Size); err != nil {
+		return nil, md, err
+	}
+
+	checksum := sha256.Sum256(buf.Bytes())
+	if hex.EncodeToString(checksum[:]) != md.Checksum {
+		return nil, md, fmt.Errorf("reconstructed data does not match its checksum %s", md.Checksum) //nolint:err113
+	}
+
+	return buf.Bytes(), md, nil
+}
+
+func (s *FileServer) handleMessageGetShards(from string, msg MessageGetShards) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockPeers(peer)
+	defer unlock()
+
+	// The requester reads an answer for every shard, so an error can not stop the stream.
+	_ = peer.Send([]byte{p2p.IncomingStream})
+	for _, key := range msg.Keys {
+		if err = s.writeShard(peer, msg.ID, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeShard writes a stored shard with its header to w, or a not found header when
+// the shard is not stored here.
+func (s *FileServer) writeShard(w io.Writer, id, key string) error {
+	md, err := s.Storage.ReadMetadata(id, key)
+	if err != nil || md.Shard == nil || !s.Storage.Has(id, key) {
+		return writeFileHeader(w, fileNotFound, store.Metadata{})
+	}
+
+	size, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return writeFileHeader(w, fileNotFound, store.Metadata{})
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+
+	if err = writeFileHeader(w, size, md); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func shardKey(key string, index int) string {
+	return key + shardSep + strconv.Itoa(index)
+}
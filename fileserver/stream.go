@@ -0,0 +1,79 @@
+package fileserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// writeFileHeader writes the header that precedes a file sent over a stream.
+// It contains the size of the file followed by its length-prefixed metadata,
+// so the receiver knows how many bytes to read and how to decode them.
+func writeFileHeader(w io.Writer, size int64, md store.Metadata) error {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	if err = binary.Write(w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil { //nolint:gosec
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// readFileHeader reads the header written by writeFileHeader.
+func readFileHeader(r io.Reader) (int64, store.Metadata, error) {
+	var (
+		size   int64
+		mdSize uint32
+		md     store.Metadata
+	)
+
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return 0, md, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &mdSize); err != nil {
+		return 0, md, err
+	}
+
+	b := make([]byte, mdSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, md, err
+	}
+
+	err := json.Unmarshal(b, &md)
+	return size, md, err
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if cErr := c.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// countingReader counts the bytes that are read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
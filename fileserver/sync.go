@@ -0,0 +1,535 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/merkle"
+	"github.com/yigithankarabulut/distributed-file-storage/p2p"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+// SyncEntry describes a file in the anti-entropy exchange between two nodes.
+// Key is the key that the file is known by on the network.
+type SyncEntry struct {
+	ID       string
+	Key      string
+	Checksum string
+	Clock    vclock.Clock
+
+	// storedKey is the key that the file is stored with on this node.
+	storedKey string
+}
+
+func (e SyncEntry) treeKey() string {
+	return e.ID + "/" + e.Key
+}
+
+func (e SyncEntry) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte(e.Checksum))
+	h.Write([]byte(e.Clock.String()))
+	return h.Sum(nil)
+}
+
+// syncLevelStep is the amount of levels of the Merkle tree that an anti-entropy
+// round descends at once, so the roots are followed by 16 hashes, and each of
+// those that differ by the 16 buckets below it.
+const syncLevelStep = 4
+
+// syncState holds the files that take part in anti-entropy and the Merkle trees over
+// them. It is filled from the storage when it is first needed, and kept up to date
+// by writeMetadata and deleteKey from then on.
+type syncState struct {
+	mu sync.Mutex
+	// entries holds the files, keyed by their tree key, and is nil until it is filled.
+	entries map[string]SyncEntry
+	// trees holds the tree over the files that are placed on both this node and a peer,
+	// keyed by the node of the peer, for the live nodes that they were built for.
+	trees map[string]*merkle.Tree
+	nodes []string
+}
+
+// Sync starts an anti-entropy round with every peer, by sending them the root of
+// the Merkle tree of the files placed on both nodes. Peers with a different root
+// drill down to the buckets that differ and exchange the files that either side is missing.
+func (s *FileServer) Sync() error {
+	for _, peer := range s.peerList() {
+		var root []byte
+		err := s.withSyncTree(peer, func(tree *merkle.Tree, _ map[string]SyncEntry) {
+			root = tree.Root()
+		})
+		if err != nil {
+			continue
+		}
+
+		msg := Message{
+			Payload: MessageSyncRoot{
+				Root: root,
+			},
+		}
+		if err = s.send(peer, &msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withSyncTree calls fn with the Merkle tree of the files that are placed on both this
+// node and peer, and with all the files of this node, keyed by their tree key. Neither
+// may be used once fn returns.
+func (s *FileServer) withSyncTree(peer p2p.Peer, fn func(tree *merkle.Tree, entries map[string]SyncEntry)) error {
+	// Without a replication factor every file is placed on every node, so all the peers share a tree.
+	var nodeID string
+	if s.ReplicationFactor > 0 {
+		s.peerLock.Lock()
+		id, ok := s.peerNodes[peer.RemoteAddr().String()]
+		s.peerLock.Unlock()
+		if !ok {
+			return fmt.Errorf("peer (%s) did not announce its node yet", peer.RemoteAddr()) //nolint:err113
+		}
+		nodeID = id
+	}
+
+	st := &s.syncState
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := s.loadSyncEntries(); err != nil {
+		return err
+	}
+
+	nodes := s.liveNodes()
+	if !slices.Equal(nodes, st.nodes) {
+		st.trees, st.nodes = make(map[string]*merkle.Tree), nodes
+	}
+
+	tree, ok := st.trees[nodeID]
+	if !ok {
+		digests := make(map[string][]byte)
+		for k, e := range st.entries {
+			if s.sharedWith(k, nodeID) {
+				digests[k] = e.digest()
+			}
+		}
+		tree = merkle.Build(digests)
+		st.trees[nodeID] = tree
+	}
+
+	fn(tree, st.entries)
+	return nil
+}
+
+// syncEntries returns the files of this node that take part in anti-entropy.
+func (s *FileServer) syncEntries() ([]SyncEntry, error) {
+	st := &s.syncState
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := s.loadSyncEntries(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]SyncEntry, 0, len(st.entries))
+	for _, e := range st.entries {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// sharedWith reports whether the file with the given tree key is placed on both this
+// node and the given node, for the live nodes of the trees. The sync lock must be held.
+func (s *FileServer) sharedWith(treeKey, nodeID string) bool {
+	if s.ReplicationFactor == 0 {
+		return true
+	}
+	owners := placement(treeKey, s.syncState.nodes, s.ReplicationFactor)
+	return slices.Contains(owners, s.NodeID) && slices.Contains(owners, nodeID)
+}
+
+// loadSyncEntries fills the sync entries from the storage, if they were not filled
+// yet. The sync lock must be held.
+func (s *FileServer) loadSyncEntries() error {
+	if s.syncState.entries != nil {
+		return nil
+	}
+
+	ids, err := s.Storage.IDs()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]SyncEntry)
+	for _, id := range ids {
+		infos, err := s.Storage.List(id)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range infos {
+			md, err := s.Storage.ReadMetadata(id, fi.Key)
+			if err != nil {
+				// Files without metadata were not stored by a file server.
+				continue
+			}
+			if e, ok := s.syncEntry(id, fi.Key, md); ok {
+				entries[e.treeKey()] = e
+			}
+		}
+	}
+
+	s.syncState.entries = entries
+	return nil
+}
+
+// syncEntry returns the sync entry of a stored file, and whether the file takes part in anti-entropy.
+func (s *FileServer) syncEntry(id, key string, md store.Metadata) (SyncEntry, bool) {
+	if isVersionKey(key) {
+		// Versions are replicated along with the writes that create them
+		// and deleted by PruneVersions, syncing them would version them again.
+		return SyncEntry{}, false
+	}
+	if md.Shard != nil || (md.NetKey != "" && s.DataShards > 0) {
+		// Shards belong on the peers that they were sent to, not on every peer,
+		// and in erasure coded mode the peers only get shards of the files owned here.
+		return SyncEntry{}, false
+	}
+
+	e := SyncEntry{
+		ID:        id,
+		Key:       key,
+		Checksum:  md.Checksum,
+		Clock:     md.Clock,
+		storedKey: key,
+	}
+	if md.NetKey != "" {
+		e.Key = md.NetKey
+	}
+	return e, true
+}
+
+// writeMetadata writes the metadata of a key, and updates the file in the Merkle trees.
+// The file server writes all metadata through it, so the files are only read from the
+// storage once.
+func (s *FileServer) writeMetadata(id, key string, md store.Metadata) error {
+	if err := s.Storage.WriteMetadata(id, key, md); err != nil {
+		return err
+	}
+
+	e, ok := s.syncEntry(id, key, md)
+	if !ok {
+		return nil
+	}
+	s.updateSyncEntry(e.treeKey(), &e)
+	return nil
+}
+
+// deleteKey deletes a key, and removes the file from the Merkle trees.
+func (s *FileServer) deleteKey(id, key string) error {
+	treeKey := SyncEntry{ID: id, Key: key}.treeKey()
+	if md, err := s.Storage.ReadMetadata(id, key); err == nil && md.NetKey != "" {
+		treeKey = SyncEntry{ID: id, Key: md.NetKey}.treeKey()
+	}
+
+	if err := s.Storage.Delete(id, key); err != nil {
+		return err
+	}
+
+	s.updateSyncEntry(treeKey, nil)
+	return nil
+}
+
+// updateSyncEntry sets the entry of a tree key, or removes it when e is nil.
+func (s *FileServer) updateSyncEntry(treeKey string, e *SyncEntry) {
+	st := &s.syncState
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.entries == nil {
+		// The entries are read from the storage once they are needed.
+		return
+	}
+
+	if e == nil {
+		delete(st.entries, treeKey)
+	} else {
+		st.entries[treeKey] = *e
+	}
+	for nodeID, tree := range st.trees {
+		if e != nil && s.sharedWith(treeKey, nodeID) {
+			tree.Put(treeKey, e.digest())
+		} else {
+			tree.Delete(treeKey)
+		}
+	}
+}
+
+func (s *FileServer) handleMessageSyncRoot(from string, msg MessageSyncRoot) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	// The peer is sent the hashes of the level some steps below the root.
+	var reply *MessageSyncBuckets
+	err = s.withSyncTree(peer, func(tree *merkle.Tree, _ map[string]SyncEntry) {
+		if bytes.Equal(tree.Root(), msg.Root) {
+			return
+		}
+		level := max(tree.Depth()-1-syncLevelStep, 0)
+		reply = syncBuckets(tree, level, merkle.Children(tree.Depth()-1, 0, level))
+	})
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return s.send(peer, &Message{Payload: *reply})
+}
+
+// handleMessageSyncBuckets compares the hashes of a level of the Merkle tree of the
+// peer with the same level here. The hashes of the nodes some steps below the nodes
+// that differ are sent back, until the buckets that differ are found, whose entries
+// are sent to the peer.
+func (s *FileServer) handleMessageSyncBuckets(from string, msg MessageSyncBuckets) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	var reply any
+	err = s.withSyncTree(peer, func(tree *merkle.Tree, entries map[string]SyncEntry) {
+		diff := tree.DiffLevel(msg.Level, msg.Nodes, msg.Hashes)
+		if len(diff) == 0 {
+			return
+		}
+
+		if msg.Level > 0 {
+			level := max(msg.Level-syncLevelStep, 0)
+			var children []int
+			for _, node := range diff {
+				children = append(children, merkle.Children(msg.Level, node, level)...)
+			}
+			reply = *syncBuckets(tree, level, children)
+			return
+		}
+
+		var diffEntries []SyncEntry
+		for _, bucket := range diff {
+			for _, k := range tree.Keys(bucket) {
+				diffEntries = append(diffEntries, entries[k])
+			}
+		}
+		reply = MessageSyncEntries{
+			Buckets: diff,
+			Entries: diffEntries,
+		}
+	})
+	if err != nil || reply == nil {
+		return err
+	}
+
+	return s.send(peer, &Message{Payload: reply})
+}
+
+// syncBuckets returns the message with the hashes of the given nodes of a level of a tree.
+func syncBuckets(tree *merkle.Tree, level int, nodes []int) *MessageSyncBuckets {
+	hashes := make([][]byte, 0, len(nodes))
+	for _, node := range nodes {
+		hashes = append(hashes, tree.Level(level)[node])
+	}
+	return &MessageSyncBuckets{
+		Level:  level,
+		Nodes:  nodes,
+		Hashes: hashes,
+	}
+}
+
+// handleMessageSyncEntries compares the entries of the buckets that differ. Files
+// that the peer is missing or that are outdated on the peer are pushed to it, and
+// the files that this node is missing or has outdated are requested from the peer.
+func (s *FileServer) handleMessageSyncEntries(from string, msg MessageSyncEntries) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]SyncEntry, len(msg.Entries))
+	for _, e := range msg.Entries {
+		remote[e.treeKey()] = e
+	}
+
+	var (
+		request []SyncEntry
+		push    []SyncEntry
+	)
+	err = s.withSyncTree(peer, func(tree *merkle.Tree, entries map[string]SyncEntry) {
+		for _, e := range msg.Entries {
+			local, ok := entries[e.treeKey()]
+			if !ok || newer(e, local) {
+				request = append(request, SyncEntry{ID: e.ID, Key: e.Key})
+			}
+		}
+		for _, bucket := range msg.Buckets {
+			if bucket < 0 || bucket >= merkle.NumBuckets {
+				continue
+			}
+			for _, k := range tree.Keys(bucket) {
+				r, ok := remote[k]
+				if !ok || newer(entries[k], r) {
+					push = append(push, entries[k])
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(request) > 0 {
+		reply := Message{
+			Payload: MessageSyncRequest{
+				Entries: request,
+			},
+		}
+		if err = s.send(peer, &reply); err != nil {
+			return err
+		}
+	}
+
+	go s.pushFiles(peer, push)
+
+	return nil
+}
+
+func (s *FileServer) handleMessageSyncRequest(from string, msg MessageSyncRequest) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	push := make([]SyncEntry, 0, len(msg.Entries))
+	err = s.withSyncTree(peer, func(_ *merkle.Tree, entries map[string]SyncEntry) {
+		for _, e := range msg.Entries {
+			if local, ok := entries[e.treeKey()]; ok {
+				push = append(push, local)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go s.pushFiles(peer, push)
+
+	return nil
+}
+
+// pushFiles sends the files of the given entries to a peer, except for the files that
+// are not placed on the peer. It runs outside of the message loop, so large transfers
+// do not stop this node from reading its peers.
+func (s *FileServer) pushFiles(peer p2p.Peer, entries []SyncEntry) {
+	for _, e := range entries {
+		if !s.placedOnPeer(e.treeKey(), peer) {
+			continue
+		}
+		if err := s.sendFile(peer, e.ID, e.storedKey); err != nil {
+			log.Printf("[%s] sync push of file (%s) to (%s) failed: %s\n", s.Transport.Addr(), e.Key, peer.RemoteAddr(), err.Error())
+			continue
+		}
+		log.Printf("[%s] synced file (%s) to (%s)\n", s.Transport.Addr(), e.Key, peer.RemoteAddr())
+	}
+}
+
+// sendFile sends a stored file to a peer, the same way Store replicates it. Files
+// that this node owns are stored unencrypted, so they are encrypted on the way,
+// while replicas are sent as they are.
+func (s *FileServer) sendFile(peer p2p.Peer, id, key string) error {
+	_, err := s.sendFileLimited(peer, id, key, nil)
+	return err
+}
+
+// sendFileLimited sends a stored file to a peer like sendFile, at the rate allowed by
+// limiter when it is not nil. It returns the amount of bytes that were sent.
+func (s *FileServer) sendFileLimited(peer p2p.Peer, id, key string, limiter *rateLimiter) (int64, error) {
+	md, err := s.Storage.ReadMetadata(id, key)
+	if err != nil {
+		return 0, err
+	}
+
+	size, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer func() { _ = rc.Close() }()
+	}
+
+	netKey, encrypt := key, md.NetKey != ""
+	if encrypt {
+		netKey, size = md.NetKey, size+16
+	}
+
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:       id,
+			Key:      netKey,
+			Size:     size,
+			Metadata: md,
+		},
+	}
+
+	unlock := s.lockPeers(peer)
+	defer unlock()
+
+	if err = s.write(peer, &msg); err != nil {
+		return 0, err
+	}
+
+	if err = peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return 0, err
+	}
+
+	var w io.Writer = peer
+	if limiter != nil {
+		w = limiter.writer(peer)
+	}
+
+	if encrypt {
+		n, err := crypto.CopyEncrypt(s.EncryptKey, r, w)
+		return int64(n), err
+	}
+
+	return io.Copy(w, r)
+}
+
+// peer returns the connected peer with the given address.
+func (s *FileServer) peer(addr string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	if !ok {
+		return nil, fmt.Errorf("peer (%s) could not be found in the peers map", addr) //nolint:err113
+	}
+	return peer, nil
+}
+
+// newer reports whether entry a should replace entry b.
+func newer(a, b SyncEntry) bool {
+	switch a.Clock.Compare(b.Clock) {
+	case vclock.After:
+		return true
+	case vclock.Concurrent:
+		return a.Checksum != b.Checksum
+	case vclock.Before, vclock.Equal:
+	}
+	return false
+}
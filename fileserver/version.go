@@ -0,0 +1,168 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/store"
+)
+
+// versionSep separates a key from the ID of one of its versions.
+const versionSep = "@v."
+
+// ErrReservedKey is an error that is returned for keys that contain a separator
+// the file server uses to derive the keys of versions and siblings.
+var ErrReservedKey = errors.New("key contains a reserved separator")
+
+// RetentionPolicy describes which old versions of a key are kept. The latest
+// version is always kept, zero values mean no limit.
+type RetentionPolicy struct {
+	// KeepLast is the amount of most recent versions that are kept.
+	KeepLast int
+	// MaxAge is the age after which versions are pruned.
+	MaxAge time.Duration
+}
+
+// Version describes a stored version of a key.
+type Version struct {
+	ID        string
+	Size      int64
+	Timestamp time.Time
+}
+
+// GetVersion gets a specific version of a key from the file server.
+func (s *FileServer) GetVersion(key, version string, opts ...CallOption) (io.Reader, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return s.get(versionKey(key, version), versionKey(crypto.HashKey(key), version), opts...)
+}
+
+// ListVersions returns the versions of a key that are stored locally, newest first.
+func (s *FileServer) ListVersions(key string) ([]Version, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	prefix := key + versionSep
+	infos, err := s.Storage.ListPrefix(s.ID, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(infos))
+	for _, fi := range infos {
+		v := Version{
+			ID:        strings.TrimPrefix(fi.Key, prefix),
+			Size:      fi.Size,
+			Timestamp: fi.ModTime,
+		}
+		if md, mdErr := s.Storage.ReadMetadata(s.ID, fi.Key); mdErr == nil && !md.Timestamp.IsZero() {
+			v.Timestamp = md.Timestamp
+		}
+		versions = append(versions, v)
+	}
+
+	// Version IDs start with their creation time, so they sort chronologically.
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+
+	return versions, nil
+}
+
+// PruneVersions deletes the versions of a key that are not kept by the retention
+// policy, locally and on the peers.
+func (s *FileServer) PruneVersions(key string) error {
+	versions, err := s.ListVersions(key)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range versions {
+		if i == 0 {
+			continue
+		}
+
+		expired := s.Retention.MaxAge > 0 && time.Since(v.Timestamp) > s.Retention.MaxAge
+		if (s.Retention.KeepLast == 0 || i < s.Retention.KeepLast) && !expired {
+			continue
+		}
+
+		if err = s.deleteKey(s.ID, versionKey(key, v.ID)); err != nil {
+			return err
+		}
+
+		msg := Message{
+			Payload: MessageDeleteFile{
+				ID:  s.ID,
+				Key: versionKey(crypto.HashKey(key), v.ID),
+			},
+		}
+		if err = s.broadcast(&msg); err != nil {
+			return err
+		}
+
+		log.Printf("[%s] pruned version (%s) of file (%s)\n", s.Transport.Addr(), v.ID, key)
+	}
+
+	return nil
+}
+
+// storeVersion keeps the data of key as the version that is recorded in its metadata,
+// so it can still be read once the key is overwritten.
+func (s *FileServer) storeVersion(id, key string, md store.Metadata) error {
+	if md.Version == "" || isVersionKey(key) {
+		return nil
+	}
+	if md.NetKey != "" {
+		md.NetKey = versionKey(md.NetKey, md.Version)
+	}
+
+	return s.copyKey(id, key, versionKey(key, md.Version), md)
+}
+
+func (s *FileServer) handleMessageDeleteFile(_ string, msg MessageDeleteFile) error {
+	if !s.Storage.Has(msg.ID, msg.Key) {
+		return nil
+	}
+	if err := s.deleteKey(msg.ID, msg.Key); err != nil {
+		return err
+	}
+
+	s.unprovide(msg.ID, msg.Key)
+	return nil
+}
+
+func versionKey(key, version string) string {
+	return key + versionSep + version
+}
+
+// isVersionKey reports whether key is the key of a version of another key. User keys
+// can not contain the separator, see checkKey.
+func isVersionKey(key string) bool {
+	return strings.Contains(key, versionSep)
+}
+
+// checkKey returns ErrReservedKey if a user key contains the separator of version or
+// sibling keys, since it would be mistaken for a version or sibling of another key.
+func checkKey(key string) error {
+	if strings.Contains(key, versionSep) || strings.Contains(key, siblingSep) {
+		return fmt.Errorf("%w: %s", ErrReservedKey, key)
+	}
+	return nil
+}
+
+// newVersionID returns a new version ID, which starts with the current time so
+// that version IDs sort in the order they were created.
+func newVersionID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(buf))
+}
@@ -0,0 +1,178 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+)
+
+// NumBuckets is the amount of leaf buckets of a tree. Keys are spread over the
+// buckets by their hash, so two trees with the same keys always line up.
+const NumBuckets = 256
+
+// Tree is a Merkle tree over a set of keys and their digests. The leaves of the tree
+// are buckets of keys, so two nodes can compare their roots first, then the buckets,
+// and only exchange the keys of the buckets that differ.
+type Tree struct {
+	digests map[string][]byte
+	buckets [NumBuckets][]string
+	// levels holds the hashes of each level of the tree, from the leaf buckets up to the root.
+	levels [][][]byte
+}
+
+// Build builds a tree from the given keys and their digests. The tree takes the
+// digests over, and keeps them up to date as keys are put and deleted.
+func Build(digests map[string][]byte) *Tree {
+	if digests == nil {
+		digests = make(map[string][]byte)
+	}
+	t := &Tree{digests: digests}
+
+	for key := range digests {
+		b := BucketOf(key)
+		t.buckets[b] = append(t.buckets[b], key)
+	}
+
+	leaves := make([][]byte, NumBuckets)
+	for i := range t.buckets {
+		sort.Strings(t.buckets[i])
+		leaves[i] = t.bucketHash(i)
+	}
+
+	t.levels = [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+
+	return t
+}
+
+// Put sets the digest of a key, rehashing its bucket and the path from the bucket to the root.
+func (t *Tree) Put(key string, digest []byte) {
+	b := BucketOf(key)
+	if _, ok := t.digests[key]; !ok {
+		keys := t.buckets[b]
+		i := sort.SearchStrings(keys, key)
+		t.buckets[b] = append(keys[:i], append([]string{key}, keys[i:]...)...)
+	}
+	t.digests[key] = digest
+	t.rehash(b)
+}
+
+// Delete removes a key from the tree, rehashing its bucket and the path from the bucket to the root.
+func (t *Tree) Delete(key string) {
+	if _, ok := t.digests[key]; !ok {
+		return
+	}
+	delete(t.digests, key)
+
+	b := BucketOf(key)
+	keys := t.buckets[b]
+	i := sort.SearchStrings(keys, key)
+	t.buckets[b] = append(keys[:i], keys[i+1:]...)
+	t.rehash(b)
+}
+
+func (t *Tree) rehash(bucket int) {
+	t.levels[0][bucket] = t.bucketHash(bucket)
+	for level, i := 1, bucket/2; level < len(t.levels); level, i = level+1, i/2 {
+		t.levels[level][i] = hashPair(t.levels[level-1][2*i], t.levels[level-1][2*i+1])
+	}
+}
+
+func (t *Tree) bucketHash(bucket int) []byte {
+	h := sha256.New()
+	for _, key := range t.buckets[bucket] {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(t.digests[key])
+	}
+	return h.Sum(nil)
+}
+
+func hashPair(a, b []byte) []byte {
+	h := sha256.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Root returns the hash of the root of the tree.
+func (t *Tree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Buckets returns the hashes of the leaf buckets of the tree.
+func (t *Tree) Buckets() [][]byte {
+	return t.levels[0]
+}
+
+// Level returns the hashes of the given level of the tree, zero being the leaf
+// buckets and the last level holding only the root.
+func (t *Tree) Level(i int) [][]byte {
+	return t.levels[i]
+}
+
+// Depth returns the amount of levels of the tree.
+func (t *Tree) Depth() int {
+	return len(t.levels)
+}
+
+// Keys returns the sorted keys of the given bucket.
+func (t *Tree) Keys(bucket int) []string {
+	return t.buckets[bucket]
+}
+
+// Digest returns the digest of a key and whether the key is part of the tree.
+func (t *Tree) Digest(key string) ([]byte, bool) {
+	d, ok := t.digests[key]
+	return d, ok
+}
+
+// Diff returns the buckets whose hashes differ from the given bucket hashes of
+// another tree.
+func (t *Tree) Diff(buckets [][]byte) []int {
+	var diff []int
+	for i, h := range t.Buckets() {
+		if i >= len(buckets) || !bytes.Equal(h, buckets[i]) {
+			diff = append(diff, i)
+		}
+	}
+	return diff
+}
+
+// DiffLevel returns the given nodes of a level whose hashes differ from the given
+// hashes of the same nodes of another tree.
+func (t *Tree) DiffLevel(level int, nodes []int, hashes [][]byte) []int {
+	var diff []int
+	for i, node := range nodes {
+		if level < 0 || level >= len(t.levels) || node < 0 || node >= len(t.levels[level]) {
+			continue
+		}
+		if i >= len(hashes) || !bytes.Equal(t.levels[level][node], hashes[i]) {
+			diff = append(diff, node)
+		}
+	}
+	return diff
+}
+
+// Children returns the nodes of level to that are below the given node of level from.
+func Children(from, node, to int) []int {
+	shift := from - to
+	children := make([]int, 0, 1<<shift)
+	for i := node << shift; i < (node+1)<<shift; i++ {
+		children = append(children, i)
+	}
+	return children
+}
+
+// BucketOf returns the bucket that a key belongs to.
+func BucketOf(key string) int {
+	h := sha256.Sum256([]byte(key))
+	return int(h[0]) % NumBuckets
+}
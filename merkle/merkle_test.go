@@ -0,0 +1,88 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTree(t *testing.T) {
+	a := make(map[string][]byte)
+	b := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		a[key] = []byte(key)
+		b[key] = []byte(key)
+	}
+
+	ta, tb := Build(a), Build(b)
+	assert.Equal(t, ta.Root(), tb.Root())
+	assert.Empty(t, ta.Diff(tb.Buckets()))
+	assert.Equal(t, 9, ta.Depth())
+
+	b["key-42"] = []byte("changed")
+	delete(b, "key-7")
+	b["key-new"] = []byte("new")
+	tb = Build(b)
+
+	assert.NotEqual(t, ta.Root(), tb.Root())
+
+	diff := ta.Diff(tb.Buckets())
+	assert.NotEmpty(t, diff)
+	assert.LessOrEqual(t, len(diff), 3)
+
+	var keys []string
+	for _, bucket := range diff {
+		keys = append(keys, ta.Keys(bucket)...)
+		keys = append(keys, tb.Keys(bucket)...)
+	}
+	assert.Contains(t, keys, "key-42")
+	assert.Contains(t, keys, "key-7")
+	assert.Contains(t, keys, "key-new")
+}
+
+func TestTreeUpdate(t *testing.T) {
+	digests := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		digests[key] = []byte(key)
+	}
+	tree := Build(nil)
+	for key, digest := range digests {
+		tree.Put(key, digest)
+	}
+	assert.Equal(t, Build(digests).Root(), tree.Root())
+
+	tree.Put("key-42", []byte("changed"))
+	tree.Delete("key-7")
+	tree.Delete("missing")
+	digests["key-42"] = []byte("changed")
+	delete(digests, "key-7")
+	assert.Equal(t, Build(digests).Root(), tree.Root())
+
+	// The differing bucket is found by descending from the root.
+	other := Build(map[string][]byte{})
+	for key, digest := range digests {
+		other.Put(key, digest)
+	}
+	other.Put("key-new", []byte("new"))
+
+	level, nodes := tree.Depth()-1, []int{0}
+	for level > 0 {
+		diff := tree.DiffLevel(level, nodes, [][]byte{other.Level(level)[nodes[0]]})
+		assert.Equal(t, nodes, diff)
+
+		var children []int
+		for _, node := range diff {
+			children = append(children, Children(level, node, level-1)...)
+		}
+		hashes := make([][]byte, 0, len(children))
+		for _, child := range children {
+			hashes = append(hashes, other.Level(level - 1)[child])
+		}
+		level, nodes = level-1, tree.DiffLevel(level-1, children, hashes)
+		assert.Len(t, nodes, 1)
+	}
+	assert.Equal(t, []int{BucketOf("key-new")}, nodes)
+}
@@ -1,10 +1,15 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+// MaxMessageSize is the maximum size of a message payload that DefaultDecoder accepts.
+const MaxMessageSize = 32 << 20
+
 // Decoder is an interface that can be implemented to decode
 // a message from a reader into an RPC message.
 type Decoder interface {
@@ -22,15 +27,16 @@ func (d *GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 }
 
 // DefaultDecoder is a decoder that reads from a reader into an RPC message.
-// It reads up to 1028 bytes from the reader and sets the payload of the RPC message.
+// Messages are framed by EncodeMessage, so it reads the length of the payload
+// first and then exactly that many bytes into the payload of the RPC message.
 type DefaultDecoder struct{}
 
 // Decode decodes a message from a reader into an RPC message.
 // Implements the Decoder interface.
 func (d DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 	peakBuf := make([]byte, 1)
-	if _, err := r.Read(peakBuf); err != nil {
-		return nil //nolint:nilerr
+	if _, err := io.ReadFull(r, peakBuf); err != nil {
+		return err
 	}
 
 	// In case of a stream we are not decoding what is being sent over the network
@@ -41,12 +47,28 @@ func (d DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum size of %d bytes", size, MaxMessageSize) //nolint:err113
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
 	return nil
 }
+
+// EncodeMessage frames the payload of a message so it can be read by DefaultDecoder.
+// The frame starts with the IncomingMessage byte followed by the length of the payload.
+func EncodeMessage(payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = IncomingMessage
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload))) //nolint:gosec
+	return append(buf, payload...)
+}
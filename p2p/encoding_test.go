@@ -0,0 +1,33 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(EncodeMessage([]byte("first")))
+	buf.Write(EncodeMessage(bytes.Repeat([]byte("x"), 4096)))
+	buf.WriteByte(IncomingStream)
+
+	dec := DefaultDecoder{}
+
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, []byte("first"), rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Len(t, rpc.Payload, 4096)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+
+	rpc = RPC{}
+	assert.ErrorIs(t, dec.Decode(buf, &rpc), io.EOF)
+}
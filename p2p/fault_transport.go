@@ -0,0 +1,317 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPartitioned is returned when two nodes that are partitioned from each other connect or write.
+	ErrPartitioned = errors.New("nodes are partitioned")
+	// ErrFaultsUnsupported is returned when a transport other than TCPTransport or
+	// MemTransport is wrapped with faults.
+	ErrFaultsUnsupported = errors.New("transport does not support fault injection")
+)
+
+// link is the pair of names of two nodes, in order, so it is the same in both directions.
+type link struct {
+	a, b string
+}
+
+func newLink(a, b string) link {
+	if b < a {
+		a, b = b, a
+	}
+	return link{a: a, b: b}
+}
+
+// linkFaults are the faults injected between two nodes.
+type linkFaults struct {
+	latency     time.Duration
+	bandwidth   int64
+	dropRate    float64
+	partitioned bool
+}
+
+// Faults injects faults into the connections between the nodes whose transports it wraps,
+// which are named by their listen address. Faults can be changed at any time, and apply
+// to the connections that are already open as well as to new ones, in both directions.
+type Faults struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	links map[link]linkFaults
+	nodes map[string]bool
+	// dialers maps the local address of every dialed connection to the name of the node
+	// that dialed it, which is the remote address that the accepting node sees.
+	dialers map[string]string
+	conns   map[*faultConn]struct{}
+}
+
+// NewFaults creates a fault injector without faults, which drops messages with the
+// randomness of the given seed, so tests are reproducible.
+func NewFaults(seed int64) *Faults {
+	return &Faults{
+		rand:    rand.New(rand.NewSource(seed)), //nolint:gosec
+		links:   make(map[link]linkFaults),
+		nodes:   make(map[string]bool),
+		dialers: make(map[string]string),
+		conns:   make(map[*faultConn]struct{}),
+	}
+}
+
+// FaultTransport is a transport decorator that injects the faults of a Faults into the
+// connections of the transport that it wraps. Peers are handed to the callbacks of the
+// wrapped transport, which are set on it as usual.
+type FaultTransport struct {
+	Transport
+	faults *Faults
+}
+
+// Wrap wraps a TCPTransport or MemTransport with the faults, before it starts listening.
+// The nodes at both ends of a connection have to be wrapped by the same Faults, as the
+// accepting node learns which node it is connected with from the dialing node.
+func (f *Faults) Wrap(t Transport) (*FaultTransport, error) {
+	b, ok := t.(interface{ base() *TCPTransport })
+	if !ok {
+		return nil, ErrFaultsUnsupported
+	}
+
+	// The connections of other transports can not be told apart by their addresses.
+	base := b.base()
+	if base.network != "tcp" && base.network != "mem" {
+		return nil, ErrFaultsUnsupported
+	}
+
+	name := t.Addr()
+	f.mu.Lock()
+	f.nodes[name] = true
+	f.mu.Unlock()
+
+	listen, dial := base.listen, base.dial
+	base.listen = func(addr string) (net.Listener, error) {
+		l, err := listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &faultListener{Listener: l, faults: f, name: name}, nil
+	}
+	base.dial = func(addr string) (net.Conn, error) {
+		if f.partitioned(name, addr) {
+			return nil, fmt.Errorf("dial %s from %s: %w", addr, name, ErrPartitioned)
+		}
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		f.mu.Lock()
+		f.dialers[conn.LocalAddr().String()] = name
+		f.mu.Unlock()
+
+		return f.track(&faultConn{Conn: conn, faults: f, local: name, remote: addr}), nil
+	}
+
+	return &FaultTransport{Transport: t, faults: f}, nil
+}
+
+// Faults returns the faults that are injected into the transport.
+func (t *FaultTransport) Faults() *Faults {
+	return t.faults
+}
+
+func (t *TCPTransport) base() *TCPTransport {
+	return t
+}
+
+// SetLatency delays every write between two nodes by d.
+func (f *Faults) SetLatency(a, b string, d time.Duration) {
+	f.update(a, b, func(lf *linkFaults) { lf.latency = d })
+}
+
+// SetBandwidth caps the bandwidth between two nodes to the given amount of bytes per
+// second in each direction, zero meaning unlimited.
+func (f *Faults) SetBandwidth(a, b string, bytesPerSecond int64) {
+	f.update(a, b, func(lf *linkFaults) { lf.bandwidth = bytesPerSecond })
+}
+
+// SetDropRate drops the given fraction of the messages between two nodes. Only whole
+// messages are dropped, never the streams that follow them, so the connection stays
+// readable.
+func (f *Faults) SetDropRate(a, b string, rate float64) {
+	f.update(a, b, func(lf *linkFaults) { lf.dropRate = rate })
+}
+
+// Partition partitions two nodes from each other. Their connections are reset, and
+// they can not connect again until the partition is healed.
+func (f *Faults) Partition(a, b string) {
+	f.update(a, b, func(lf *linkFaults) { lf.partitioned = true })
+	f.Reset(a, b)
+}
+
+// Isolate partitions a node from every other node.
+func (f *Faults) Isolate(name string) {
+	for _, other := range f.names() {
+		if other != name {
+			f.Partition(name, other)
+		}
+	}
+}
+
+// Heal heals the partition between two nodes.
+func (f *Faults) Heal(a, b string) {
+	f.update(a, b, func(lf *linkFaults) { lf.partitioned = false })
+}
+
+// HealAll removes every fault between every node.
+func (f *Faults) HealAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.links = make(map[link]linkFaults)
+}
+
+// Reset closes the connections between two nodes, like a connection reset does.
+func (f *Faults) Reset(a, b string) {
+	l := newLink(a, b)
+
+	f.mu.Lock()
+	var conns []*faultConn
+	for c := range f.conns {
+		if remote, ok := f.remoteOf(c); ok && newLink(c.local, remote) == l {
+			conns = append(conns, c)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+func (f *Faults) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.nodes))
+	for name := range f.nodes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (f *Faults) update(a, b string, fn func(*linkFaults)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	l := newLink(a, b)
+	lf := f.links[l]
+	fn(&lf)
+	f.links[l] = lf
+}
+
+func (f *Faults) link(a, b string) linkFaults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.links[newLink(a, b)]
+}
+
+func (f *Faults) partitioned(a, b string) bool {
+	return f.link(a, b).partitioned
+}
+
+func (f *Faults) drop(rate float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+func (f *Faults) track(c *faultConn) *faultConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conns[c] = struct{}{}
+	return c
+}
+
+// remoteOf returns the name of the node at the other end of a connection. Accepted
+// connections only learn it once the dialing node has registered the connection.
+// The caller holds mu.
+func (f *Faults) remoteOf(c *faultConn) (string, bool) {
+	if c.remote != "" {
+		return c.remote, true
+	}
+	name, ok := f.dialers[c.Conn.RemoteAddr().String()]
+	if ok {
+		c.remote = name
+	}
+	return name, ok
+}
+
+type faultListener struct {
+	net.Listener
+	faults *Faults
+	name   string
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.faults.track(&faultConn{Conn: conn, faults: l.faults, local: l.name}), nil
+}
+
+// faultConn is a connection between two nodes that the faults between them are injected into.
+type faultConn struct {
+	net.Conn
+	faults *Faults
+	local  string
+	// remote is the name of the node at the other end, guarded by the mutex of faults.
+	remote string
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.faults.mu.Lock()
+	remote, ok := c.faults.remoteOf(c)
+	c.faults.mu.Unlock()
+	if !ok {
+		return c.Conn.Write(b)
+	}
+
+	lf := c.faults.link(c.local, remote)
+	if lf.partitioned {
+		_ = c.Close()
+		return 0, fmt.Errorf("write from %s to %s: %w", c.local, remote, ErrPartitioned)
+	}
+
+	delay := lf.latency
+	if lf.bandwidth > 0 {
+		delay += time.Duration(int64(len(b)) * int64(time.Second) / lf.bandwidth)
+	}
+	time.Sleep(delay)
+
+	if lf.dropRate > 0 && isMessageFrame(b) && c.faults.drop(lf.dropRate) {
+		return len(b), nil
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *faultConn) Close() error {
+	c.faults.mu.Lock()
+	delete(c.faults.conns, c)
+	if c.faults.dialers[c.Conn.LocalAddr().String()] == c.local {
+		delete(c.faults.dialers, c.Conn.LocalAddr().String())
+	}
+	c.faults.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// isMessageFrame reports whether b holds exactly one message framed by EncodeMessage.
+func isMessageFrame(b []byte) bool {
+	return len(b) >= 5 && b[0] == IncomingMessage && int(binary.LittleEndian.Uint32(b[1:5])) == len(b)-5
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultTransport(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork()
+	faults := NewFaults(1)
+
+	connected := make(chan Peer, 4)
+	disconnected := make(chan Peer, 4)
+	newTransport := func(name string) *FaultTransport {
+		ft, err := faults.Wrap(NewMemTransport(network,
+			WithListenAddr(name),
+			WithHandshakeFunc(NOPHandshakeFunc),
+			WithDecoder(&DefaultDecoder{}),
+			WithOnPeer(func(p Peer) error {
+				connected <- p
+				return nil
+			}),
+			WithOnPeerDisconnect(func(p Peer) {
+				disconnected <- p
+			}),
+		))
+		assert.Nil(t, err)
+		assert.Nil(t, ft.ListenAndAccept())
+		return ft
+	}
+	connect := func(from, to *FaultTransport) (Peer, Peer) {
+		assert.Nil(t, from.Dial(to.Addr()))
+		p1, p2 := <-connected, <-connected
+		if p1.RemoteAddr().String() != to.Addr() {
+			p1, p2 = p2, p1
+		}
+		return p1, p2
+	}
+
+	a, b := newTransport("a"), newTransport("b")
+	p1, p2 := connect(a, b)
+
+	faults.SetLatency("a", "b", 50*time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, p2.Send(EncodeMessage([]byte("slow"))))
+	assert.Equal(t, []byte("slow"), (<-a.Consume()).Payload)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	faults.SetLatency("a", "b", 0)
+
+	faults.SetBandwidth("a", "b", 100*1024)
+	start = time.Now()
+	assert.Nil(t, p1.Send(EncodeMessage(make([]byte, 10*1024))))
+	<-b.Consume()
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	faults.SetBandwidth("a", "b", 0)
+
+	// Dropped messages leave the connection readable for the next ones.
+	faults.SetDropRate("a", "b", 1)
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("dropped"))))
+	faults.SetDropRate("a", "b", 0)
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("delivered"))))
+	assert.Equal(t, []byte("delivered"), (<-b.Consume()).Payload)
+
+	faults.Partition("a", "b")
+	<-disconnected
+	<-disconnected
+	assert.ErrorIs(t, a.Dial("b"), ErrPartitioned)
+	assert.ErrorIs(t, b.Dial("a"), ErrPartitioned)
+
+	// Other nodes are not affected by the partition.
+	c := newTransport("c")
+	connect(c, a)
+
+	faults.Heal("a", "b")
+	connect(b, a)
+
+	quic, err := NewQUICTransport(nil)
+	assert.Nil(t, err)
+	_, err = faults.Wrap(quic)
+	assert.ErrorIs(t, err, ErrFaultsUnsupported)
+}
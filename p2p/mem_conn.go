@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// memPipe creates the two ends of an in-memory connection. Unlike net.Pipe, writes
+// are buffered and do not wait for the other end to read them, the way writes to a
+// TCP connection do not wait for the remote to read them.
+func memPipe(a, b memAddr) (net.Conn, net.Conn) {
+	ab, ba := newMemBuffer(), newMemBuffer()
+	return &memConn{local: a, remote: b, r: ba, w: ab},
+		&memConn{local: b, remote: a, r: ab, w: ba}
+}
+
+// memBuffer holds the bytes written to one direction of a memPipe until they are read.
+type memBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemBuffer() *memBuffer {
+	b := &memBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.buf.Len() == 0 {
+		switch {
+		case b.closed:
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	return b.buf.Read(p)
+}
+
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, _ := b.buf.Write(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *memBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// setDeadline sets the time after which blocked and future reads fail.
+func (b *memBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// memConn is one end of a memPipe.
+type memConn struct {
+	local, remote memAddr
+	r, w          *memBuffer
+
+	// readMu serializes reads like the read lock of a socket does, so a reader that
+	// is already waiting gets the next bytes before a reader that comes after it.
+	// The read loop of a transport relies on that to see the stream byte before the
+	// receiver of the stream starts reading it.
+	readMu sync.Mutex
+
+	mu            sync.Mutex
+	closed        bool
+	writeDeadline time.Time
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	return c.r.read(p)
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mu.Unlock()
+
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.w.write(p)
+}
+
+// Close closes both directions, so the other end reads EOF once it has read what
+// was written before, and fails to write.
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+func (c *memConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.r.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of writes, which never block, so it only
+// makes writes fail once it has passed.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
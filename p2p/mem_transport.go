@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrAddrInUse is returned when a MemTransport listens on a name that is already listened on.
+	ErrAddrInUse = errors.New("address already in use")
+	// ErrConnRefused is returned when a MemTransport dials a name that nobody listens on.
+	ErrConnRefused = errors.New("connection refused")
+)
+
+// MemNetwork is an in-memory network, which MemTransports listen and dial on by name.
+// Each test can create its own network, so tests run in parallel without sockets.
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	conns     int
+}
+
+// NewMemNetwork creates an empty in-memory network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+	}
+}
+
+// Listening reports whether a transport listens on the given name.
+func (n *MemNetwork) Listening(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.listeners[name]
+	return ok
+}
+
+func (n *MemNetwork) listen(name string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[name]; ok {
+		return nil, fmt.Errorf("listen mem %s: %w", name, ErrAddrInUse)
+	}
+
+	l := &memListener{
+		network: n,
+		addr:    memAddr(name),
+		conns:   make(chan net.Conn, 16),
+		done:    make(chan struct{}),
+	}
+	n.listeners[name] = l
+	return l, nil
+}
+
+// dial connects from the node named from to the node listening on name. The
+// listening side sees the connection coming from a name that is unique to it,
+// like the ephemeral port of a TCP connection.
+func (n *MemNetwork) dial(from, name string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[name]
+	if !ok {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dial mem %s: %w", name, ErrConnRefused)
+	}
+	n.conns++
+	local := memAddr(fmt.Sprintf("%s/%d", from, n.conns))
+	n.mu.Unlock()
+
+	client, server := memPipe(local, l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("dial mem %s: %w", name, ErrConnRefused)
+	}
+}
+
+// MemTransport is a transport implementation that connects the nodes of a MemNetwork
+// in memory. It shares the handshake, decoding and peer callbacks of TCPTransport, and
+// its listen address is the name of the node on the network.
+type MemTransport struct {
+	*TCPTransport
+}
+
+// NewMemTransport creates a new MemTransport on the given network with the given options.
+func NewMemTransport(network *MemNetwork, opts ...TCPTransportOption) *MemTransport {
+	t := NewTCPTransport(opts...)
+	t.network = "mem"
+	t.listen = network.listen
+	t.dial = func(addr string) (net.Conn, error) {
+		return network.dial(t.ListenAddr, addr)
+	}
+	return &MemTransport{TCPTransport: t}
+}
+
+// memAddr is the address of a node on a MemNetwork.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	network *MemNetwork
+	addr    memAddr
+	conns   chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
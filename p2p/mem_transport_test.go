@@ -0,0 +1,102 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemTransport(t *testing.T) {
+	t.Parallel()
+
+	network := NewMemNetwork()
+
+	connected := make(chan Peer, 2)
+	disconnected := make(chan Peer, 2)
+	newTransport := func(name string) *MemTransport {
+		return NewMemTransport(network,
+			WithListenAddr(name),
+			WithHandshakeFunc(NOPHandshakeFunc),
+			WithDecoder(&DefaultDecoder{}),
+			WithOnPeer(func(p Peer) error {
+				connected <- p
+				return nil
+			}),
+			WithOnPeerDisconnect(func(p Peer) {
+				disconnected <- p
+			}),
+		)
+	}
+
+	a, b := newTransport("a"), newTransport("b")
+	assert.Nil(t, a.ListenAndAccept())
+	assert.Nil(t, b.ListenAndAccept())
+	assert.ErrorIs(t, newTransport("a").ListenAndAccept(), ErrAddrInUse)
+	assert.ErrorIs(t, a.Dial("c"), ErrConnRefused)
+
+	assert.Nil(t, a.Dial("b"))
+	p1, p2 := <-connected, <-connected
+	if p1.RemoteAddr().String() != "b" {
+		p1, p2 = p2, p1
+	}
+	assert.Equal(t, "b", p1.RemoteAddr().String())
+	assert.Equal(t, "a/1", p2.RemoteAddr().String())
+
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("hello"))))
+	rpc := <-b.Consume()
+	assert.Equal(t, []byte("hello"), rpc.Payload)
+	assert.Equal(t, "a/1", rpc.From.String())
+
+	// A stream is read by the receiver itself, until it closes the stream.
+	assert.Nil(t, p1.Send([]byte{IncomingStream}))
+	assert.Nil(t, p1.Send([]byte("stream")))
+	time.Sleep(10 * time.Millisecond)
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(p2, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("stream"), buf)
+	p2.CloseStream()
+
+	assert.Nil(t, p1.Close())
+	<-disconnected
+	<-disconnected
+	assert.NotNil(t, p2.Send([]byte("gone")))
+
+	assert.Nil(t, b.Close())
+	assert.ErrorIs(t, a.Dial("b"), ErrConnRefused)
+}
+
+func TestMemConnDeadline(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := memPipe("a", "b")
+
+	// Writes do not wait for the other end to read.
+	_, err := c1.Write(make([]byte, 1<<20))
+	assert.Nil(t, err)
+	n, err := io.ReadFull(c2, make([]byte, 1<<20))
+	assert.Nil(t, err)
+	assert.Equal(t, 1<<20, n)
+
+	assert.Nil(t, c2.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = c2.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	assert.Nil(t, c2.SetReadDeadline(time.Time{}))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = c1.Write([]byte("x"))
+	}()
+	_, err = c2.Read(make([]byte, 1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, c1.Close())
+	_, err = c2.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = c1.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicPreamble is written first on the control stream, because QUIC only lets the
+// remote accept a stream once data has been sent on it. The data streams start with
+// their ID instead.
+const quicPreamble = 0x0
+
+// errStreamCanceled is the code that the streams that were not read to the end are canceled with.
+const errStreamCanceled quic.StreamErrorCode = 1
+
+// QUICPeer represents a peer in a QUIC network. Messages are sent on a control stream
+// that lives as long as the connection, while every stream of data, like a file, is
+// sent on a stream of its own. The IncomingStream byte on the control stream is
+// followed by the ID of the data stream, which starts with the same ID, so the data
+// streams are paired with their announcements in whatever order they arrive in, and
+// the messages that follow them are delivered while the data is still being read.
+// The data streams are read one after the other, in the order of their announcements.
+type QUICPeer struct {
+	conn    quic.Connection
+	control quic.Stream
+
+	// wmu serializes writes, so the data that follows an IncomingStream byte goes to
+	// the data stream that it announced.
+	wmu    sync.Mutex
+	out    quic.SendStream
+	nextID uint64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// announced are the IDs of the incoming data streams that were announced on the
+	// control stream and not closed yet, in order.
+	announced []uint64
+	// accepted are the incoming data streams that were accepted, by ID.
+	accepted map[uint64]quic.ReceiveStream
+	// discarded are the IDs of the data streams that were closed before they were accepted.
+	discarded map[uint64]bool
+	// released is set when CloseStream is called before the data stream was announced,
+	// which then closes the next data stream right away, like it does on a TCPPeer.
+	released bool
+	closed   bool
+	// shaken is set once the handshake is done, which reads from the control stream.
+	shaken bool
+}
+
+func newQUICPeer(conn quic.Connection, control quic.Stream) *QUICPeer {
+	p := &QUICPeer{
+		conn:      conn,
+		control:   control,
+		accepted:  make(map[uint64]quic.ReceiveStream),
+		discarded: make(map[uint64]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Send sends data to the peer. A single IncomingStream byte opens a new data stream,
+// which the following writes go to, until the next call to Send.
+// Implement the Peer interface.
+func (p *QUICPeer) Send(data []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	if p.out != nil {
+		_ = p.out.Close()
+		p.out = nil
+	}
+
+	_, err := p.writeControl(data)
+	return err
+}
+
+// Write writes to the data stream that was opened last, or to the control stream
+// when no data stream is open, where a single IncomingStream byte opens one like Send does.
+func (p *QUICPeer) Write(b []byte) (int, error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	if p.out != nil {
+		return p.out.Write(b)
+	}
+	return p.writeControl(b)
+}
+
+// writeControl writes to the control stream, opening a data stream after an
+// IncomingStream byte and announcing its ID. The caller holds wmu.
+func (p *QUICPeer) writeControl(b []byte) (int, error) {
+	if len(b) != 1 || b[0] != IncomingStream {
+		return p.control.Write(b)
+	}
+
+	p.nextID++
+	id := binary.LittleEndian.AppendUint64(nil, p.nextID)
+	if _, err := p.control.Write(append([]byte{IncomingStream}, id...)); err != nil {
+		return 0, err
+	}
+
+	out, err := p.conn.OpenUniStreamSync(context.Background())
+	if err != nil {
+		return 1, err
+	}
+	if _, err = out.Write(id); err != nil {
+		return 1, err
+	}
+	p.out = out
+
+	return 1, nil
+}
+
+// Read reads from the oldest incoming data stream that was not closed, waiting until
+// it is announced and accepted. The handshake function reads from the control stream instead.
+func (p *QUICPeer) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	if !p.shaken {
+		p.mu.Unlock()
+		return p.control.Read(b)
+	}
+	var in quic.ReceiveStream
+	for !p.closed {
+		if len(p.announced) > 0 {
+			if in = p.accepted[p.announced[0]]; in != nil {
+				break
+			}
+		}
+		p.cond.Wait()
+	}
+	closed := p.closed
+	p.mu.Unlock()
+
+	if closed {
+		return 0, net.ErrClosed
+	}
+	return in.Read(b)
+}
+
+// CloseStream closes the oldest incoming data stream, discarding what was not read of it.
+// Implement the Peer interface.
+func (p *QUICPeer) CloseStream() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.announced) == 0 {
+		p.released = true
+		return
+	}
+
+	id := p.announced[0]
+	p.announced = p.announced[1:]
+	p.discard(id)
+}
+
+// announce records the ID of an incoming data stream that was announced on the control stream.
+func (p *QUICPeer) announce(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.released {
+		p.released = false
+		p.discard(id)
+		return
+	}
+
+	p.announced = append(p.announced, id)
+	p.cond.Broadcast()
+}
+
+// discard cancels the incoming data stream with the given ID, or does so once it is
+// accepted. The caller holds mu.
+func (p *QUICPeer) discard(id uint64) {
+	if in, ok := p.accepted[id]; ok {
+		in.CancelRead(errStreamCanceled)
+		delete(p.accepted, id)
+		return
+	}
+	p.discarded[id] = true
+}
+
+// acceptStreams accepts the incoming data streams, until the connection is closed.
+func (p *QUICPeer) acceptStreams(ctx context.Context) {
+	for {
+		in, err := p.conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+
+		var id uint64
+		if err = binary.Read(in, binary.LittleEndian, &id); err != nil {
+			in.CancelRead(errStreamCanceled)
+			continue
+		}
+
+		p.mu.Lock()
+		if p.discarded[id] || p.closed {
+			delete(p.discarded, id)
+			in.CancelRead(errStreamCanceled)
+		} else {
+			p.accepted[id] = in
+			p.cond.Broadcast()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Close closes the connection with the peer.
+func (p *QUICPeer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	return p.conn.CloseWithError(0, "")
+}
+
+// LocalAddr returns the local address of the connection.
+func (p *QUICPeer) LocalAddr() net.Addr { return p.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the connection.
+func (p *QUICPeer) RemoteAddr() net.Addr { return p.conn.RemoteAddr() }
+
+// SetDeadline sets the deadline of the control stream.
+func (p *QUICPeer) SetDeadline(t time.Time) error { return p.control.SetDeadline(t) }
+
+// SetReadDeadline sets the read deadline of the control stream.
+func (p *QUICPeer) SetReadDeadline(t time.Time) error { return p.control.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the write deadline of the control stream.
+func (p *QUICPeer) SetWriteDeadline(t time.Time) error { return p.control.SetWriteDeadline(t) }
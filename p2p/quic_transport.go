@@ -0,0 +1,236 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicProtocol is the ALPN protocol that the nodes negotiate in the TLS handshake of QUIC.
+const quicProtocol = "distributed-file-storage"
+
+// quicKeepAlive keeps idle connections open, which QUIC closes after 30 seconds otherwise.
+const quicKeepAlive = 10 * time.Second
+
+// QUICTransport is a transport implementation that uses QUIC as the underlying network
+// protocol. Each peer is a QUIC connection, with the messages on one stream and every
+// stream of data on a stream of its own. It shares the handshake, decoding and peer
+// callbacks of TCPTransport, and its listen address is a UDP address.
+type QUICTransport struct {
+	*TCPTransport
+
+	// TLSConfig is the TLS configuration of both the listening and the dialing side.
+	TLSConfig *tls.Config
+	// QUICConfig is the QUIC configuration.
+	QUICConfig *quic.Config
+
+	listener *quic.Listener
+}
+
+// NewQUICTransport creates a new QUICTransport with the given TLS configuration and
+// options. Without a TLS configuration, the transport uses a self-signed certificate
+// and does not verify the certificates of its peers, which only authenticates the
+// peers through the handshake function.
+func NewQUICTransport(tlsConf *tls.Config, opts ...TCPTransportOption) (*QUICTransport, error) {
+	if tlsConf == nil {
+		var err error
+		if tlsConf, err = selfSignedTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConf = tlsConf.Clone()
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{quicProtocol}
+	}
+
+	t := NewTCPTransport(opts...)
+	t.network = "quic"
+
+	return &QUICTransport{
+		TCPTransport: t,
+		TLSConfig:    tlsConf,
+		QUICConfig:   &quic.Config{KeepAlivePeriod: quicKeepAlive},
+	}, nil
+}
+
+// Close implements the Transport interface, which will close the transport and stop
+// listening for incoming connections.
+func (t *QUICTransport) Close() error {
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return ErrNilListener
+}
+
+// Dial implements the Transport interface, which will dial a connection to the given address
+// and then handle the connection.
+func (t *QUICTransport) Dial(addr string) error {
+	conn, err := quic.DialAddr(context.Background(), addr, t.TLSConfig, t.QUICConfig)
+	if err != nil {
+		return err
+	}
+
+	control, err := conn.OpenStreamSync(context.Background())
+	if err == nil {
+		_, err = control.Write([]byte{quicPreamble})
+	}
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return err
+	}
+
+	go t.handleConn(newQUICPeer(conn, control))
+
+	return nil
+}
+
+// Addr implements the Transport interface, which will return the address that the
+// transport listens on, e.g. with the port that was picked for a listen address of port 0.
+func (t *QUICTransport) Addr() string {
+	if t.listener != nil {
+		return t.listener.Addr().String()
+	}
+	return t.ListenAddr
+}
+
+// ListenAndAccept implements the Transport interface, which will listen for incoming
+// connections and accept them, and then handle the connection.
+func (t *QUICTransport) ListenAndAccept() error {
+	var err error
+
+	t.listener, err = quic.ListenAddr(t.ListenAddr, t.TLSConfig, t.QUICConfig)
+	if err != nil {
+		log.Printf("quic listen error: %s\n", err.Error())
+		return err
+	}
+
+	go t.startAcceptLoop()
+
+	log.Printf("quic transport listening on [%s]\n", t.Addr())
+
+	return nil
+}
+
+func (t *QUICTransport) startAcceptLoop() {
+	for {
+		conn, err := t.listener.Accept(context.Background())
+		if errors.Is(err, quic.ErrServerClosed) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("quic accept error: %s\n", err.Error())
+			continue
+		}
+
+		go t.acceptConn(conn)
+	}
+}
+
+// acceptConn accepts the control stream that the dialing side opens first.
+func (t *QUICTransport) acceptConn(conn quic.Connection) {
+	control, err := conn.AcceptStream(conn.Context())
+	if err == nil {
+		_, err = io.ReadFull(control, make([]byte, 1))
+	}
+	if err != nil {
+		log.Printf("quic accept error: %s\n", err.Error())
+		_ = conn.CloseWithError(0, "")
+		return
+	}
+
+	t.handleConn(newQUICPeer(conn, control))
+}
+
+func (t *QUICTransport) handleConn(peer *QUICPeer) {
+	var err error
+
+	defer func() {
+		log.Printf("dropping peer connection: %s", err)
+		_ = peer.Close()
+	}()
+
+	if err = t.ShakeHands(peer); err != nil {
+		return
+	}
+
+	peer.mu.Lock()
+	peer.shaken = true
+	peer.mu.Unlock()
+
+	go peer.acceptStreams(peer.conn.Context())
+
+	if t.OnPeer != nil {
+		if err = t.OnPeer(peer); err != nil {
+			return
+		}
+	}
+
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
+	// Read Loop
+	for {
+		rpc := RPC{}
+		err = t.Decoder.Decode(peer.control, &rpc)
+		if err != nil {
+			return
+		}
+
+		rpc.From = peer.RemoteAddr()
+
+		if rpc.Stream {
+			var id uint64
+			if err = binary.Read(peer.control, binary.LittleEndian, &id); err != nil {
+				return
+			}
+			log.Printf("[%s] incoming stream %d\n", peer.RemoteAddr(), id)
+			peer.announce(id)
+			continue
+		}
+
+		t.rpcCh <- rpc
+	}
+}
+
+// selfSignedTLSConfig creates a TLS configuration with a new self-signed certificate,
+// which does not verify the certificates of the other side.
+func selfSignedTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: quicProtocol},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		InsecureSkipVerify: true, //nolint:gosec
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newQUICPair starts two QUIC transports and connects them, returning the peer of b on a
+// and the peer of a on b.
+func newQUICPair(t *testing.T) (a, b *QUICTransport, p1, p2 Peer) {
+	t.Helper()
+
+	connected := make(chan Peer, 2)
+	newTransport := func() *QUICTransport {
+		tr, err := NewQUICTransport(nil,
+			WithListenAddr("127.0.0.1:0"),
+			WithHandshakeFunc(NOPHandshakeFunc),
+			WithDecoder(&DefaultDecoder{}),
+			WithOnPeer(func(p Peer) error {
+				connected <- p
+				return nil
+			}),
+		)
+		assert.Nil(t, err)
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { _ = tr.Close() })
+		return tr
+	}
+
+	a, b = newTransport(), newTransport()
+	assert.NotEqual(t, "127.0.0.1:0", b.Addr())
+
+	assert.Nil(t, a.Dial(b.Addr()))
+	p1, p2 = <-connected, <-connected
+	if p1.RemoteAddr().String() != b.Addr() {
+		p1, p2 = p2, p1
+	}
+	return a, b, p1, p2
+}
+
+func TestQUICTransport(t *testing.T) {
+	t.Parallel()
+
+	a, b, p1, p2 := newQUICPair(t)
+
+	// Messages and streams are paired up in the order that they were sent in.
+	data := bytes.Repeat([]byte("quic"), 64*1024)
+	for _, payload := range [][]byte{[]byte("first"), []byte("second")} {
+		assert.Nil(t, p1.Send(EncodeMessage(payload)))
+		assert.Nil(t, p1.Send([]byte{IncomingStream}))
+		_, err := p1.Write(data)
+		assert.Nil(t, err)
+
+		rpc := <-b.Consume()
+		assert.Equal(t, payload, rpc.Payload)
+
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(p2, got)
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+		p2.CloseStream()
+	}
+
+	// The IncomingStream byte can be written like the data that follows it.
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("third"))))
+	_, err := p1.Write([]byte{IncomingStream})
+	assert.Nil(t, err)
+	_, err = p1.Write([]byte("written"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("third"), (<-b.Consume()).Payload)
+	got := make([]byte, 7)
+	_, err = io.ReadFull(p2, got)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("written"), got)
+	p2.CloseStream()
+
+	// A stream that is closed without being read is discarded.
+	assert.Nil(t, p1.Send([]byte{IncomingStream}))
+	_, err = p1.Write([]byte("unread"))
+	assert.Nil(t, err)
+	p2.CloseStream()
+
+	assert.Nil(t, p2.Send(EncodeMessage([]byte("back"))))
+	rpc := <-a.Consume()
+	assert.Equal(t, []byte("back"), rpc.Payload)
+
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("after"))))
+	rpc = <-b.Consume()
+	assert.Equal(t, []byte("after"), rpc.Payload)
+}
+
+func TestQUICConcurrentStreams(t *testing.T) {
+	t.Parallel()
+
+	_, b, p1, p2 := newQUICPair(t)
+
+	// Two transfers are sent before the receiver reads either of them, followed by a message.
+	first, second := bytes.Repeat([]byte("1"), 128*1024), bytes.Repeat([]byte("2"), 128*1024)
+	for _, data := range [][]byte{first, second} {
+		assert.Nil(t, p1.Send([]byte{IncomingStream}))
+		_, err := p1.Write(data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, p1.Send(EncodeMessage([]byte("meanwhile"))))
+
+	// The message is not held up by the transfers that are still being read.
+	select {
+	case rpc := <-b.Consume():
+		assert.Equal(t, []byte("meanwhile"), rpc.Payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message is held up by the open streams")
+	}
+
+	// The transfers are read in the order that they were announced in.
+	for _, data := range [][]byte{first, second} {
+		got := make([]byte, len(data))
+		_, err := io.ReadFull(p2, got)
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+		p2.CloseStream()
+	}
+}
@@ -2,7 +2,6 @@ package p2p
 
 import (
 	"net"
-	"sync"
 )
 
 // TCPPeer represents a peer in a TCP network.
@@ -15,7 +14,10 @@ type TCPPeer struct {
 	// if we accept and retrieve a connection, outbound == false
 	outbound bool
 
-	wg *sync.WaitGroup
+	// released is signaled when the stream of the peer is closed. It holds one signal,
+	// so a stream can be closed before the read loop waits for it, and after the
+	// connection was dropped in the middle of it.
+	released chan struct{}
 }
 
 // TCPPeerOption is a functional option for configuring a TCPPeer.
@@ -38,7 +40,7 @@ func WithTCPPeerOutbound(outbound bool) TCPPeerOption {
 // NewTCPPeer creates a new TCPPeer with the given options.
 func NewTCPPeer(opts ...TCPPeerOption) *TCPPeer {
 	p := &TCPPeer{
-		wg: &sync.WaitGroup{},
+		released: make(chan struct{}, 1),
 	}
 
 	for _, opt := range opts {
@@ -57,5 +59,8 @@ func (p *TCPPeer) Send(data []byte) error {
 // CloseStream closes the stream of the peer.
 // Implement the Peer interface.
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	select {
+	case p.released <- struct{}{}:
+	default:
+	}
 }
@@ -15,6 +15,14 @@ type TCPTransport struct {
 	ShakeHands HandshakeFunc
 	Decoder    Decoder
 	OnPeer     func(Peer) error
+	// OnPeerDisconnect is called when the connection with a peer is dropped.
+	OnPeerDisconnect func(Peer)
+
+	// network names the network in the logs, and listen and dial open its listeners
+	// and connections, so the transport can run over other networks than TCP.
+	network string
+	listen  func(addr string) (net.Listener, error)
+	dial    func(addr string) (net.Conn, error)
 
 	listener net.Listener
 	rpcCh    chan RPC
@@ -51,9 +59,23 @@ func WithOnPeer(f func(Peer) error) TCPTransportOption {
 	}
 }
 
+// WithOnPeerDisconnect is a functional option for setting the on peer disconnect function of the TCPTransport.
+func WithOnPeerDisconnect(f func(Peer)) TCPTransportOption {
+	return func(t *TCPTransport) {
+		t.OnPeerDisconnect = f
+	}
+}
+
 // NewTCPTransport creates a new TCPTransport with the given options.
 func NewTCPTransport(opts ...TCPTransportOption) *TCPTransport {
 	t := &TCPTransport{
+		network: "tcp",
+		listen: func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		},
+		dial: func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
 		rpcCh: make(chan RPC, 1024),
 	}
 	for _, opt := range opts {
@@ -80,7 +102,7 @@ func (t *TCPTransport) Close() error {
 // Dial implements the Transport interface, which will dial a connection to the given address
 // and then handle the connection.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := t.dial(addr)
 	if err != nil {
 		return err
 	}
@@ -100,15 +122,15 @@ func (t *TCPTransport) Addr() string {
 func (t *TCPTransport) ListenAndAccept() error {
 	var err error
 
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	t.listener, err = t.listen(t.ListenAddr)
 	if err != nil {
-		log.Printf("tcp listen error: %s\n", err.Error())
+		log.Printf("%s listen error: %s\n", t.network, err.Error())
 		return err
 	}
 
 	go t.startAcceptLoop()
 
-	log.Printf("TCP transport listening on port [%s]\n", t.ListenAddr)
+	log.Printf("%s transport listening on [%s]\n", t.network, t.ListenAddr)
 
 	return nil
 }
@@ -121,7 +143,8 @@ func (t *TCPTransport) startAcceptLoop() {
 		}
 
 		if err != nil {
-			log.Printf("tcp accept error: %s\n", err.Error())
+			log.Printf("%s accept error: %s\n", t.network, err.Error())
+			continue
 		}
 
 		go t.handleConn(conn, false)
@@ -150,6 +173,10 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		}
 	}
 
+	if t.OnPeerDisconnect != nil {
+		defer t.OnPeerDisconnect(peer)
+	}
+
 	// Read Loop
 	for {
 		rpc := RPC{}
@@ -161,9 +188,8 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		rpc.From = conn.RemoteAddr()
 
 		if rpc.Stream {
-			peer.wg.Add(1)
 			log.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
+			<-peer.released
 			log.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
 			continue
 		}
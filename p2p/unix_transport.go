@@ -0,0 +1,175 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// UnixTransport is a transport implementation that uses Unix domain sockets, for nodes
+// and clients that run on the same host. It shares the handshake, decoding and peer
+// callbacks of TCPTransport, and its listen address is the path of the socket.
+type UnixTransport struct {
+	*TCPTransport
+
+	// SocketMode is the file mode of the socket, zero leaving the default of the process.
+	SocketMode os.FileMode
+	// SocketUID and SocketGID are the owner and group of the socket, -1 leaving them unchanged.
+	SocketUID int
+	SocketGID int
+}
+
+// UnixTransportOption is a functional option type for configuring the socket of a UnixTransport.
+type UnixTransportOption func(*UnixTransport)
+
+// WithSocketMode is a functional option for setting the file mode of the socket that
+// a UnixTransport listens on, e.g. 0o600 to only accept connections from its owner.
+func WithSocketMode(mode os.FileMode) UnixTransportOption {
+	return func(t *UnixTransport) {
+		t.SocketMode = mode
+	}
+}
+
+// WithSocketOwner is a functional option for setting the owner and group of the socket
+// that a UnixTransport listens on. An ID of -1 leaves it unchanged.
+func WithSocketOwner(uid, gid int) UnixTransportOption {
+	return func(t *UnixTransport) {
+		t.SocketUID, t.SocketGID = uid, gid
+	}
+}
+
+// NewUnixTransport creates a new UnixTransport with the given options of the transport
+// and of its socket.
+func NewUnixTransport(tcpOpts []TCPTransportOption, opts ...UnixTransportOption) *UnixTransport {
+	t := &UnixTransport{
+		TCPTransport: NewTCPTransport(tcpOpts...),
+		SocketUID:    -1,
+		SocketGID:    -1,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	t.network = "unix"
+	t.listen = t.listenUnix
+	t.dial = func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		// The socket reports the path that it was created at, not the one it was moved to.
+		return &unixConn{Conn: conn, remote: &net.UnixAddr{Name: addr, Net: "unix"}}, nil
+	}
+	return t
+}
+
+// listenUnix listens on the socket at path, replacing a socket that was left behind by
+// a process that is gone. The socket is created in a directory that only this process
+// can enter, and only moved to path once it has its permissions, so no client can
+// connect to it before.
+func (t *UnixTransport) listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tmp := filepath.Join(dir, filepath.Base(path))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from path when the listener is closed, not from where it was created.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if t.SocketMode != 0 {
+		err = os.Chmod(tmp, t.SocketMode)
+	}
+	if err == nil && (t.SocketUID != -1 || t.SocketGID != -1) {
+		err = os.Lchown(tmp, t.SocketUID, t.SocketGID)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: l, path: path}, nil
+}
+
+// removeStaleSocket removes the socket at path when nothing listens on it anymore.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen unix %s: not a socket: %w", path, syscall.EADDRINUSE)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("listen unix %s: %w", path, syscall.EADDRINUSE)
+	}
+
+	return os.Remove(path)
+}
+
+// unixListener gives every accepted connection a remote address of its own. The
+// clients of a Unix socket are unnamed, so their connections would all have the
+// same remote address, while peers are told apart by it.
+type unixListener struct {
+	net.Listener
+	path  string
+	conns atomic.Int64
+}
+
+// Addr returns the address of the socket, which was moved after the listener was created.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Close closes the listener and removes its socket.
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	if rmErr := os.Remove(l.path); err == nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = rmErr
+	}
+	return err
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	remote := &net.UnixAddr{
+		Name: fmt.Sprintf("%s#%d", l.Addr(), l.conns.Add(1)),
+		Net:  "unix",
+	}
+	return &unixConn{Conn: conn, remote: remote}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
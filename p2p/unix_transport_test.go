@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixTransport(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node.sock")
+
+	connected := make(chan Peer, 4)
+	newTransport := func(path string) *UnixTransport {
+		return NewUnixTransport([]TCPTransportOption{
+			WithListenAddr(path),
+			WithHandshakeFunc(NOPHandshakeFunc),
+			WithDecoder(&DefaultDecoder{}),
+			WithOnPeer(func(p Peer) error {
+				connected <- p
+				return nil
+			}),
+		}, WithSocketMode(0o600))
+	}
+
+	// A socket left behind by a process that is gone is replaced.
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.Nil(t, l.Close())
+
+	tr := newTransport(path)
+	assert.Nil(t, tr.ListenAndAccept())
+
+	fi, err := os.Stat(tr.Addr())
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	// The directory that the socket was created in is gone.
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// Nodes can not listen on a socket that is in use.
+	assert.NotNil(t, newTransport(tr.Addr()).ListenAndAccept())
+
+	client := newTransport(filepath.Join(dir, "client.sock"))
+	assert.Nil(t, client.Dial(tr.Addr()))
+	assert.Nil(t, client.Dial(tr.Addr()))
+
+	var inbound []string
+	for i := 0; i < 4; i++ {
+		p := <-connected
+		if p.RemoteAddr().String() != tr.Addr() {
+			inbound = append(inbound, p.RemoteAddr().String())
+		}
+	}
+	// The unnamed clients of the socket are told apart.
+	assert.Len(t, inbound, 2)
+	assert.NotEqual(t, inbound[0], inbound[1])
+
+	// The socket is removed when the transport is closed.
+	assert.Nil(t, tr.Close())
+	_, err = os.Stat(tr.Addr())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"io"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+)
+
+// FileInfo describes a key that is stored in a Backend.
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is an interface that can be implemented to keep the data of the
+// file server somewhere. Keys are always scoped by the ID of their owner.
+type Backend interface {
+	Has(id, key string) bool
+	Read(id, key string) (int64, io.Reader, error)
+	Write(id, key string, r io.Reader) (int64, error)
+	Delete(id, key string) error
+	Stat(id, key string) (FileInfo, error)
+	List(id string) ([]FileInfo, error)
+	ListPrefix(id, prefix string) ([]FileInfo, error)
+	IDs() ([]string, error)
+
+	ReadMetadata(id, key string) (Metadata, error)
+	WriteMetadata(id, key string, md Metadata) error
+	Clear() error
+}
+
+// Linker is implemented by backends that can make the data of a key readable under
+// another key as well, without storing a second copy of it. Writing either key later
+// replaces its data without changing the other key.
+type Linker interface {
+	Link(id, from, to string) error
+}
+
+var (
+	_ Backend = (*Store)(nil)
+	_ Backend = (*MemoryStore)(nil)
+	_ Backend = (*PackStore)(nil)
+
+	_ Linker = (*Store)(nil)
+	_ Linker = (*MemoryStore)(nil)
+)
+
+// WriteDecrypt writes a key to the given backend with decryption. It uses the given
+// encryption key to decrypt the data while it is streamed into the backend.
+func WriteDecrypt(b Backend, encryptKey []byte, id, key string, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := crypto.CopyDecrypt(encryptKey, r, pw)
+		_ = pw.CloseWithError(err)
+	}()
+
+	n, err := b.Write(id, key, pr)
+	_ = pr.CloseWithError(err)
+	return n, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package store
+
+import "errors"
+
+// diskFree is not supported on this platform, so the store is only limited by
+// its configured capacity.
+func diskFree(string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,170 @@
+package store
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultGCMinAge is the default age below which files are never collected, so
+// that writes which are still in progress are left alone.
+const defaultGCMinAge = time.Hour
+
+// GCOptions configures a garbage collection pass of a Store.
+type GCOptions struct {
+	// DryRun only reports what would be removed, without removing anything.
+	DryRun bool
+	// MinAge is the age that blobs and temporary files must have before they are
+	// collected. Defaults to one hour.
+	MinAge time.Duration
+}
+
+// GCReport describes what a garbage collection pass found. Paths are relative to the root of the store.
+type GCReport struct {
+	// Orphans are metadata files without a blob, and blobs without an index entry.
+	Orphans []string
+	// TempFiles are the leftovers of interrupted writes.
+	TempFiles []string
+	// EmptyDirs are directories that do not contain any file.
+	EmptyDirs []string
+	// StaleEntries are keys of the index whose blob does not exist anymore.
+	StaleEntries []string
+	// Reclaimed is the amount of bytes that is, or would be in a dry run, freed.
+	Reclaimed int64
+}
+
+// GC finds blobs that do not have an index entry, metadata files without a blob,
+// stale temporary files of interrupted writes and empty directories, and removes
+// them unless DryRun is set. Without the index, blobs are never collected, since
+// a blob does not need a metadata file to be a key of the store.
+func (s *Store) GC(opts GCOptions) (GCReport, error) {
+	var report GCReport
+
+	if opts.MinAge == 0 {
+		opts.MinAge = defaultGCMinAge
+	}
+	deadline := time.Now().Add(-opts.MinAge)
+
+	known := make(map[string]bool)
+	idx := s.openIndex()
+	if idx != nil {
+		for _, e := range idx.All() {
+			if _, err := os.Stat(filepath.Join(s.Root, e.Path)); errors.Is(err, os.ErrNotExist) {
+				report.StaleEntries = append(report.StaleEntries, e.Path)
+				if !opts.DryRun {
+					if err = idx.Delete(e.ID, e.Key); err != nil {
+						return report, err
+					}
+				}
+				continue
+			}
+			known[e.Path] = true
+		}
+	}
+
+	var (
+		dirs    []string
+		garbage = make(map[string]bool)
+	)
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Files at the top level, such as the index log, belong to the store itself.
+		if !strings.Contains(rel, "/") {
+			if d.IsDir() && rel != "." {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(deadline) {
+			return nil
+		}
+
+		var found *[]string
+		switch {
+		case strings.HasSuffix(rel, tempSuffix):
+			found = &report.TempFiles
+		case strings.HasSuffix(rel, metadataSuffix):
+			if _, err = os.Stat(strings.TrimSuffix(path, metadataSuffix)); errors.Is(err, os.ErrNotExist) {
+				found = &report.Orphans
+			}
+		case idx != nil && !known[rel]:
+			found = &report.Orphans
+		}
+		if found == nil {
+			return nil
+		}
+
+		*found = append(*found, rel)
+		garbage[path] = true
+		report.Reclaimed += fi.Size()
+		if opts.DryRun {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+
+	// Walk the directories bottom up, so parents that only contain empty
+	// directories or garbage are found as well.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return report, err
+		}
+
+		isEmpty := true
+		for _, e := range entries {
+			if !garbage[filepath.Join(dir, e.Name())] {
+				isEmpty = false
+				break
+			}
+		}
+		if !isEmpty {
+			continue
+		}
+
+		garbage[dir] = true
+		rel, _ := filepath.Rel(s.Root, dir)
+		report.EmptyDirs = append(report.EmptyDirs, filepath.ToSlash(rel))
+		if !opts.DryRun {
+			if err = os.Remove(dir); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !opts.DryRun {
+		s.resetUsage()
+	}
+
+	log.Printf("gc of [%s] found %d orphans, %d temp files, %d empty dirs and %d stale entries, reclaiming %d bytes (dry run: %t)\n",
+		s.Root, len(report.Orphans), len(report.TempFiles), len(report.EmptyDirs), len(report.StaleEntries), report.Reclaimed, opts.DryRun)
+
+	return report, nil
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+)
+
+func TestGC(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+		WithIndex(true),
+	)
+	id := crypto.GenerateID()
+
+	if _, err := s.Write(id, "kept", bytes.NewReader([]byte("kept bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// An orphaned blob, a leftover of an interrupted write and an empty directory.
+	orphan := filepath.Join(s.Root, id, "aaaaa", "orphan")
+	temp := filepath.Join(s.Root, id, "bbbbb", "interrupted"+tempSuffix)
+	empty := filepath.Join(s.Root, id, "ccccc", "ddddd")
+	for _, dir := range []string{filepath.Dir(orphan), filepath.Dir(temp), empty} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{orphan, temp} {
+		if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.GC(GCOptions{DryRun: true, MinAge: -time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 || len(report.TempFiles) != 1 || len(report.EmptyDirs) != 4 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if _, err = os.Stat(orphan); err != nil {
+		t.Error("expected a dry run to keep the orphan")
+	}
+
+	if _, err = s.GC(GCOptions{MinAge: -time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{orphan, temp, filepath.Dir(orphan), filepath.Dir(empty)} {
+		if _, err = os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", path)
+		}
+	}
+	if !s.Has(id, "kept") {
+		t.Error("expected kept to exist")
+	}
+
+	if err = s.Delete(id, "kept"); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(s.Root, id)); !os.IsNotExist(err) {
+		t.Error("expected delete to remove the empty directories of the key")
+	}
+}
+
+func TestGCWithoutIndex(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+	)
+	id := crypto.GenerateID()
+
+	// A blob that was written without metadata is still a key of the store.
+	if _, err := s.Write(id, "plain", bytes.NewReader([]byte("plain bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "with-metadata", bytes.NewReader([]byte("some bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteMetadata(id, "with-metadata", Metadata{Key: "with-metadata"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A metadata file whose blob is gone.
+	orphan := s.metadataPath(id, "gone")
+	if err := os.MkdirAll(filepath.Dir(orphan), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.GC(GCOptions{MinAge: -time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 {
+		t.Errorf("expected only the metadata file to be collected, got %+v", report)
+	}
+	for _, key := range []string{"plain", "with-metadata"} {
+		if !s.Has(id, key) {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+	if _, err = os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("expected the orphaned metadata file to be removed")
+	}
+}
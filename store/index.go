@@ -0,0 +1,322 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIndexFileName = "index.log"
+	// compactThreshold is the minimum amount of records in the log before it is
+	// considered for compaction.
+	compactThreshold = 1024
+)
+
+// ErrCorruptIndex is an error that is returned when the index log can not be parsed.
+var ErrCorruptIndex = errors.New("index log is corrupt")
+
+// IndexEntry is a record of the index, describing where and how a key is stored.
+type IndexEntry struct {
+	ID         string    `json:"id"`
+	Key        string    `json:"key"`
+	Path       string    `json:"path"`
+	Offset     int64     `json:"offset,omitempty"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"`
+	CreatedAt  time.Time `json:"created_at"`
+	ModifiedAt time.Time `json:"modified_at"`
+	// Metadata is the metadata of objects that do not have a metadata file of their own.
+	Metadata *Metadata `json:"metadata,omitempty"`
+	// Deleted marks the record as a tombstone in the log.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Info returns the FileInfo of the entry.
+func (e IndexEntry) Info() FileInfo {
+	return FileInfo{Key: e.Key, Size: e.Size, ModTime: e.ModifiedAt}
+}
+
+// Index is an embedded key-value index that maps each key of the store to the
+// information about its blob. It is kept in memory and persisted to an
+// append-only log, which is compacted once it grows well beyond the live entries.
+type Index struct {
+	path string
+
+	mu      sync.RWMutex
+	f       *os.File
+	entries map[string]IndexEntry
+	records int
+	// sorted holds the sorted keys of the IDs whose keys were listed by prefix,
+	// so later lookups do not go through all the entries again.
+	sorted map[string][]string
+}
+
+// OpenIndex opens the index log at the given path, creating it if it does not exist,
+// and replays it into memory. It returns ErrCorruptIndex if a record can not be parsed.
+func OpenIndex(path string) (*Index, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil { //nolint:gosec
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{
+		path:    path,
+		f:       f,
+		entries: make(map[string]IndexEntry),
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e IndexEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("%w: record %d: %s", ErrCorruptIndex, idx.records+1, err.Error())
+		}
+		idx.apply(e)
+	}
+	if err = scanner.Err(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrCorruptIndex, err.Error())
+	}
+
+	return idx, nil
+}
+
+// Get returns the entry of a key.
+func (i *Index) Get(id, key string) (IndexEntry, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	e, ok := i.entries[indexKey(id, key)]
+	return e, ok
+}
+
+// List returns all the entries that the given ID owns, sorted by key.
+func (i *Index) List(id string) []IndexEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var entries []IndexEntry
+	for _, e := range i.entries {
+		if e.ID == id {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+
+	return entries
+}
+
+// ListPrefix returns the entries of the given ID whose key starts with prefix, sorted by key.
+func (i *Index) ListPrefix(id, prefix string) []IndexEntry {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	keys, ok := i.sorted[id]
+	if !ok {
+		for _, e := range i.entries {
+			if e.ID == id {
+				keys = append(keys, e.Key)
+			}
+		}
+		sort.Strings(keys)
+		if i.sorted == nil {
+			i.sorted = make(map[string][]string)
+		}
+		i.sorted[id] = keys
+	}
+
+	var entries []IndexEntry
+	for _, key := range keys[sort.SearchStrings(keys, prefix):] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		entries = append(entries, i.entries[indexKey(id, key)])
+	}
+
+	return entries
+}
+
+// All returns all the entries of the index, sorted by ID and key.
+func (i *Index) All() []IndexEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries := make([]IndexEntry, 0, len(i.entries))
+	for _, e := range i.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return indexKey(entries[a].ID, entries[a].Key) < indexKey(entries[b].ID, entries[b].Key)
+	})
+
+	return entries
+}
+
+// Len returns the amount of live entries in the index.
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.entries)
+}
+
+// Put adds or replaces the entry of a key. The creation time of an existing
+// entry is preserved.
+func (i *Index) Put(e IndexEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	if e.ModifiedAt.IsZero() {
+		e.ModifiedAt = now
+	}
+	if old, ok := i.entries[indexKey(e.ID, e.Key)]; ok {
+		e.CreatedAt = old.CreatedAt
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = e.ModifiedAt
+	}
+
+	return i.append(e)
+}
+
+// Delete removes the entry of a key by appending a tombstone to the log.
+func (i *Index) Delete(id, key string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.entries[indexKey(id, key)]; !ok {
+		return nil
+	}
+
+	return i.append(IndexEntry{ID: id, Key: key, ModifiedAt: time.Now(), Deleted: true})
+}
+
+// Reset replaces all the entries of the index with the given ones and rewrites the log.
+func (i *Index) Reset(entries []IndexEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.entries = make(map[string]IndexEntry, len(entries))
+	i.sorted = nil
+	for _, e := range entries {
+		i.entries[indexKey(e.ID, e.Key)] = e
+	}
+
+	return i.compact()
+}
+
+// Compact rewrites the log so that it only contains the live entries.
+func (i *Index) Compact() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.compact()
+}
+
+// Close closes the index log.
+func (i *Index) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.f.Close()
+}
+
+func (i *Index) append(e IndexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = i.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	i.apply(e)
+
+	if i.records > compactThreshold && i.records > 2*len(i.entries) {
+		return i.compact()
+	}
+	return nil
+}
+
+func (i *Index) apply(e IndexEntry) {
+	i.records++
+	_, exists := i.entries[indexKey(e.ID, e.Key)]
+	if e.Deleted {
+		delete(i.entries, indexKey(e.ID, e.Key))
+	} else {
+		i.entries[indexKey(e.ID, e.Key)] = e
+	}
+
+	keys, ok := i.sorted[e.ID]
+	if !ok || exists != e.Deleted {
+		return
+	}
+	n := sort.SearchStrings(keys, e.Key)
+	if e.Deleted {
+		i.sorted[e.ID] = append(keys[:n], keys[n+1:]...)
+	} else {
+		i.sorted[e.ID] = append(keys[:n], append([]string{e.Key}, keys[n:]...)...)
+	}
+}
+
+// compact writes the live entries to a temporary file, which then atomically
+// replaces the log, so a crash during compaction never loses the index.
+func (i *Index) compact() error {
+	tmpPath := i.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range i.entries {
+		if err = enc.Encode(e); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, i.path); err != nil {
+		return err
+	}
+
+	_ = i.f.Close()
+	i.f, err = os.OpenFile(i.path, os.O_RDWR|os.O_APPEND, 0o600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	i.records = len(i.entries)
+
+	return nil
+}
+
+func indexKey(id, key string) string {
+	return id + "/" + key
+}
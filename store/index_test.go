@@ -0,0 +1,254 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+)
+
+func TestIndexReopen(t *testing.T) {
+	path := t.TempDir() + "/index.log"
+
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = idx.Put(IndexEntry{ID: "id", Key: fmt.Sprintf("key-%d", i), Size: int64(i)}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = idx.Delete("id", "key-3"); err != nil {
+		t.Error(err)
+	}
+	if err = idx.Close(); err != nil {
+		t.Error(err)
+	}
+
+	idx, err = OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+
+	if idx.Len() != 9 {
+		t.Errorf("expected 9 entries, got %d", idx.Len())
+	}
+	if _, ok := idx.Get("id", "key-3"); ok {
+		t.Error("expected key-3 to be deleted")
+	}
+	if e, ok := idx.Get("id", "key-7"); !ok || e.Size != 7 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestIndexCompaction(t *testing.T) {
+	idx, err := OpenIndex(t.TempDir() + "/index.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+
+	for i := 0; i < compactThreshold*2; i++ {
+		if err = idx.Put(IndexEntry{ID: "id", Key: "same-key", Size: int64(i)}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if idx.records > compactThreshold {
+		t.Errorf("expected the log to be compacted, got %d records", idx.records)
+	}
+	if e, _ := idx.Get("id", "same-key"); e.Size != compactThreshold*2-1 {
+		t.Errorf("expected the latest entry, got %+v", e)
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+		WithIndex(true),
+	)
+	id := crypto.GenerateID()
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("foo-%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Error(err)
+		}
+		if err := s.WriteMetadata(id, key, Metadata{Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	before, _ := s.Stat(id, "foo-2")
+
+	// Corrupt the log and drop the opened index, so it has to be reopened.
+	if err := os.WriteFile(s.indexPath(), []byte("{not json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.index.Close()
+	s.index = nil
+
+	if !s.Has(id, "foo-2") {
+		t.Error("expected foo-2 to exist after rebuild")
+	}
+
+	infos, err := s.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(infos) != 5 {
+		t.Errorf("expected 5 keys, got %d", len(infos))
+	}
+
+	e, _ := s.index.Get(id, "foo-2")
+	if e.Size != before.Size || e.Checksum == "" {
+		t.Errorf("unexpected rebuilt entry %+v", e)
+	}
+}
+
+func TestIndexRebuildWithoutMetadata(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+		WithIndex(true),
+	)
+	id := crypto.GenerateID()
+
+	if _, err := s.Write(id, "with-metadata", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Error(err)
+	}
+	if err := s.WriteMetadata(id, "with-metadata", Metadata{Key: "with-metadata"}); err != nil {
+		t.Error(err)
+	}
+	// The CAS path of a blob without metadata does not tell its key.
+	if _, err := s.Write(id, "without-metadata", bytes.NewReader([]byte("some png bytes"))); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := s.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(infos) != 1 || infos[0].Key != "with-metadata" {
+		t.Errorf("expected only the key with metadata, got %+v", infos)
+	}
+
+	// Keys of a reversible path transform function are recovered from the path.
+	s.PathTransformFunc = DefaultPathTransformFunc
+	if _, err = s.Write(id, "plain", bytes.NewReader([]byte("some gif bytes"))); err != nil {
+		t.Error(err)
+	}
+	if err = s.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, "plain") {
+		t.Error("expected plain to be recovered from its path")
+	}
+}
+
+func TestIndexRebuildMissingLog(t *testing.T) {
+	root := t.TempDir()
+	id := crypto.GenerateID()
+
+	// The blobs are written before the index is enabled, so the index starts without a log.
+	s := NewStore(WithRoot(root), WithPathTransformFunc(CASPathTransformFunc))
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("foo-%d", i)
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Error(err)
+		}
+		if err := s.WriteMetadata(id, key, Metadata{Key: key, Compression: "gzip"}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	s = NewStore(WithRoot(root), WithPathTransformFunc(CASPathTransformFunc), WithIndex(true))
+	if !s.Has(id, "foo-1") {
+		t.Error("expected foo-1 to exist without a log")
+	}
+	if s.index == nil || s.index.Len() != 3 {
+		t.Fatalf("expected the index to be rebuilt with 3 entries")
+	}
+
+	// The metadata is kept in the index and served from it.
+	e, _ := s.index.Get(id, "foo-1")
+	if e.Metadata == nil || e.Metadata.Compression != "gzip" {
+		t.Errorf("expected the metadata in the entry, got %+v", e.Metadata)
+	}
+	if err := s.WriteMetadata(id, "foo-1", Metadata{Key: "foo-1", Compression: "zstd"}); err != nil {
+		t.Error(err)
+	}
+	if md, err := s.ReadMetadata(id, "foo-1"); err != nil || md.Compression != "zstd" {
+		t.Errorf("unexpected metadata %+v: %v", md, err)
+	}
+
+	// An emptied log is rebuilt as well.
+	_ = s.index.Close()
+	if err := os.Truncate(s.indexPath(), 0); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStore(WithRoot(root), WithPathTransformFunc(CASPathTransformFunc), WithIndex(true))
+
+	infos, err := s.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(infos))
+	}
+	if md, err := s.ReadMetadata(id, "foo-1"); err != nil || md.Compression != "zstd" {
+		t.Errorf("unexpected metadata %+v: %v", md, err)
+	}
+}
+
+func TestIndexListPrefix(t *testing.T) {
+	idx, err := OpenIndex(t.TempDir() + "/index.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = idx.Close() }()
+
+	for _, key := range []string{"a", "a@v.2", "a@v.1", "ab", "b@v.1"} {
+		if err = idx.Put(IndexEntry{ID: "id", Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = idx.Put(IndexEntry{ID: "other", Key: "a@v.3"}); err != nil {
+		t.Error(err)
+	}
+
+	keys := func() []string {
+		var keys []string
+		for _, e := range idx.ListPrefix("id", "a@v.") {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+	if got := keys(); fmt.Sprint(got) != "[a@v.1 a@v.2]" {
+		t.Errorf("unexpected keys %v", got)
+	}
+
+	// The sorted keys are kept up to date by later writes and deletes.
+	if err = idx.Put(IndexEntry{ID: "id", Key: "a@v.0"}); err != nil {
+		t.Error(err)
+	}
+	if err = idx.Put(IndexEntry{ID: "id", Key: "a@v.2", Size: 2}); err != nil {
+		t.Error(err)
+	}
+	if err = idx.Delete("id", "a@v.1"); err != nil {
+		t.Error(err)
+	}
+	if got := keys(); fmt.Sprint(got) != "[a@v.0 a@v.2]" {
+		t.Errorf("unexpected keys %v", got)
+	}
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	data    []byte
+	md      *Metadata
+	modTime time.Time
+}
+
+// MemoryStore is a Backend that keeps all the data in memory. It is useful for
+// tests and ephemeral cache nodes that should not touch the disk.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	files map[string]map[string]*memoryEntry
+}
+
+// NewMemoryStore creates a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		files: make(map[string]map[string]*memoryEntry),
+	}
+}
+
+// Clear removes all the keys from the memory store.
+func (m *MemoryStore) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = make(map[string]map[string]*memoryEntry)
+	return nil
+}
+
+// Has checks if a key exists in the memory store.
+func (m *MemoryStore) Has(id, key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.files[id][key]
+	return ok
+}
+
+// Delete deletes a key from the memory store.
+func (m *MemoryStore) Delete(id, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files[id], key)
+	if len(m.files[id]) == 0 {
+		delete(m.files, id)
+	}
+	return nil
+}
+
+// Write writes a key to the memory store.
+func (m *MemoryStore) Write(id, key string, r io.Reader) (int64, error) {
+	buf := new(bytes.Buffer)
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[id]; !ok {
+		m.files[id] = make(map[string]*memoryEntry)
+	}
+	e, ok := m.files[id][key]
+	if !ok {
+		e = &memoryEntry{}
+		m.files[id][key] = e
+	}
+	e.data = buf.Bytes()
+	e.modTime = time.Now()
+
+	return n, nil
+}
+
+// Link makes the data of key from readable as key to, sharing it between the keys.
+func (m *MemoryStore) Link(id, from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.entry(id, from)
+	if err != nil {
+		return err
+	}
+	m.files[id][to] = &memoryEntry{data: e.data, modTime: time.Now()}
+	return nil
+}
+
+// Read reads a key from the memory store.
+func (m *MemoryStore) Read(id, key string) (int64, io.Reader, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, err := m.entry(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(e.data)), bytes.NewReader(e.data), nil
+}
+
+// Stat returns the information of a key in the memory store.
+func (m *MemoryStore) Stat(id, key string) (FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, err := m.entry(id, key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime}, nil
+}
+
+// List returns the information of all the keys that the given ID owns, sorted by key.
+func (m *MemoryStore) List(id string) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	infos := make([]FileInfo, 0, len(m.files[id]))
+	for key, e := range m.files[id] {
+		infos = append(infos, FileInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+// ListPrefix returns the information of the keys of the given ID that start with prefix, sorted by key.
+func (m *MemoryStore) ListPrefix(id, prefix string) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var infos []FileInfo
+	for key, e := range m.files[id] {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, FileInfo{Key: key, Size: int64(len(e.data)), ModTime: e.modTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+// IDs returns the sorted IDs that own at least one key in the memory store.
+func (m *MemoryStore) IDs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.files))
+	for id := range m.files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// ReadMetadata reads the metadata of a key from the memory store.
+func (m *MemoryStore) ReadMetadata(id, key string) (Metadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, err := m.entry(id, key)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if e.md == nil {
+		return Metadata{}, fmt.Errorf("metadata of %s: %w", key, os.ErrNotExist)
+	}
+	return *e.md, nil
+}
+
+// WriteMetadata writes the metadata of a key to the memory store.
+func (m *MemoryStore) WriteMetadata(id, key string, md Metadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.entry(id, key)
+	if err != nil {
+		return err
+	}
+	e.md = &md
+	return nil
+}
+
+func (m *MemoryStore) entry(id, key string) (*memoryEntry, error) {
+	e, ok := m.files[id][key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	return e, nil
+}
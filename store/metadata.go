@@ -0,0 +1,110 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
+)
+
+const metadataSuffix = ".meta"
+
+// Metadata contains the information recorded alongside each stored key.
+type Metadata struct {
+	// Key is the key that the data was stored with.
+	Key string `json:"key"`
+	// NetKey is the key that the data is known by on the peers, when it differs from Key.
+	NetKey string `json:"net_key,omitempty"`
+	// Checksum is the hex encoded SHA-256 of the data as it is stored by its owner,
+	// which is the same on every replica.
+	Checksum string `json:"checksum,omitempty"`
+	// Compression is the name of the codec that the stored data is compressed with.
+	Compression string `json:"compression,omitempty"`
+	// Version is the ID of the version of the key that the data belongs to.
+	Version string `json:"version,omitempty"`
+	// Timestamp is the time that the data was stored by its owner.
+	Timestamp time.Time `json:"timestamp"`
+	// Origin is the node that wrote the data.
+	Origin string `json:"origin,omitempty"`
+	// Clock is the version vector of the write that produced the data.
+	Clock vclock.Clock `json:"clock,omitempty"`
+	// Shard is set when the data is an erasure coded shard of the data described by the metadata.
+	Shard *Shard `json:"shard,omitempty"`
+}
+
+// Shard describes an erasure coded shard of stored data.
+type Shard struct {
+	// Index is the index of the shard, data shards coming before parity shards.
+	Index        int `json:"index"`
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+	// Size is the size of the data that the shards were coded from.
+	Size int64 `json:"size"`
+	// Checksum is the hex encoded SHA-256 of the shard.
+	Checksum string `json:"checksum"`
+}
+
+// WriteMetadata writes the metadata of a key to the storage. When the index is enabled,
+// the metadata is kept in the entry of the key as well, so reading it does not open a
+// file. The metadata file stays, since it holds the key that the blob is found by when
+// the index has to be rebuilt from the blobs.
+func (s *Store) WriteMetadata(id, key string, md Metadata) error {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	// The metadata file takes space of the owner as well, though it is written
+	// without checking the quota, since it is small and belongs to data that fit.
+	path := s.metadataPath(id, key)
+	oldSize := fileSize(path)
+	if err = os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+	s.addUsage(id, int64(len(b))-oldSize)
+
+	if idx := s.openIndex(); idx != nil {
+		if e, ok := idx.Get(id, key); ok {
+			e.Metadata = &md
+			return idx.Put(e)
+		}
+	}
+	return nil
+}
+
+// ReadMetadata reads the metadata of a key from the storage.
+func (s *Store) ReadMetadata(id, key string) (Metadata, error) {
+	if idx := s.openIndex(); idx != nil {
+		if e, ok := idx.Get(id, key); ok && e.Metadata != nil {
+			return *e.Metadata, nil
+		}
+	}
+	return readMetadataFile(s.metadataPath(id, key))
+}
+
+func readMetadataFile(path string) (Metadata, error) {
+	var md Metadata
+
+	b, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return md, err
+	}
+
+	err = json.Unmarshal(b, &md)
+	return md, err
+}
+
+// metadataOf returns the metadata that was read with the given error, or nil when it could not be read.
+func metadataOf(md Metadata, err error) *Metadata {
+	if err != nil {
+		return nil
+	}
+	return &md
+}
+
+func (s *Store) metadataPath(id, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), metadataSuffix)
+}
@@ -0,0 +1,639 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultSmallObjectSize = 64 * 1024
+	defaultSegmentSize     = 64 * 1024 * 1024
+	// compactLiveRatio is the ratio of live bytes below which a segment is compacted.
+	compactLiveRatio = 0.5
+
+	packDirName    = "pack"
+	objectsDirName = "objects"
+	// maxRecordHeaderSize is the size above which a record header is considered corrupt.
+	maxRecordHeaderSize = 64 * 1024
+)
+
+// packRecord is the header that precedes each object in a segment, so that the
+// index can be rebuilt from the segments alone. A tombstone has no data.
+type packRecord struct {
+	ID       string    `json:"id"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// PackStore is a Backend that appends small objects to large segment files, instead of
+// creating a file and a directory tree for each of them. Each object is written with
+// a header holding its ID, key, size and metadata, and its offset is kept in an Index,
+// which is rebuilt from the segments when it is lost. Objects larger than the small
+// object size are stored in a regular Store.
+type PackStore struct {
+	Root            string
+	SmallObjectSize int64
+	SegmentSize     int64
+
+	pathTransformFunc PathTransformFunc
+	objects           *Store
+	index             *Index
+
+	mu         sync.Mutex
+	active     *os.File
+	activeSeq  int
+	activeSize int64
+}
+
+// PackOption is a functional option for configuring a PackStore.
+type PackOption func(*PackStore)
+
+// WithSmallObjectSize is a functional option for setting the size up to which
+// objects are appended to segment files.
+func WithSmallObjectSize(n int64) PackOption {
+	return func(p *PackStore) {
+		p.SmallObjectSize = n
+	}
+}
+
+// WithSegmentSize is a functional option for setting the size after which a new segment file is started.
+func WithSegmentSize(n int64) PackOption {
+	return func(p *PackStore) {
+		p.SegmentSize = n
+	}
+}
+
+// WithPackPathTransformFunc is a functional option for setting the path transform function
+// of the store that keeps the large objects.
+func WithPackPathTransformFunc(f PathTransformFunc) PackOption {
+	return func(p *PackStore) {
+		p.pathTransformFunc = f
+	}
+}
+
+// NewPackStore creates a new PackStore in the given root directory with the given options.
+func NewPackStore(root string, opts ...PackOption) (*PackStore, error) {
+	p := &PackStore{
+		Root:              root,
+		SmallObjectSize:   defaultSmallObjectSize,
+		SegmentSize:       defaultSegmentSize,
+		pathTransformFunc: CASPathTransformFunc,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.objects = NewStore(
+		WithRoot(filepath.Join(root, objectsDirName)),
+		WithPathTransformFunc(p.pathTransformFunc),
+	)
+
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Close closes the active segment and the index of the pack store.
+func (p *PackStore) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.close()
+}
+
+// Clear removes all the segments and objects of the pack store.
+func (p *PackStore) Clear() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_ = p.close()
+	if err := os.RemoveAll(p.Root); err != nil {
+		return err
+	}
+	return p.open()
+}
+
+// Has checks if a key exists in the pack store.
+func (p *PackStore) Has(id, key string) bool {
+	if _, ok := p.index.Get(id, key); ok {
+		return true
+	}
+	return p.objects.Has(id, key)
+}
+
+// Write writes a key to the pack store. Objects up to the small object size are
+// appended to the active segment, larger ones are written to their own file.
+func (p *PackStore) Write(id, key string, r io.Reader) (int64, error) {
+	head := new(bytes.Buffer)
+	n, err := io.CopyN(head, r, p.SmallObjectSize+1)
+	if err != nil && err != io.EOF { //nolint:errorlint
+		return n, err
+	}
+
+	if n > p.SmallObjectSize {
+		if err = p.deletePacked(id, key); err != nil {
+			return 0, err
+		}
+		return p.objects.Write(id, key, io.MultiReader(head, r))
+	}
+
+	if p.objects.Has(id, key) {
+		if err = p.objects.Delete(id, key); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, p.append(id, key, head.Bytes())
+}
+
+// Read reads a key from the pack store.
+func (p *PackStore) Read(id, key string) (int64, io.Reader, error) {
+	// The segment is opened under the lock, so it is not removed by a compaction in between.
+	p.mu.Lock()
+	e, ok := p.index.Get(id, key)
+	if !ok {
+		p.mu.Unlock()
+		return p.objects.Read(id, key)
+	}
+
+	f, err := os.Open(filepath.Join(p.Root, e.Path)) //nolint:gosec
+	p.mu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r := io.NewSectionReader(f, e.Offset, e.Size)
+	return e.Size, struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// Delete deletes a key from the pack store. The space of a packed object is
+// only reclaimed once its segment is compacted.
+func (p *PackStore) Delete(id, key string) error {
+	if _, ok := p.index.Get(id, key); ok {
+		return p.deletePacked(id, key)
+	}
+	return p.objects.Delete(id, key)
+}
+
+// deletePacked appends a tombstone for a packed key, so it is not brought back
+// when the index is rebuilt, and removes it from the index.
+func (p *PackStore) deletePacked(id, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.index.Get(id, key); !ok {
+		return nil
+	}
+	if _, _, _, err := p.appendRecord(packRecord{ID: id, Key: key, Deleted: true}, nil); err != nil {
+		return err
+	}
+	return p.index.Delete(id, key)
+}
+
+// Stat returns the information of a key in the pack store.
+func (p *PackStore) Stat(id, key string) (FileInfo, error) {
+	if e, ok := p.index.Get(id, key); ok {
+		return e.Info(), nil
+	}
+	return p.objects.Stat(id, key)
+}
+
+// List returns the information of all the keys that the given ID owns, sorted by key.
+func (p *PackStore) List(id string) ([]FileInfo, error) {
+	infos, err := p.objects.List(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range p.index.List(id) {
+		infos = append(infos, e.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+// ListPrefix returns the information of the keys of the given ID that start with prefix, sorted by key.
+func (p *PackStore) ListPrefix(id, prefix string) ([]FileInfo, error) {
+	infos, err := p.objects.ListPrefix(id, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range p.index.ListPrefix(id, prefix) {
+		infos = append(infos, e.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+// IDs returns the sorted IDs that own at least one key in the pack store.
+func (p *PackStore) IDs() ([]string, error) {
+	ids, err := p.objects.IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, e := range p.index.All() {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			ids = append(ids, e.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// ReadMetadata reads the metadata of a key from the pack store.
+func (p *PackStore) ReadMetadata(id, key string) (Metadata, error) {
+	e, ok := p.index.Get(id, key)
+	if !ok {
+		return p.objects.ReadMetadata(id, key)
+	}
+	if e.Metadata == nil {
+		return Metadata{}, fmt.Errorf("metadata of %s: %w", key, os.ErrNotExist)
+	}
+	return *e.Metadata, nil
+}
+
+// WriteMetadata writes the metadata of a key to the pack store. The metadata of
+// packed objects is kept in their record, so the object is appended again with it.
+func (p *PackStore) WriteMetadata(id, key string, md Metadata) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.index.Get(id, key)
+	if !ok {
+		return p.objects.WriteMetadata(id, key, md)
+	}
+
+	data, err := p.readEntry(e)
+	if err != nil {
+		return err
+	}
+	return p.put(id, key, data, &md)
+}
+
+// Compact rewrites the live objects of the segments that are mostly made up of
+// deleted or overwritten objects into the active segment, and removes the old
+// segments. It returns the amount of bytes that were reclaimed.
+func (p *PackStore) Compact() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	segments, err := p.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	live := make(map[string][]IndexEntry)
+	for _, e := range p.index.All() {
+		live[e.Path] = append(live[e.Path], e)
+	}
+
+	var (
+		reclaimed int64
+		kept      bool
+	)
+	for _, segment := range segments {
+		rel := filepath.ToSlash(filepath.Join(packDirName, filepath.Base(segment)))
+		if rel == p.segmentPath(p.activeSeq) {
+			continue
+		}
+
+		fi, err := os.Stat(segment)
+		if err != nil {
+			return reclaimed, err
+		}
+
+		var liveSize int64
+		for _, e := range live[rel] {
+			liveSize += e.Size
+		}
+		if fi.Size() > 0 && float64(liveSize)/float64(fi.Size()) >= compactLiveRatio {
+			kept = true
+			continue
+		}
+
+		// The tombstones only have to be kept while an older segment may still hold
+		// a record of their key.
+		moved, err := p.moveLive(segment, rel, kept)
+		if err != nil {
+			return reclaimed, err
+		}
+		if err = os.Remove(segment); err != nil {
+			return reclaimed, err
+		}
+
+		log.Printf("compacted segment [%s], reclaimed %d bytes\n", rel, fi.Size()-moved)
+		reclaimed += fi.Size() - moved
+	}
+
+	return reclaimed, p.index.Compact()
+}
+
+// moveLive appends the records of a segment that are still in use to the active
+// segment, and returns the amount of bytes that were appended.
+func (p *PackStore) moveLive(segment, rel string, keepTombstones bool) (int64, error) {
+	var moved int64
+	err := readSegment(segment, func(rec packRecord, offset int64, data []byte) error {
+		e, ok := p.index.Get(rec.ID, rec.Key)
+		switch {
+		case rec.Deleted && !ok && keepTombstones:
+		case !rec.Deleted && ok && e.Path == rel && e.Offset == offset:
+			rec.Metadata = e.Metadata
+		default:
+			return nil
+		}
+
+		path, newOffset, n, err := p.appendRecord(rec, data)
+		if err != nil {
+			return err
+		}
+		moved += n
+		if rec.Deleted {
+			return nil
+		}
+
+		e.Path, e.Offset = path, newOffset
+		return p.index.Put(e)
+	})
+	return moved, err
+}
+
+// append appends an object to the active segment and points its key to it. The
+// metadata of a previous version of the key is not kept, since it described other data.
+func (p *PackStore) append(id, key string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.put(id, key, data, nil)
+}
+
+func (p *PackStore) put(id, key string, data []byte, md *Metadata) error {
+	path, offset, _, err := p.appendRecord(packRecord{ID: id, Key: key, Size: int64(len(data)), Metadata: md}, data)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	return p.index.Put(IndexEntry{
+		ID:       id,
+		Key:      key,
+		Path:     path,
+		Offset:   offset,
+		Size:     int64(len(data)),
+		Checksum: hex.EncodeToString(sum[:]),
+		Metadata: md,
+	})
+}
+
+// appendRecord appends a record to the active segment, starting a new one when the
+// active segment is full. It returns the path and the offset the data was written at,
+// and the size of the whole record.
+func (p *PackStore) appendRecord(rec packRecord, data []byte) (string, int64, int64, error) {
+	header, err := json.Marshal(rec)
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	b := make([]byte, 4, 4+len(header)+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(header))) //nolint:gosec
+	b = append(append(b, header...), data...)
+
+	path, offset, err := p.appendSegment(b)
+	return path, offset + 4 + int64(len(header)), int64(len(b)), err
+}
+
+// appendSegment appends bytes to the active segment, starting a new one when the
+// active segment is full. It returns the path and the offset the bytes were written at.
+func (p *PackStore) appendSegment(data []byte) (string, int64, error) {
+	if p.activeSize > 0 && p.activeSize+int64(len(data)) > p.SegmentSize {
+		if err := p.active.Close(); err != nil {
+			return "", 0, err
+		}
+		if err := p.openSegment(p.activeSeq + 1); err != nil {
+			return "", 0, err
+		}
+	}
+
+	offset := p.activeSize
+	if _, err := p.active.Write(data); err != nil {
+		return "", 0, err
+	}
+	if err := p.active.Sync(); err != nil {
+		return "", 0, err
+	}
+	p.activeSize += int64(len(data))
+
+	return p.segmentPath(p.activeSeq), offset, nil
+}
+
+func (p *PackStore) open() error {
+	dir := filepath.Join(p.Root, packDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil { //nolint:gosec
+		return err
+	}
+
+	segments, err := p.segments()
+	if err != nil {
+		return err
+	}
+
+	// Without a log, or with a corrupt one, the index is rebuilt from the segments.
+	indexPath := filepath.Join(dir, defaultIndexFileName)
+	fi, err := os.Stat(indexPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist) || err == nil && fi.Size() == 0:
+		err = p.rebuildIndex(indexPath, segments)
+	case err == nil:
+		p.index, err = OpenIndex(indexPath)
+		if errors.Is(err, ErrCorruptIndex) {
+			log.Printf("rebuilding index of [%s]: %s\n", p.Root, err.Error())
+			err = p.rebuildIndex(indexPath, segments)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	seq := 1
+	if len(segments) > 0 {
+		if _, err = fmt.Sscanf(filepath.Base(segments[len(segments)-1]), "segment-%06d.pack", &seq); err != nil {
+			return err
+		}
+	}
+
+	return p.openSegment(seq)
+}
+
+// rebuildIndex replaces the index with the records of the segments, which are
+// replayed in the order they were appended in.
+func (p *PackStore) rebuildIndex(indexPath string, segments []string) error {
+	if err := os.Remove(indexPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	idx, err := OpenIndex(indexPath)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]IndexEntry)
+	for _, segment := range segments {
+		rel := filepath.ToSlash(filepath.Join(packDirName, filepath.Base(segment)))
+		err = readSegment(segment, func(rec packRecord, offset int64, data []byte) error {
+			if rec.Deleted {
+				delete(entries, indexKey(rec.ID, rec.Key))
+				return nil
+			}
+
+			sum := sha256.Sum256(data)
+			entries[indexKey(rec.ID, rec.Key)] = IndexEntry{
+				ID:       rec.ID,
+				Key:      rec.Key,
+				Path:     rel,
+				Offset:   offset,
+				Size:     rec.Size,
+				Checksum: hex.EncodeToString(sum[:]),
+				Metadata: rec.Metadata,
+			}
+			return nil
+		})
+		if err != nil {
+			_ = idx.Close()
+			return err
+		}
+	}
+
+	all := make([]IndexEntry, 0, len(entries))
+	for _, e := range entries {
+		all = append(all, e)
+	}
+	if err = idx.Reset(all); err != nil {
+		_ = idx.Close()
+		return err
+	}
+
+	p.index = idx
+	return nil
+}
+
+// readSegment calls fn with each record of a segment, the offset of its data and
+// the data itself. A record that was cut short by a crash ends the segment.
+func readSegment(segment string, fn func(rec packRecord, offset int64, data []byte) error) error {
+	f, err := os.Open(segment) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		var size [4]byte
+		if _, err = io.ReadFull(r, size[:]); err == io.EOF { //nolint:errorlint
+			return nil
+		} else if err != nil {
+			break
+		}
+
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxRecordHeaderSize {
+			return fmt.Errorf("segment %s: record at %d has a header of %d bytes", segment, offset, n) //nolint:err113
+		}
+		header := make([]byte, n)
+		if _, err = io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		var rec packRecord
+		if err = json.Unmarshal(header, &rec); err != nil {
+			return fmt.Errorf("segment %s: record at %d: %w", segment, offset, err)
+		}
+		data := make([]byte, rec.Size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		offset += 4 + int64(n)
+		if err = fn(rec, offset, data); err != nil {
+			return err
+		}
+		offset += rec.Size
+	}
+
+	log.Printf("segment [%s] ends with an incomplete record at %d: %s\n", segment, offset, err.Error())
+	return nil
+}
+
+// readEntry reads the data of a packed entry.
+func (p *PackStore) readEntry(e IndexEntry) ([]byte, error) {
+	f, err := os.Open(filepath.Join(p.Root, e.Path)) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	data := make([]byte, e.Size)
+	_, err = f.ReadAt(data, e.Offset)
+	return data, err
+}
+
+// segments returns the paths of the segments, from the oldest to the newest.
+func (p *PackStore) segments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(p.Root, packDirName, "*.pack"))
+	sort.Strings(segments)
+	return segments, err
+}
+
+func (p *PackStore) openSegment(seq int) error {
+	f, err := os.OpenFile(filepath.Join(p.Root, p.segmentPath(seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	p.active, p.activeSeq, p.activeSize = f, seq, fi.Size()
+	return nil
+}
+
+func (p *PackStore) close() error {
+	err := p.active.Close()
+	if iErr := p.index.Close(); iErr != nil && err == nil {
+		err = iErr
+	}
+	return err
+}
+
+func (p *PackStore) segmentPath(seq int) string {
+	return fmt.Sprintf("%s/segment-%06d.pack", packDirName, seq)
+}
@@ -0,0 +1,192 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+)
+
+func TestPackStore(t *testing.T) {
+	p, err := NewPackStore(t.TempDir(), WithSmallObjectSize(16), WithSegmentSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close() }()
+
+	id := crypto.GenerateID()
+	payloads := map[string][]byte{
+		"small-0": []byte("tiny"),
+		"small-1": []byte("tiny bytes"),
+		"large":   bytes.Repeat([]byte("large bytes "), 10),
+	}
+
+	for key, data := range payloads {
+		if _, err = p.Write(id, key, bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+		if err = p.WriteMetadata(id, key, Metadata{Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if !p.objects.Has(id, "large") {
+		t.Error("expected the large object to be stored in its own file")
+	}
+	if _, ok := p.index.Get(id, "small-1"); !ok {
+		t.Error("expected the small object to be packed")
+	}
+
+	for key, data := range payloads {
+		_, r, rErr := p.Read(id, key)
+		if rErr != nil {
+			t.Error(rErr)
+			continue
+		}
+		b, _ := io.ReadAll(r)
+		if !bytes.Equal(b, data) {
+			t.Errorf("expected %s, got %s", data, b)
+		}
+
+		md, mdErr := p.ReadMetadata(id, key)
+		if mdErr != nil || md.Key != key {
+			t.Errorf("unexpected metadata %+v: %v", md, mdErr)
+		}
+	}
+
+	infos, err := p.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(infos))
+	}
+}
+
+func TestPackStoreCompact(t *testing.T) {
+	p, err := NewPackStore(t.TempDir(), WithSmallObjectSize(16), WithSegmentSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close() }()
+
+	id := crypto.GenerateID()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err = p.Write(id, key, bytes.NewReader([]byte(fmt.Sprintf("value-%d", i)))); err != nil {
+			t.Error(err)
+		}
+		if i%3 != 0 {
+			if err = p.Delete(id, key); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	reclaimed, err := p.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+	if reclaimed == 0 {
+		t.Error("expected some space to be reclaimed")
+	}
+
+	for i := 0; i < 10; i += 3 {
+		key := fmt.Sprintf("key-%d", i)
+		_, r, rErr := p.Read(id, key)
+		if rErr != nil {
+			t.Error(rErr)
+			continue
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != fmt.Sprintf("value-%d", i) {
+			t.Errorf("unexpected value %s for %s", b, key)
+		}
+	}
+}
+
+func TestPackStoreRebuild(t *testing.T) {
+	root := t.TempDir()
+	p, err := NewPackStore(root, WithSmallObjectSize(16), WithSegmentSize(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := crypto.GenerateID()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err = p.Write(id, key, bytes.NewReader([]byte(fmt.Sprintf("value-%d", i)))); err != nil {
+			t.Error(err)
+		}
+		if err = p.WriteMetadata(id, key, Metadata{Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < 10; i += 2 {
+		if err = p.Delete(id, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// An overwritten object does not keep the metadata of the old data.
+	if _, err = p.Write(id, "key-1", bytes.NewReader([]byte("new-value"))); err != nil {
+		t.Error(err)
+	}
+	if _, err = p.ReadMetadata(id, "key-1"); err == nil {
+		t.Error("expected the metadata of key-1 to be cleared")
+	}
+
+	if _, err = p.Compact(); err != nil {
+		t.Error(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if err = os.Remove(filepath.Join(root, packDirName, defaultIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewPackStore(root, WithSmallObjectSize(16), WithSegmentSize(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Close() }()
+
+	infos, err := p.List(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(infos) != 5 {
+		t.Errorf("expected 5 keys, got %+v", infos)
+	}
+
+	for i := 1; i < 10; i += 2 {
+		key := fmt.Sprintf("key-%d", i)
+		want := fmt.Sprintf("value-%d", i)
+		if i == 1 {
+			want = "new-value"
+		}
+
+		_, r, rErr := p.Read(id, key)
+		if rErr != nil {
+			t.Error(rErr)
+			continue
+		}
+		b, _ := io.ReadAll(r)
+		if string(b) != want {
+			t.Errorf("expected %s for %s, got %s", want, key, b)
+		}
+
+		md, mdErr := p.ReadMetadata(id, key)
+		if i != 1 && (mdErr != nil || md.Key != key) {
+			t.Errorf("unexpected metadata of %s %+v: %v", key, md, mdErr)
+		}
+	}
+	if p.Has(id, "key-4") {
+		t.Error("expected key-4 to stay deleted")
+	}
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrCapacityExceeded is an error that is returned when a write does not fit in the capacity of the store.
+	ErrCapacityExceeded = errors.New("storage capacity exceeded")
+	// ErrQuotaExceeded is an error that is returned when a write does not fit in the quota of its owner.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// Capacity describes how much data a store can hold. A Total of zero means
+// that the store is only limited by the free space of its disk.
+type Capacity struct {
+	Total int64
+	Used  int64
+	// Free is the amount of bytes that can still be written, taking the free
+	// space of the disk into account.
+	Free int64
+}
+
+// Limiter is implemented by backends that limit how much data they accept. Only Store
+// implements it; MemoryStore and PackStore accept writes until memory or disk runs out.
+type Limiter interface {
+	Capacity() (Capacity, error)
+	CheckQuota(id string, size int64) error
+}
+
+var _ Limiter = (*Store)(nil)
+
+// WithCapacity is a functional option for setting the maximum amount of bytes the Store holds.
+func WithCapacity(n int64) Option {
+	return func(s *Store) {
+		s.capacity = n
+	}
+}
+
+// WithQuota is a functional option for setting the maximum amount of bytes that each ID can
+// store. Quotas of specific IDs can be overridden with SetQuota.
+func WithQuota(n int64) Option {
+	return func(s *Store) {
+		s.defaultQuota = n
+	}
+}
+
+// SetQuota sets the maximum amount of bytes that the given ID can store. A quota of zero
+// removes the limit for the ID.
+func (s *Store) SetQuota(id string, n int64) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	if s.quotas == nil {
+		s.quotas = make(map[string]int64)
+	}
+	s.quotas[id] = n
+}
+
+// Quota returns the maximum amount of bytes that the given ID can store, zero meaning unlimited.
+func (s *Store) Quota(id string) int64 {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	if n, ok := s.quotas[id]; ok {
+		return n
+	}
+	return s.defaultQuota
+}
+
+// Usage returns the amount of bytes that the given ID stores, including the metadata files of its keys.
+func (s *Store) Usage(id string) (int64, error) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	if err := s.loadUsage(); err != nil {
+		return 0, err
+	}
+	return s.usage[id], nil
+}
+
+// Capacity returns the capacity of the store.
+func (s *Store) Capacity() (Capacity, error) {
+	s.quotaLock.Lock()
+	err := s.loadUsage()
+	used := s.used
+	s.quotaLock.Unlock()
+	if err != nil {
+		return Capacity{}, err
+	}
+
+	c := Capacity{Total: s.capacity, Used: used, Free: -1}
+	if s.capacity > 0 {
+		c.Free = max(s.capacity-used, 0)
+	}
+
+	if disk, dErr := diskFree(s.Root); dErr == nil && (c.Free < 0 || disk < c.Free) {
+		c.Free = disk
+	}
+
+	return c, nil
+}
+
+// CheckQuota checks if size more bytes can be stored for the given ID, returning
+// ErrCapacityExceeded or ErrQuotaExceeded if not.
+func (s *Store) CheckQuota(id string, size int64) error {
+	allowance, err := s.allowance(id)
+	if err != nil {
+		return err
+	}
+	if allowance.n >= 0 && size > allowance.n {
+		return fmt.Errorf("%w: %d bytes requested, %d bytes available", allowance.err, size, allowance.n)
+	}
+	return nil
+}
+
+type allowance struct {
+	n   int64
+	err error
+}
+
+// allowance returns how many bytes can still be written for the given ID, along
+// with the error to return when that limit is exceeded. A negative amount means
+// that there is no limit.
+func (s *Store) allowance(id string) (allowance, error) {
+	a := allowance{n: -1}
+	if s.capacity == 0 && s.Quota(id) == 0 {
+		return a, nil
+	}
+
+	c, err := s.Capacity()
+	if err != nil {
+		return a, err
+	}
+	if c.Free >= 0 {
+		a = allowance{n: c.Free, err: ErrCapacityExceeded}
+	}
+
+	if quota := s.Quota(id); quota > 0 {
+		used, err := s.Usage(id)
+		if err != nil {
+			return a, err
+		}
+		if left := max(quota-used, 0); a.n < 0 || left < a.n {
+			a = allowance{n: left, err: ErrQuotaExceeded}
+		}
+	}
+
+	return a, nil
+}
+
+// loadUsage counts the bytes that each ID stores, if they were not counted yet. From
+// then on the counters are kept up to date by addUsage, so the store is only walked
+// once. It also creates the root of the store, whose disk is asked for its free space.
+// The caller must hold quotaLock.
+func (s *Store) loadUsage() error {
+	if s.usage != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil { //nolint:gosec
+		return err
+	}
+
+	var entries []IndexEntry
+	if idx := s.openIndex(); idx != nil {
+		entries = idx.All()
+	} else {
+		var err error
+		if entries, err = s.scan(""); err != nil {
+			return err
+		}
+	}
+
+	s.usage = make(map[string]int64)
+	s.used = 0
+	for _, e := range entries {
+		size := e.Size + fileSize(filepath.Join(s.Root, e.Path+metadataSuffix))
+		s.usage[e.ID] += size
+		s.used += size
+	}
+	return nil
+}
+
+// fileSize returns the size of a file, or zero when it does not exist.
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// addUsage adds delta bytes to the usage of the given ID and of the store, when the
+// usage has been counted already.
+func (s *Store) addUsage(id string, delta int64) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	if s.usage == nil {
+		return
+	}
+	s.usage[id] += delta
+	s.used += delta
+	if s.usage[id] <= 0 {
+		delete(s.usage, id)
+	}
+}
+
+// resetUsage forgets the counted usage, so it is counted again when it is needed.
+func (s *Store) resetUsage() {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	s.usage = nil
+	s.used = 0
+}
+
+// limitedReader is a reader that fails with err once more than n bytes are read from it.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
@@ -1,23 +1,43 @@
 package store
 
 import (
-	//nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
-
-	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 )
 
-const defaultRootFolderName = "store"
+const (
+	defaultRootFolderName = "store"
+	tempSuffix            = ".tmp"
+)
 
 // Store is an interface that can be implemented to store.
 type Store struct {
 	// Root is the root directory of the store, containing all the folders/files of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+
+	indexEnabled bool
+	indexLock    sync.Mutex
+	index        *Index
+
+	capacity     int64
+	defaultQuota int64
+	quotaLock    sync.Mutex
+	quotas       map[string]int64
+	// usage is the amount of bytes that each ID stores and used the sum of it, both
+	// counted when they are first needed. usage is nil until then.
+	usage map[string]int64
+	used  int64
 }
 
 // Option is a functional option for configuring a Store.
@@ -37,6 +57,14 @@ func WithPathTransformFunc(f PathTransformFunc) Option {
 	}
 }
 
+// WithIndex is a functional option for enabling the embedded index of the Store.
+// When it is enabled, Has, Stat and List are answered from the index instead of the file system.
+func WithIndex(enabled bool) Option {
+	return func(s *Store) {
+		s.indexEnabled = enabled
+	}
+}
+
 // NewStore creates a new Store with the given options.
 func NewStore(opts ...Option) *Store {
 	s := &Store{
@@ -51,11 +79,24 @@ func NewStore(opts ...Option) *Store {
 
 // Clear clears the all folders/files in the storage.
 func (s *Store) Clear() error {
+	s.indexLock.Lock()
+	if s.index != nil {
+		_ = s.index.Close()
+		s.index = nil
+	}
+	s.indexLock.Unlock()
+	s.resetUsage()
+
 	return os.RemoveAll(s.Root)
 }
 
 // Has checks if a key exists in the storage.
 func (s *Store) Has(id, key string) bool {
+	if idx := s.openIndex(); idx != nil {
+		_, ok := idx.Get(id, key)
+		return ok
+	}
+
 	pathKey := s.PathTransformFunc(key)
 	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
@@ -72,8 +113,43 @@ func (s *Store) Delete(id, key string) error {
 		log.Printf("deleted [%s] from disk\n", pathKey.FullPath())
 	}()
 
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
-	return os.RemoveAll(pathNameWithRoot)
+	if idx := s.openIndex(); idx != nil {
+		if err := idx.Delete(id, key); err != nil {
+			return err
+		}
+	}
+
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	s.addUsage(id, -fileSize(fullPathWithRoot)-fileSize(fullPathWithRoot+metadataSuffix))
+	for _, path := range []string{fullPathWithRoot, fullPathWithRoot + metadataSuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return s.removeEmptyDirs(filepath.Dir(fullPathWithRoot))
+}
+
+// removeEmptyDirs removes the given directory and its parents as long as they are
+// empty, stopping at the root of the store.
+func (s *Store) removeEmptyDirs(dir string) error {
+	root := filepath.Clean(s.Root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		if err = os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Write writes a key to the storage.
@@ -83,13 +159,309 @@ func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
 
 // WriteDecrypt writes a key to the storage with decryption. It uses the given encryption key to decrypt the data.
 func (s *Store) WriteDecrypt(encryptKey []byte, id, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return WriteDecrypt(s, encryptKey, id, key, r)
+}
+
+// Link hard links the data of key from to key to, which is replaced at once if it exists.
+// Since writes replace the file of a key instead of writing into it, the keys do not
+// change each other afterwards. The metadata of from is not linked.
+func (s *Store) Link(id, from, to string) error {
+	fromPath := fmt.Sprintf("%s/%s/%s", s.Root, id, s.PathTransformFunc(from).FullPath())
+	toPathKey := s.PathTransformFunc(to)
+	if err := os.MkdirAll(fmt.Sprintf("%s/%s/%s", s.Root, id, toPathKey.PathName), os.ModePerm); err != nil { //nolint:gosec
+		return err
+	}
+
+	var oldSize int64
+	if fi, err := s.Stat(id, to); err == nil {
+		oldSize = fi.Size
+	}
+
+	// The link is made under a temporary name first, which then replaces the key at once.
+	toPath := fmt.Sprintf("%s/%s/%s", s.Root, id, toPathKey.FullPath())
+	if err := os.Remove(toPath + tempSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(fromPath, toPath+tempSuffix); err != nil {
+		return err
+	}
+	if err := os.Rename(toPath+tempSuffix, toPath); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(toPath)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	s.addUsage(id, fi.Size()-oldSize)
+
+	if idx := s.openIndex(); idx != nil {
+		e, ok := idx.Get(id, from)
+		if !ok {
+			e = IndexEntry{Size: fi.Size()}
+		}
+		return idx.Put(IndexEntry{
+			ID:       id,
+			Key:      to,
+			Path:     id + "/" + toPathKey.FullPath(),
+			Size:     e.Size,
+			Checksum: e.Checksum,
+		})
+	}
+
+	return nil
+}
+
+// Stat returns the information of a key in the storage.
+func (s *Store) Stat(id, key string) (FileInfo, error) {
+	if idx := s.openIndex(); idx != nil {
+		e, ok := idx.Get(id, key)
+		if !ok {
+			return FileInfo{}, fmt.Errorf("%s: %w", key, os.ErrNotExist)
+		}
+		return e.Info(), nil
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+
+	fi, err := os.Stat(pathNameWithRoot)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// List returns the information of all the keys that the given ID owns, sorted by key.
+func (s *Store) List(id string) ([]FileInfo, error) {
+	if idx := s.openIndex(); idx != nil {
+		entries := idx.List(id)
+		infos := make([]FileInfo, 0, len(entries))
+		for _, e := range entries {
+			infos = append(infos, e.Info())
+		}
+		return infos, nil
+	}
+
+	entries, err := s.scan(id)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]FileInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+// ListPrefix returns the information of the keys of the given ID that start with prefix,
+// sorted by key. Without the index, all the keys of the ID are scanned.
+func (s *Store) ListPrefix(id, prefix string) ([]FileInfo, error) {
+	if idx := s.openIndex(); idx != nil {
+		entries := idx.ListPrefix(id, prefix)
+		infos := make([]FileInfo, 0, len(entries))
+		for _, e := range entries {
+			infos = append(infos, e.Info())
+		}
+		return infos, nil
+	}
+
+	infos, err := s.List(id)
+	if err != nil {
+		return nil, err
+	}
+	return filterPrefix(infos, prefix), nil
+}
+
+// filterPrefix returns the infos whose key starts with prefix.
+func filterPrefix(infos []FileInfo, prefix string) []FileInfo {
+	var filtered []FileInfo
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Key, prefix) {
+			filtered = append(filtered, fi)
+		}
+	}
+	return filtered
+}
+
+// IDs returns the sorted IDs that own at least one key in the storage.
+func (s *Store) IDs() ([]string, error) {
+	if idx := s.openIndex(); idx != nil {
+		var ids []string
+		for _, e := range idx.All() {
+			if len(ids) == 0 || ids[len(ids)-1] != e.ID {
+				ids = append(ids, e.ID)
+			}
+		}
+		return ids, nil
 	}
 
-	n, err := crypto.CopyDecrypt(encryptKey, r, f)
-	return int64(n), err
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// RebuildIndex rebuilds the index from the blobs in the storage, which is
+// useful after the index log got corrupted or lost.
+func (s *Store) RebuildIndex() error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	return s.rebuildIndex()
+}
+
+// openIndex returns the index of the store, opening it on first use. The index is
+// rebuilt from the blobs when its log is corrupt, missing or empty. It returns nil
+// when the index is disabled or could not be opened, in which case the store falls
+// back to the file system.
+func (s *Store) openIndex() *Index {
+	if !s.indexEnabled {
+		return nil
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if s.index != nil {
+		return s.index
+	}
+
+	// A store that was written without the index, or whose log was lost, still holds
+	// blobs that an empty log does not know about.
+	var idx *Index
+	fi, err := os.Stat(s.indexPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist) || err == nil && fi.Size() == 0:
+		err = s.rebuildIndex()
+		idx = s.index
+	case err == nil:
+		idx, err = OpenIndex(s.indexPath())
+		if errors.Is(err, ErrCorruptIndex) {
+			log.Printf("rebuilding index of [%s]: %s\n", s.Root, err.Error())
+			err = s.rebuildIndex()
+			idx = s.index
+		}
+	}
+	if err != nil {
+		log.Printf("index open error: %s\n", err.Error())
+		return nil
+	}
+
+	s.index = idx
+	return idx
+}
+
+func (s *Store) rebuildIndex() error {
+	if s.index != nil {
+		_ = s.index.Close()
+		s.index = nil
+	}
+
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil { //nolint:gosec
+		return err
+	}
+	if err := os.WriteFile(s.indexPath(), nil, 0o600); err != nil {
+		return err
+	}
+
+	idx, err := OpenIndex(s.indexPath())
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.scan("")
+	if err != nil {
+		_ = idx.Close()
+		return err
+	}
+	if err = idx.Reset(entries); err != nil {
+		_ = idx.Close()
+		return err
+	}
+
+	s.index = idx
+	return nil
+}
+
+// scan walks the blobs of the given ID, or of every ID when it is empty, and
+// returns an index entry for each of them. Keys are recovered from the metadata
+// of each file, since the path transform function may not be reversible. Files
+// without metadata are only listed when their file name is their key, and skipped
+// otherwise, as they could not be found by their key anyway.
+func (s *Store) scan(id string) ([]IndexEntry, error) {
+	var entries []IndexEntry
+
+	root := filepath.Join(s.Root, id)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if d.IsDir() || len(parts) < 2 || strings.HasSuffix(path, metadataSuffix) || strings.HasSuffix(path, tempSuffix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		key := d.Name()
+		md, mdErr := readMetadataFile(path + metadataSuffix)
+		if mdErr == nil && md.Key != "" {
+			key = md.Key
+		} else if s.PathTransformFunc(key).FullPath() != strings.Join(parts[1:], "/") {
+			log.Printf("skipping blob [%s] without metadata, its key can not be recovered\n", rel)
+			return nil
+		}
+
+		checksum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, IndexEntry{
+			ID:         parts[0],
+			Key:        key,
+			Path:       filepath.ToSlash(rel),
+			Size:       fi.Size(),
+			Checksum:   checksum,
+			CreatedAt:  fi.ModTime(),
+			ModifiedAt: fi.ModTime(),
+			Metadata:   metadataOf(md, mdErr),
+		})
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return entries, err
+}
+
+func (s *Store) indexPath() string {
+	return filepath.Join(s.Root, defaultIndexFileName)
 }
 
 func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
@@ -99,18 +471,59 @@ func (s *Store) openFileForWriting(id, key string) (*os.File, error) {
 		return nil, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	// The data is written to a temporary file first, which replaces the key once
+	// it is complete, so an interrupted write never leaves a truncated key behind.
+	fullPathWithRoot := fmt.Sprintf("%s/%s/%s%s", s.Root, id, pathKey.FullPath(), tempSuffix)
 
 	return os.Create(fullPathWithRoot) //nolint:gosec
 }
 
 func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
+	allowance, err := s.allowance(id)
+	if err != nil {
+		return 0, err
+	}
+	// The old content of the key is replaced, so its space can be reused.
+	var oldSize int64
+	if fi, sErr := s.Stat(id, key); sErr == nil {
+		oldSize = fi.Size
+	}
+	if allowance.n >= 0 {
+		r = &limitedReader{r: r, n: allowance.n + oldSize, err: allowance.err}
+	}
+
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
 
-	return io.Copy(f, r)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return n, err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	if err = os.Rename(f.Name(), strings.TrimSuffix(f.Name(), tempSuffix)); err != nil {
+		return n, err
+	}
+	s.addUsage(id, n-oldSize)
+
+	if idx := s.openIndex(); idx != nil {
+		err = idx.Put(IndexEntry{
+			ID:       id,
+			Key:      key,
+			Path:     id + "/" + pathKey.FullPath(),
+			Size:     n,
+			Checksum: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	return n, err
 }
 
 func (s *Store) Read(id, key string) (int64, io.Reader, error) {
@@ -133,3 +546,17 @@ func (s *Store) readStream(id, key string) (int64, io.ReadCloser, error) {
 
 	return fi.Size(), file, nil
 }
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,11 +2,15 @@ package store
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"reflect"
 	"testing"
 
 	"github.com/yigithankarabulut/distributed-file-storage/crypto"
+	"github.com/yigithankarabulut/distributed-file-storage/vclock"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -92,3 +96,221 @@ func teardown(s *Store, t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMetadata(t *testing.T) {
+	s := newStore()
+	id := crypto.GenerateID()
+	defer teardown(s, t)
+
+	key := "my-special-log"
+	if _, err := s.writeStream(id, key, bytes.NewReader([]byte("some log lines"))); err != nil {
+		t.Error(err)
+	}
+
+	md := Metadata{Key: key, Compression: "gzip", Clock: vclock.Clock{"node": 1}}
+	if err := s.WriteMetadata(id, key, md); err != nil {
+		t.Error(err)
+	}
+
+	got, err := s.ReadMetadata(id, key)
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(got, md) {
+		t.Errorf("expected %+v, got %+v", md, got)
+	}
+
+	if err := s.Delete(id, key); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := s.ReadMetadata(id, key); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestBackends(t *testing.T) {
+	backends := map[string]Backend{
+		"disk":   newStore(),
+		"memory": NewMemoryStore(),
+	}
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			id := crypto.GenerateID()
+			defer func() { _ = b.Clear() }()
+
+			for i := 0; i < 3; i++ {
+				key := fmt.Sprintf("bar-%d", i)
+				data := []byte("some png bytes")
+
+				if _, err := b.Write(id, key, bytes.NewReader(data)); err != nil {
+					t.Error(err)
+				}
+				if err := b.WriteMetadata(id, key, Metadata{Key: key}); err != nil {
+					t.Error(err)
+				}
+
+				fi, err := b.Stat(id, key)
+				if err != nil {
+					t.Error(err)
+				}
+				if fi.Size != int64(len(data)) {
+					t.Errorf("expected size %d, got %d", len(data), fi.Size)
+				}
+			}
+
+			infos, err := b.List(id)
+			if err != nil {
+				t.Error(err)
+			}
+			if len(infos) != 3 || infos[0].Key != "bar-0" || infos[2].Key != "bar-2" {
+				t.Errorf("unexpected listing %+v", infos)
+			}
+
+			if err := b.Delete(id, "bar-1"); err != nil {
+				t.Error(err)
+			}
+			if b.Has(id, "bar-1") {
+				t.Error("expected to not have key bar-1")
+			}
+			if _, err := b.Stat(id, "bar-1"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected not exist error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+		WithIndex(true),
+		WithCapacity(100),
+		WithQuota(40),
+	)
+	id := crypto.GenerateID()
+	data := bytes.Repeat([]byte("a"), 30)
+
+	if _, err := s.Write(id, "first", bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+	if err := s.CheckQuota(id, 30); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected quota error, got %v", err)
+	}
+	if _, err := s.Write(id, "second", bytes.NewReader(data)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected quota error, got %v", err)
+	}
+	if s.Has(id, "second") {
+		t.Error("expected the refused key to not exist")
+	}
+
+	// Overwriting a key reuses its space.
+	if _, err := s.Write(id, "first", bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+
+	s.SetQuota(id, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Write(id, fmt.Sprintf("more-%d", i), bytes.NewReader(data)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.CheckQuota(id, 30); !errors.Is(err, ErrCapacityExceeded) {
+		t.Errorf("expected capacity error, got %v", err)
+	}
+
+	c, err := s.Capacity()
+	if err != nil {
+		t.Error(err)
+	}
+	if c.Total != 100 || c.Used != 90 || c.Free != 10 {
+		t.Errorf("unexpected capacity %+v", c)
+	}
+}
+
+func TestLink(t *testing.T) {
+	s := NewStore(
+		WithRoot(t.TempDir()),
+		WithPathTransformFunc(CASPathTransformFunc),
+		WithIndex(true),
+	)
+	id := crypto.GenerateID()
+
+	if _, err := s.Write(id, "current", bytes.NewReader([]byte("first"))); err != nil {
+		t.Error(err)
+	}
+	if err := s.Link(id, "current", "version"); err != nil {
+		t.Error(err)
+	}
+
+	// The keys share the file of the data until one of them is written.
+	current, _ := os.Stat(s.Root + "/" + id + "/" + CASPathTransformFunc("current").FullPath())
+	version, _ := os.Stat(s.Root + "/" + id + "/" + CASPathTransformFunc("version").FullPath())
+	if !os.SameFile(current, version) {
+		t.Error("expected the keys to share their file")
+	}
+
+	if _, err := s.Write(id, "current", bytes.NewReader([]byte("second"))); err != nil {
+		t.Error(err)
+	}
+	for key, expected := range map[string]string{"current": "second", "version": "first"} {
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Error(err)
+		}
+		b, _ := io.ReadAll(r)
+		if rc, ok := r.(io.Closer); ok {
+			_ = rc.Close()
+		}
+		if string(b) != expected {
+			t.Errorf("expected %s to be %s, got %s", key, expected, b)
+		}
+	}
+	if fi, err := s.Stat(id, "version"); err != nil || fi.Size != 5 {
+		t.Errorf("unexpected stat of the link %+v: %v", fi, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(WithRoot(root), WithCapacity(1000))
+	id := crypto.GenerateID()
+
+	for _, key := range []string{"first", "second"} {
+		if _, err := s.Write(id, key, bytes.NewReader(bytes.Repeat([]byte("a"), 30))); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := s.Write(id, "first", bytes.NewReader(bytes.Repeat([]byte("a"), 10))); err != nil {
+		t.Error(err)
+	}
+	// The metadata files count towards the usage as well.
+	for _, key := range []string{"first", "second"} {
+		if err := s.WriteMetadata(id, key, Metadata{Key: key}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.Delete(id, "second"); err != nil {
+		t.Error(err)
+	}
+	mdSize := fileSize(s.metadataPath(id, "first"))
+	if mdSize == 0 {
+		t.Error("expected the metadata of first to be written")
+	}
+
+	// The usage that is kept while writing and deleting matches a fresh count.
+	for _, store := range []*Store{s, NewStore(WithRoot(root), WithCapacity(1000))} {
+		used, err := store.Usage(id)
+		if err != nil {
+			t.Error(err)
+		}
+		c, err := store.Capacity()
+		if err != nil {
+			t.Error(err)
+		}
+		if used != 10+mdSize || c.Used != 10+mdSize {
+			t.Errorf("expected %d bytes to be used, got %d and %+v", 10+mdSize, used, c)
+		}
+	}
+}
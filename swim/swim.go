@@ -0,0 +1,515 @@
+// Package swim implements the SWIM membership protocol. Every node probes a member each
+// protocol period, asks other members to probe it indirectly when it does not answer,
+// and suspects it when none of them got an answer either. Suspected members that do not
+// refute the suspicion with a higher incarnation number in time are declared dead.
+// Changes in membership are gossiped by piggybacking them on the probes.
+package swim
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a member.
+type State int
+
+const (
+	// Alive members answer to probes.
+	Alive State = iota
+	// Suspect members did not answer to a probe, and are declared dead unless they refute it.
+	Suspect
+	// Dead members did not refute the suspicion in time.
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is a node of the cluster as seen by a member list.
+type Member struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// Kind is the kind of a message.
+type Kind int
+
+const (
+	// Ping probes the receiver, which answers with an Ack.
+	Ping Kind = iota
+	// Ack answers a Ping.
+	Ack
+	// PingReq asks the receiver to probe the target on behalf of the sender.
+	PingReq
+)
+
+// Update is a change in membership that is gossiped along with the messages.
+type Update struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// Message is a message of the protocol.
+type Message struct {
+	Kind     Kind
+	Seq      uint64
+	From     string
+	FromAddr string
+	// Target is the member that a PingReq asks to probe.
+	Target     string
+	TargetAddr string
+	Updates    []Update
+}
+
+const (
+	defaultProbeInterval    = time.Second
+	defaultProbeTimeout     = 300 * time.Millisecond
+	defaultSuspicionTimeout = 5 * time.Second
+	defaultIndirectProbes   = 3
+	defaultMaxUpdates       = 8
+	// retransmitMult scales the amount of times an update is gossiped with the log of the cluster size.
+	retransmitMult = 3
+)
+
+// ErrNoSend is returned by New when the configuration has no Send function.
+var ErrNoSend = errors.New("swim: no send function configured")
+
+// Config is the configuration of a member list.
+type Config struct {
+	// ID and Addr identify this node to the other members.
+	ID   string
+	Addr string
+
+	// ProbeInterval is the length of a protocol period, in which one member is probed.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long a direct probe is waited for before probing indirectly.
+	ProbeTimeout time.Duration
+	// SuspicionTimeout is how long a member is suspected before it is declared dead.
+	SuspicionTimeout time.Duration
+	// IndirectProbes is the amount of members that are asked to probe a member that
+	// did not answer a direct probe.
+	IndirectProbes int
+	// MaxUpdates is the maximum amount of updates piggybacked on a message.
+	MaxUpdates int
+
+	// Send sends a message to the member with the given address. Messages may be lost.
+	Send func(addr string, msg Message) error
+	// OnChange is called when the state of a member changes.
+	OnChange func(Member)
+}
+
+// Memberlist is the view of a node on the members of its cluster.
+type Memberlist struct {
+	cfg Config
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*member
+	probeOrder  []string
+	seq         uint64
+	// acks are the probes of this node that are waiting for an ack, by sequence number.
+	acks map[uint64]chan struct{}
+	// relays are the probes sent on behalf of other members, by sequence number.
+	relays  map[uint64]relay
+	updates []*update
+}
+
+type member struct {
+	Member
+	suspectedAt time.Time
+}
+
+type relay struct {
+	addr string
+	seq  uint64
+}
+
+type update struct {
+	Update
+	transmits int
+}
+
+// New creates a member list that only knows about this node.
+func New(cfg Config) (*Memberlist, error) {
+	if cfg.Send == nil {
+		return nil, ErrNoSend
+	}
+	if cfg.ProbeInterval == 0 {
+		cfg.ProbeInterval = defaultProbeInterval
+	}
+	if cfg.ProbeTimeout == 0 {
+		cfg.ProbeTimeout = defaultProbeTimeout
+	}
+	if cfg.SuspicionTimeout == 0 {
+		cfg.SuspicionTimeout = defaultSuspicionTimeout
+	}
+	if cfg.IndirectProbes == 0 {
+		cfg.IndirectProbes = defaultIndirectProbes
+	}
+	if cfg.MaxUpdates == 0 {
+		cfg.MaxUpdates = defaultMaxUpdates
+	}
+
+	return &Memberlist{
+		cfg:     cfg,
+		members: make(map[string]*member),
+		acks:    make(map[uint64]chan struct{}),
+		relays:  make(map[uint64]relay),
+	}, nil
+}
+
+// Join adds a member that is known to be reachable, e.g. because it just connected.
+// A member that was suspected or declared dead is revived with a higher incarnation,
+// which the member takes over once it is suspected again.
+func (m *Memberlist) Join(id, addr string) {
+	var incarnation uint64
+
+	m.mu.Lock()
+	if mb, ok := m.members[id]; ok {
+		incarnation = mb.Incarnation
+		if mb.State != Alive {
+			incarnation++
+		}
+	}
+	m.mu.Unlock()
+
+	m.apply([]Update{{ID: id, Addr: addr, State: Alive, Incarnation: incarnation}})
+}
+
+// Members returns all the members, including this node, sorted by ID.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := []Member{{ID: m.cfg.ID, Addr: m.cfg.Addr, State: Alive, Incarnation: m.incarnation}}
+	for _, mb := range m.members {
+		members = append(members, mb.Member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// Member returns the member with the given ID.
+func (m *Memberlist) Member(id string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mb, ok := m.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return mb.Member, true
+}
+
+// Run probes a member every protocol period until done is closed.
+func (m *Memberlist) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(m.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.expireSuspects()
+			go m.Probe()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Probe runs a single protocol period: it probes the next member directly, then
+// indirectly through other members, and suspects it when no ack arrived.
+func (m *Memberlist) Probe() {
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+
+	seq, ch := m.expectAck()
+	defer m.forgetAck(seq)
+
+	m.send(target.Addr, Message{Kind: Ping, Seq: seq, Target: target.ID, TargetAddr: target.Addr})
+
+	select {
+	case <-ch:
+		return
+	case <-time.After(m.cfg.ProbeTimeout):
+	}
+
+	for _, mb := range m.randomMembers(m.cfg.IndirectProbes, target.ID) {
+		m.send(mb.Addr, Message{Kind: PingReq, Seq: seq, Target: target.ID, TargetAddr: target.Addr})
+	}
+
+	select {
+	case <-ch:
+		return
+	case <-time.After(m.cfg.ProbeInterval - m.cfg.ProbeTimeout):
+	}
+
+	m.suspect(target)
+}
+
+// Handle handles a message received from another member.
+func (m *Memberlist) Handle(msg Message) {
+	updates := msg.Updates
+	if msg.From != "" && msg.FromAddr != "" {
+		// The sender is evidently alive, which is news only if it is not known yet.
+		m.mu.Lock()
+		_, known := m.members[msg.From]
+		m.mu.Unlock()
+		if !known {
+			updates = append(updates, Update{ID: msg.From, Addr: msg.FromAddr, State: Alive})
+		}
+	}
+	m.apply(updates)
+
+	switch msg.Kind {
+	case Ping:
+		m.send(msg.FromAddr, Message{Kind: Ack, Seq: msg.Seq})
+
+	case Ack:
+		m.mu.Lock()
+		ch, waiting := m.acks[msg.Seq]
+		r, relayed := m.relays[msg.Seq]
+		delete(m.relays, msg.Seq)
+		m.mu.Unlock()
+
+		if waiting {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		if relayed {
+			m.send(r.addr, Message{Kind: Ack, Seq: r.seq})
+		}
+
+	case PingReq:
+		m.mu.Lock()
+		m.seq++
+		seq := m.seq
+		m.relays[seq] = relay{addr: msg.FromAddr, seq: msg.Seq}
+		m.mu.Unlock()
+
+		time.AfterFunc(m.cfg.ProbeInterval, func() {
+			m.mu.Lock()
+			delete(m.relays, seq)
+			m.mu.Unlock()
+		})
+
+		m.send(msg.TargetAddr, Message{Kind: Ping, Seq: seq, Target: msg.Target, TargetAddr: msg.TargetAddr})
+	}
+}
+
+// send sends a message with the updates to gossip piggybacked on it.
+func (m *Memberlist) send(addr string, msg Message) {
+	msg.From, msg.FromAddr = m.cfg.ID, m.cfg.Addr
+	msg.Updates = m.takeUpdates()
+	_ = m.cfg.Send(addr, msg)
+}
+
+func (m *Memberlist) expectAck() (uint64, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	ch := make(chan struct{}, 1)
+	m.acks[m.seq] = ch
+	return m.seq, ch
+}
+
+func (m *Memberlist) forgetAck(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.acks, seq)
+}
+
+// nextTarget returns the next member to probe. Members are probed in a random order
+// that is reshuffled after every round, so each member is probed once per round.
+func (m *Memberlist) nextTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(m.probeOrder) > 0 {
+			id := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if mb, ok := m.members[id]; ok && mb.State != Dead {
+				return mb.Member, true
+			}
+		}
+
+		for id, mb := range m.members {
+			if mb.State != Dead {
+				m.probeOrder = append(m.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+	}
+
+	return Member{}, false
+}
+
+// randomMembers returns up to n random alive members other than the one with the given ID.
+func (m *Memberlist) randomMembers(n int, exclude string) []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var candidates []Member
+	for id, mb := range m.members {
+		if id != exclude && mb.State == Alive {
+			candidates = append(candidates, mb.Member)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+func (m *Memberlist) suspect(target Member) {
+	m.apply([]Update{{ID: target.ID, Addr: target.Addr, State: Suspect, Incarnation: target.Incarnation}})
+}
+
+// expireSuspects declares the members dead that have been suspected for too long.
+func (m *Memberlist) expireSuspects() {
+	m.mu.Lock()
+	var expired []Update
+	for _, mb := range m.members {
+		if mb.State == Suspect && time.Since(mb.suspectedAt) > m.cfg.SuspicionTimeout {
+			expired = append(expired, Update{ID: mb.ID, Addr: mb.Addr, State: Dead, Incarnation: mb.Incarnation})
+		}
+	}
+	m.mu.Unlock()
+
+	m.apply(expired)
+}
+
+// apply applies updates to the member list, gossiping and reporting those that change it.
+func (m *Memberlist) apply(updates []Update) {
+	var changed []Member
+
+	m.mu.Lock()
+	for _, u := range updates {
+		if u.ID == m.cfg.ID {
+			// Refute a suspicion or death of this node with a higher incarnation.
+			if u.State != Alive && u.Incarnation >= m.incarnation {
+				m.incarnation = u.Incarnation + 1
+				m.queue(Update{ID: m.cfg.ID, Addr: m.cfg.Addr, State: Alive, Incarnation: m.incarnation})
+			}
+			continue
+		}
+
+		mb, ok := m.members[u.ID]
+		if ok && !overrides(u, mb.Member) {
+			continue
+		}
+		if !ok {
+			mb = &member{}
+			m.members[u.ID] = mb
+		}
+
+		mb.Member = Member(u)
+		if u.State == Suspect {
+			mb.suspectedAt = time.Now()
+		}
+		m.queue(u)
+		changed = append(changed, mb.Member)
+	}
+	m.mu.Unlock()
+
+	if m.cfg.OnChange != nil {
+		for _, mb := range changed {
+			m.cfg.OnChange(mb)
+		}
+	}
+}
+
+// overrides reports whether an update overrides what is known about a member.
+func overrides(u Update, mb Member) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > mb.Incarnation
+	case Suspect:
+		if mb.State == Alive {
+			return u.Incarnation >= mb.Incarnation
+		}
+		return u.Incarnation > mb.Incarnation
+	case Dead:
+		if mb.State != Dead {
+			return u.Incarnation >= mb.Incarnation
+		}
+		return u.Incarnation > mb.Incarnation
+	}
+	return false
+}
+
+// queue queues an update to be gossiped, replacing older updates of the same member.
+// The lock must be held.
+func (m *Memberlist) queue(u Update) {
+	for i, q := range m.updates {
+		if q.ID == u.ID {
+			m.updates = append(m.updates[:i], m.updates[i+1:]...)
+			break
+		}
+	}
+	m.updates = append(m.updates, &update{Update: u})
+}
+
+// takeUpdates returns the updates to piggyback on a message, preferring the ones that
+// were gossiped the least. Updates are dropped once they were gossiped often enough to
+// have reached every member with high probability.
+func (m *Memberlist) takeUpdates() []Update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	limit := retransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+2))))
+
+	sort.SliceStable(m.updates, func(i, j int) bool {
+		return m.updates[i].transmits < m.updates[j].transmits
+	})
+
+	var updates []Update
+	for _, u := range m.updates {
+		if len(updates) == m.cfg.MaxUpdates {
+			break
+		}
+		updates = append(updates, u.Update)
+		u.transmits++
+	}
+
+	kept := m.updates[:0]
+	for _, u := range m.updates {
+		if u.transmits < limit {
+			kept = append(kept, u)
+		}
+	}
+	m.updates = kept
+
+	return updates
+}
@@ -0,0 +1,159 @@
+package swim
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// network delivers the messages between member lists in memory, dropping the
+// messages from and to the nodes that are down.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Memberlist
+	down  map[string]bool
+}
+
+func (n *network) send(from string) func(string, Message) error {
+	return func(addr string, msg Message) error {
+		n.mu.Lock()
+		to, ok := n.nodes[addr]
+		drop := n.down[from] || n.down[addr]
+		n.mu.Unlock()
+
+		if ok && !drop {
+			go to.Handle(msg)
+		}
+		return nil
+	}
+}
+
+func (n *network) setDown(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = true
+}
+
+func states(m *Memberlist) map[string]State {
+	s := make(map[string]State)
+	for _, mb := range m.Members() {
+		s[mb.ID] = mb.State
+	}
+	return s
+}
+
+func TestMemberlist(t *testing.T) {
+	net := &network{nodes: make(map[string]*Memberlist), down: make(map[string]bool)}
+	done := make(chan struct{})
+	defer close(done)
+
+	var lists []*Memberlist
+	for i := 0; i < 5; i++ {
+		addr := fmt.Sprintf("node-%d", i)
+		m, err := New(Config{
+			ID:               addr,
+			Addr:             addr,
+			ProbeInterval:    50 * time.Millisecond,
+			ProbeTimeout:     15 * time.Millisecond,
+			SuspicionTimeout: 200 * time.Millisecond,
+			Send:             net.send(addr),
+		})
+		assert.Nil(t, err)
+
+		net.mu.Lock()
+		net.nodes[addr] = m
+		net.mu.Unlock()
+		lists = append(lists, m)
+	}
+
+	// Every node only knows the first one, and learns about the others through gossip.
+	for _, m := range lists[1:] {
+		m.Join("node-0", "node-0")
+	}
+	for _, m := range lists {
+		go m.Run(done)
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, m := range lists {
+			s := states(m)
+			if len(s) != 5 {
+				return false
+			}
+			for _, state := range s {
+				if state != Alive {
+					return false
+				}
+			}
+		}
+		return true
+	}, 3*time.Second, 20*time.Millisecond)
+
+	net.setDown("node-4")
+
+	assert.Eventually(t, func() bool {
+		for _, m := range lists[:4] {
+			if states(m)["node-4"] != Dead {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+
+	for _, m := range lists[:4] {
+		for id, state := range states(m) {
+			if id != "node-4" {
+				assert.Equal(t, Alive, state)
+			}
+		}
+	}
+}
+
+func TestRefute(t *testing.T) {
+	m, err := New(Config{ID: "a", Addr: "a", Send: func(string, Message) error { return nil }})
+	assert.Nil(t, err)
+
+	m.Handle(Message{Kind: Ack, Updates: []Update{{ID: "a", Addr: "a", State: Suspect}}})
+	assert.Equal(t, uint64(1), m.Members()[0].Incarnation)
+
+	// The refutation is gossiped with the next message.
+	updates := m.takeUpdates()
+	assert.Contains(t, updates, Update{ID: "a", Addr: "a", State: Alive, Incarnation: 1})
+
+	m.Join("b", "b")
+	m.Handle(Message{Kind: Ack, Updates: []Update{{ID: "b", Addr: "b", State: Suspect}}})
+	mb, _ := m.Member("b")
+	assert.Equal(t, Suspect, mb.State)
+
+	m.Handle(Message{Kind: Ack, Updates: []Update{{ID: "b", Addr: "b", State: Alive, Incarnation: 1}}})
+	mb, _ = m.Member("b")
+	assert.Equal(t, Alive, mb.State)
+	assert.Equal(t, uint64(1), mb.Incarnation)
+
+	_, err = New(Config{ID: "c"})
+	assert.ErrorIs(t, err, ErrNoSend)
+}
+
+func TestJoinRevives(t *testing.T) {
+	m, err := New(Config{ID: "a", Addr: "a", Send: func(string, Message) error { return nil }})
+	assert.Nil(t, err)
+
+	m.Join("b", "b")
+	m.Handle(Message{Kind: Ack, Updates: []Update{{ID: "b", Addr: "b", State: Dead}}})
+	mb, _ := m.Member("b")
+	assert.Equal(t, Dead, mb.State)
+
+	// A member that connects again after it was declared dead is alive, and the stale
+	// death that is still gossiped does not override that.
+	m.Join("b", "b")
+	mb, _ = m.Member("b")
+	assert.Equal(t, Alive, mb.State)
+	assert.Equal(t, uint64(1), mb.Incarnation)
+
+	m.Handle(Message{Kind: Ack, Updates: []Update{{ID: "b", Addr: "b", State: Dead}}})
+	mb, _ = m.Member("b")
+	assert.Equal(t, Alive, mb.State)
+}
@@ -0,0 +1,114 @@
+package vclock
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Ordering is the causal relation between two clocks.
+type Ordering int
+
+const (
+	// Equal means that both clocks have seen exactly the same events.
+	Equal Ordering = iota
+	// Before means that the clock happened before the other one.
+	Before
+	// After means that the clock happened after the other one.
+	After
+	// Concurrent means that neither clock has seen all the events of the other one.
+	Concurrent
+)
+
+// String returns the name of the ordering.
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	case Concurrent:
+		return "concurrent"
+	}
+	return "unknown"
+}
+
+// Clock is a version vector, counting the writes that each node has made.
+// The zero value is an empty clock that happened before any other clock.
+type Clock map[string]uint64
+
+// Copy returns a copy of the clock.
+func (c Clock) Copy() Clock {
+	cp := make(Clock, len(c))
+	for node, n := range c {
+		cp[node] = n
+	}
+	return cp
+}
+
+// Tick returns a copy of the clock with the counter of the given node incremented.
+func (c Clock) Tick(node string) Clock {
+	cp := c.Copy()
+	cp[node]++
+	return cp
+}
+
+// Merge returns a clock that has seen all the events of both clocks.
+func (c Clock) Merge(other Clock) Clock {
+	cp := c.Copy()
+	for node, n := range other {
+		if n > cp[node] {
+			cp[node] = n
+		}
+	}
+	return cp
+}
+
+// Compare returns how the clock is ordered relative to the other clock.
+func (c Clock) Compare(other Clock) Ordering {
+	var before, after bool
+
+	for node, n := range c {
+		if n > other[node] {
+			after = true
+		}
+	}
+	for node, n := range other {
+		if n > c[node] {
+			before = true
+		}
+	}
+
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return Before
+	case after:
+		return After
+	}
+	return Equal
+}
+
+// Descends reports whether the clock has seen all the events of the other clock.
+func (c Clock) Descends(other Clock) bool {
+	o := c.Compare(other)
+	return o == After || o == Equal
+}
+
+// String returns the clock in a stable, human-readable form.
+func (c Clock) String() string {
+	nodes := make([]string, 0, len(c))
+	for node := range c {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, node+":"+strconv.FormatUint(c[node], 10))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,30 @@
+package vclock
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	var empty Clock
+	a := empty.Tick("a")
+	ab := a.Tick("b")
+	ac := a.Tick("c")
+
+	assert.Equal(t, Equal, empty.Compare(Clock{}))
+	assert.Equal(t, Before, empty.Compare(a))
+	assert.Equal(t, After, ab.Compare(a))
+	assert.Equal(t, Before, a.Compare(ab))
+	assert.Equal(t, Concurrent, ab.Compare(ac))
+	assert.True(t, ab.Descends(a))
+	assert.False(t, ab.Descends(ac))
+
+	merged := ab.Merge(ac)
+	assert.Equal(t, After, merged.Compare(ab))
+	assert.Equal(t, After, merged.Compare(ac))
+	assert.Equal(t, "{a:1, b:1, c:1}", merged.String())
+
+	// Ticking and merging never modify the original clock.
+	assert.Equal(t, Clock{"a": 1}, a)
+}